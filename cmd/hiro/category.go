@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/bradfitz/slice"
+	"github.com/hiroapp/cli/db"
+)
+
+// MoveCategory moves the category at the src path to the dst path, changing
+// its name and parent as needed, and returns the number of entries belonging
+// to it or its sub categories. The parent of dst is created if it doesn't
+// exist and create is true. An error is returned if dst already exists, or is
+// inside of src. The category is moved within a transaction, so nothing is
+// changed if an error is returned.
+func MoveCategory(d db.DB, src, dst []string, create bool) (int, error) {
+	if len(src) == 0 || len(dst) == 0 {
+		return 0, errors.New("category must not be empty")
+	} else if len(dst) > len(src) && joinCategory(dst[:len(src)]) == joinCategory(src) {
+		return 0, errors.New("category can't be moved into itself")
+	}
+	var n int
+	err := d.Transaction(func(tx db.DB) error {
+		srcPath, err := tx.CategoryPath(src, false)
+		if err != nil {
+			return err
+		} else if _, err := tx.CategoryPath(dst, false); err == nil {
+			return fmt.Errorf("category already exists: %s", joinCategory(dst))
+		}
+		parentPath, err := tx.CategoryPath(dst[:len(dst)-1], create)
+		if err != nil {
+			return err
+		}
+		itr, err := tx.Query(db.Query{CategoryID: srcPath.CategoryID(), Recursive: true})
+		if err != nil {
+			return err
+		}
+		entries, err := db.IteratorEntries(itr)
+		if err != nil {
+			return err
+		}
+		category := srcPath[len(srcPath)-1]
+		category.Name = dst[len(dst)-1]
+		category.ParentID = parentPath.CategoryID()
+		n = len(entries)
+		return tx.SaveCategory(category)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// joinCategory is the inverse of ParseCategory.
+func joinCategory(names []string) string {
+	return strings.Join(names, categorySeparator)
+}
+
+// MergeCategory merges the category at the src path into the category at the
+// dst path and returns the number of entries that were reassigned. If src and
+// dst are the same path, all duplicates of it are merged into one of them.
+// The categories are merged within a transaction, so nothing is changed if an
+// error is returned.
+func MergeCategory(d db.DB, src, dst []string) (int, error) {
+	var n int
+	err := d.Transaction(func(tx db.DB) error {
+		categories, err := tx.Categories()
+		if err != nil {
+			return err
+		}
+		var srcNodes, dstNodes []*db.CategoryNode
+		if joinCategory(src) == joinCategory(dst) {
+			nodes := FindCategories(categories.Root(), src)
+			if len(nodes) < 2 {
+				return fmt.Errorf("category is not duplicated: %s", joinCategory(src))
+			}
+			slice.Sort(nodes, func(i, j int) bool { return nodes[i].ID < nodes[j].ID })
+			srcNodes, dstNodes = nodes[1:], nodes[:1]
+		} else {
+			srcNodes = FindCategories(categories.Root(), src)
+			dstNodes = FindCategories(categories.Root(), dst)
+			for _, nodes := range [][]*db.CategoryNode{srcNodes, dstNodes} {
+				if len(nodes) == 0 {
+					return errors.New("category does not exist")
+				} else if len(nodes) > 1 {
+					return errors.New("category exists more than once")
+				}
+			}
+		}
+		n = 0
+		for _, node := range srcNodes {
+			itr, err := tx.Query(db.Query{CategoryID: node.ID, Recursive: true})
+			if err != nil {
+				return err
+			}
+			entries, err := db.IteratorEntries(itr)
+			if err != nil {
+				return err
+			} else if err := tx.MergeCategory(node.ID, dstNodes[0].ID); err != nil {
+				return err
+			}
+			n += len(entries)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// FindCategories returns the nodes below root matching the given path. Unlike
+// db.DB.CategoryPath, all matches are returned if categories are duplicated.
+func FindCategories(root *db.CategoryNode, names []string) []*db.CategoryNode {
+	nodes := []*db.CategoryNode{root}
+	for _, name := range names {
+		var children []*db.CategoryNode
+		for _, node := range nodes {
+			children = append(children, node.ChildrenByName(name)...)
+		}
+		nodes = children
+	}
+	return nodes
+}
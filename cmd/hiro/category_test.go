@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hiroapp/cli/db"
+)
+
+func TestMoveCategory(t *testing.T) {
+	tests := []struct {
+		Name     string
+		Src      string
+		Dst      string
+		Create   bool
+		WantErr  string
+		WantN    int
+		WantPath string
+	}{
+		{Name: "rename", Src: "Work:Clinet", Dst: "Work:Client", WantN: 2},
+		{Name: "rename root", Src: "Work", Dst: "Job", WantN: 3},
+		{Name: "move", Src: "Work:Clinet", Dst: "Archive:Old", Create: true, WantN: 2},
+		{Name: "move to root", Src: "Work:Clinet:Meetings", Dst: "Meetings", WantN: 1},
+		{Name: "missing parent", Src: "Work:Clinet", Dst: "Archive:Old", WantErr: "category does not exist"},
+		{Name: "missing src", Src: "Work:Foo", Dst: "Work:Bar", WantErr: "category does not exist"},
+		{Name: "dst exists", Src: "Work:Clinet", Dst: "Work", WantErr: "category already exists: Work"},
+		{Name: "into itself", Src: "Work", Dst: "Work:Clinet:Work", Create: true, WantErr: "category can't be moved into itself"},
+	}
+	for _, test := range tests {
+		d, cleanup := tempDB(t)
+		now := time.Now()
+		for i, category := range []string{"Work", "Work:Clinet", "Work:Clinet:Meetings"} {
+			path, err := d.CategoryPath(ParseCategory(category), true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entry := &db.Entry{Start: now.Add(time.Duration(i) * time.Hour), CategoryID: path.CategoryID()}
+			if err := d.SaveEntry(entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n, err := MoveCategory(d, ParseCategory(test.Src), ParseCategory(test.Dst), test.Create)
+		var gotErr string
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != test.WantErr {
+			t.Errorf("test %q: got=%q want=%q", test.Name, gotErr, test.WantErr)
+		} else if n != test.WantN {
+			t.Errorf("test %q: got=%d want=%d", test.Name, n, test.WantN)
+		} else if test.WantErr == "" {
+			if _, err := d.CategoryPath(ParseCategory(test.Dst), false); err != nil {
+				t.Errorf("test %q: %s", test.Name, err)
+			} else if _, err := d.CategoryPath(ParseCategory(test.Src), false); err == nil {
+				t.Errorf("test %q: src still exists", test.Name)
+			}
+		}
+		cleanup()
+	}
+}
+
+// tempDB returns a new db in a temporary directory and a function to remove
+// it again.
+func tempDB(t *testing.T) (db.DB, func()) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := db.New(dir, db.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, func() {
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestMergeCategory(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	// duplicate root categories are not prevented by the unique index
+	for i := 0; i < 3; i++ {
+		c := &db.Category{Name: "Work"}
+		if err := d.SaveCategory(c); err != nil {
+			t.Fatal(err)
+		} else if err := d.SaveEntry(&db.Entry{Start: time.Now(), CategoryID: c.ID}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.CategoryPath([]string{"Home"}, true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MergeCategory(d, []string{"Work"}, []string{"Home"}); err == nil || err.Error() != "category exists more than once" {
+		t.Fatalf("got=%v want duplicate error", err)
+	} else if _, err := MergeCategory(d, []string{"Home"}, []string{"Home"}); err == nil || err.Error() != "category is not duplicated: Home" {
+		t.Fatalf("got=%v want not duplicated error", err)
+	} else if n, err := MergeCategory(d, []string{"Work"}, []string{"Work"}); err != nil {
+		t.Fatal(err)
+	} else if n != 2 {
+		t.Fatalf("got=%d want=2", n)
+	} else if n, err := MergeCategory(d, []string{"Work"}, []string{"Home"}); err != nil {
+		t.Fatal(err)
+	} else if n != 3 {
+		t.Fatalf("got=%d want=3", n)
+	} else if categories, err := d.Categories(); err != nil {
+		t.Fatal(err)
+	} else if len(categories) != 1 {
+		t.Fatalf("got=%d want=1", len(categories))
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -15,58 +16,95 @@ import (
 	"github.com/hiroapp/cli/term"
 )
 
-func cmdStart(d db.DB, resume bool, categoryS string) {
-	entries, err := active(d)
-	if err != nil {
-		fatal(err)
+func cmdStart(d db.DB, resume bool, categoryS string, tagsS []string) {
+	if categoryS == "" && !resume {
+		fatal(errors.New("category is required without --resume"))
 	}
-	now := time.Now()
-	path, err := d.CategoryPath(ParseCategory(categoryS), true)
-	if err != nil {
-		fatal(err)
+	// The category is optional, so it may hold the first tag.
+	if strings.HasPrefix(categoryS, "+") {
+		categoryS, tagsS = "", append([]string{categoryS}, tagsS...)
 	}
-	entry := &db.Entry{CategoryID: path.CategoryID(), Start: now}
-	if resume {
-		last, err := Last(d)
+	for _, tag := range tagsS {
+		if !strings.HasPrefix(tag, "+") {
+			fatal(fmt.Errorf("tags must start with +: %s", tag))
+		}
+	}
+	var (
+		now   = time.Now()
+		ended []*db.Entry
+		entry *db.Entry
+	)
+	err := d.Transaction(func(tx db.DB) error {
+		entries, err := active(tx)
 		if err != nil {
-			fatal(err)
+			return err
 		}
-		if !last.End.IsZero() {
-			entry.Start = last.End
+		path, err := tx.CategoryPath(ParseCategory(categoryS), true)
+		if err != nil {
+			return err
 		}
-		if entry.CategoryID == "" {
-			entry.CategoryID = last.CategoryID
+		entry = &db.Entry{CategoryID: path.CategoryID(), Start: now, Tags: ParseTags(tagsS)}
+		if resume {
+			last, err := Last(tx)
+			if err != nil {
+				return err
+			}
+			if !last.End.IsZero() {
+				entry.Start = last.End
+			}
+			if entry.CategoryID == "" {
+				entry.CategoryID = last.CategoryID
+				if len(entry.Tags) == 0 {
+					entry.Tags = last.Tags
+				}
+			}
+		}
+		// the active entries are ended first, so they don't overlap the new one
+		if err := endAt(tx, entries, now); err != nil {
+			return err
 		}
+		ended = entries
+		return overlapWarning(tx, tx.SaveEntry(entry))
+	})
+	if err != nil {
+		fatal(err)
 	}
-	if err := d.SaveEntry(entry); err != nil {
+	categories, err := d.Categories()
+	if err != nil {
 		fatal(err)
 	}
-	FprintEntry(os.Stdout, entry, path, PrintHideDuration|PrintHideEnd)
-	if err := endAt(d, entries, now); err != nil {
+	ids, err := entryShortIDs(d, append(ended, entry))
+	if err != nil {
 		fatal(err)
 	}
+	printEntries(ended, categories, ids)
+	FprintEntry(os.Stdout, entry, categories.Path(entry.CategoryID), ids, PrintHideDuration|PrintHideEnd)
 }
 
 func cmdEnd(d db.DB) {
-	if entries, err := active(d); err != nil {
-		fatal(err)
-	} else if err := endAt(d, entries, time.Now()); err != nil {
+	var ended []*db.Entry
+	err := d.Transaction(func(tx db.DB) error {
+		entries, err := active(tx)
+		if err != nil {
+			return err
+		} else if err := endAt(tx, entries, time.Now()); err != nil {
+			return err
+		}
+		ended = entries
+		return nil
+	})
+	if err != nil {
 		fatal(err)
 	}
-}
-
-// ById returns the entry with the given id, or an error.
-func ById(d db.DB, id string) (*db.Entry, error) {
-	itr, err := d.Query(db.Query{IDs: []string{id}})
+	categories, err := d.Categories()
 	if err != nil {
-		return nil, err
+		fatal(err)
 	}
-	defer itr.Close()
-	if entry, err := itr.Next(); err == io.EOF {
-		return nil, fmt.Errorf("entry does not exist: %s", id)
-	} else {
-		return entry, err
+	ids, err := entryShortIDs(d, ended)
+	if err != nil {
+		fatal(err)
 	}
+	printEntries(ended, categories, ids)
 }
 
 // Last returns the last entry or an error.
@@ -91,30 +129,119 @@ func active(d db.DB) ([]*db.Entry, error) {
 	}
 }
 
+// endAt ends the given entries at t.
 func endAt(d db.DB, entries []*db.Entry, t time.Time) error {
-	categories, err := d.Categories()
-	if err != nil {
-		return err
-	}
 	for _, entry := range entries {
 		entry.End = t
-		if err := d.SaveEntry(entry); err != nil {
+		if err := overlapWarning(d, d.SaveEntry(entry)); err != nil {
 			return err
 		}
-		FprintEntry(os.Stdout, entry, categories.Path(entry.CategoryID), PrintDefault)
 	}
 	return nil
 }
 
-func cmdLs(d db.DB, categoryS string, asc bool) {
-	if categories, err := d.Categories(); err != nil {
+// printEntries prints the given entries to stdout.
+func printEntries(entries []*db.Entry, categories db.CategoryMap, ids ShortIDs) {
+	for _, entry := range entries {
+		FprintEntry(os.Stdout, entry, categories.Path(entry.CategoryID), ids, PrintDefault)
+	}
+}
+
+// overlapWarning prints the entries that overlap with a saved entry if err is
+// a *db.OverlapError. It returns nil if the entry was saved despite the
+// overlaps, or err otherwise.
+func overlapWarning(d db.DB, err error) error {
+	oerr, ok := err.(*db.OverlapError)
+	if !ok {
+		return err
+	}
+	categories, cerr := d.Categories()
+	if cerr != nil {
+		return cerr
+	}
+	ids, cerr := entryShortIDs(d, oerr.Overlaps)
+	if cerr != nil {
+		return cerr
+	}
+	if oerr.Saved {
+		fmt.Fprintf(os.Stderr, "warning: %s:\n\n", oerr)
+	} else {
+		fmt.Fprintf(os.Stderr, "overlapping entries:\n\n")
+	}
+	FprintIterator(os.Stderr, db.EntryIterator(oerr.Overlaps), categories, ids, PrintDefault)
+	if oerr.Saved {
+		return nil
+	}
+	return err
+}
+
+func cmdLs(d db.DB, categoryS string, exact bool, tags []string, asc bool, fromS, toS string, limit int) {
+	q := db.Query{Asc: asc, Limit: limit, Recursive: !exact, Tags: ParseTags(tags)}
+	var err error
+	if fromS != "" {
+		if q.From, err = ParseTime(fromS, false); err != nil {
+			fatal(err)
+		}
+	}
+	if toS != "" {
+		if q.To, err = ParseTime(toS, true); err != nil {
+			fatal(err)
+		}
+	}
+	categories, err := d.Categories()
+	if err != nil {
 		fatal(err)
-	} else if path, err := d.CategoryPath(ParseCategory(categoryS), false); err != nil {
+	}
+	path, err := d.CategoryPath(ParseCategory(categoryS), false)
+	if err != nil {
 		fatal(err)
-	} else if itr, err := d.Query(db.Query{Asc: asc, CategoryID: path.CategoryID()}); err != nil {
+	}
+	q.CategoryID = path.CategoryID()
+	itr, err := d.Query(q)
+	if err != nil {
 		fatal(err)
-	} else {
-		FprintIterator(os.Stdout, itr, categories, PrintDefault)
+	}
+	entries, err := db.IteratorEntries(itr)
+	if err != nil {
+		fatal(err)
+	}
+	ids, err := entryShortIDs(d, entries)
+	if err != nil {
+		fatal(err)
+	}
+	FprintIterator(os.Stdout, db.EntryIterator(entries), categories, ids, PrintDefault)
+}
+
+func cmdSearch(d db.DB, text string) {
+	if db.EmptyNoteMatch(text) {
+		fatal(errors.New("empty search query"))
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		fatal(err)
+	}
+	itr, err := d.Query(db.Query{NoteMatch: text})
+	if err != nil {
+		fatal(err)
+	}
+	entries, err := db.IteratorEntries(itr)
+	if err != nil {
+		fatal(err)
+	}
+	ids, err := entryShortIDs(d, entries)
+	if err != nil {
+		fatal(err)
+	}
+	before, after := "[", "]"
+	if isTerminal(os.Stdout) {
+		before, after = "\x1b[1m", "\x1b[0m"
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Println()
+		}
+		entry.Note = Snippet(entry.Note, text, before, after)
+		FprintEntry(os.Stdout, entry, categories.Path(entry.CategoryID), ids, PrintDefault)
 	}
 }
 
@@ -136,7 +263,8 @@ func cmdEdit(d db.DB, id string) {
 		fatal(err)
 	}
 	e := term.NewEditor()
-	FprintEntry(e, entry, categories.Path(entry.CategoryID), PrintSeparator|PrintHideDuration)
+	e.Command = config.Editor
+	FprintEntry(e, entry, categories.Path(entry.CategoryID), nil, PrintDocument|PrintSeparator|PrintHideDuration|PrintEmptyTags)
 	if err := e.Run(); err != nil {
 		fatal(err)
 	} else if doc, err := ParseEntryDocument(e); err != nil {
@@ -149,39 +277,203 @@ func cmdEdit(d db.DB, id string) {
 			Start: doc.Start,
 			End:   doc.End,
 			Note:  doc.Note,
+			Tags:  doc.Tags,
 		}
-		if path, err := d.CategoryPath(doc.Category, false); err != nil {
-			fatal(err)
-		} else {
+		err := d.Transaction(func(tx db.DB) error {
+			path, err := tx.CategoryPath(doc.Category, false)
+			if err != nil {
+				return err
+			}
 			entry.CategoryID = path.CategoryID()
+			return overlapWarning(tx, tx.SaveEntry(entry))
+		})
+		if err != nil {
+			fatal(err)
 		}
-		if err := d.SaveEntry(entry); err != nil {
+		ids, err := entryShortIDs(d, []*db.Entry{entry})
+		if err != nil {
 			fatal(err)
-		} else {
-			FprintIterator(os.Stdout, db.EntryIterator([]*db.Entry{entry}), categories, PrintDefault)
 		}
+		FprintIterator(os.Stdout, db.EntryIterator([]*db.Entry{entry}), categories, ids, PrintDefault)
 	}
 }
 
 func cmdRm(d db.DB, id string) {
-	entry, err := ById(d, id)
+	var entry *db.Entry
+	err := d.Transaction(func(tx db.DB) error {
+		var err error
+		if entry, err = ById(tx, id); err != nil {
+			return err
+		}
+		return tx.Remove(entry.ID)
+	})
 	if err != nil {
 		fatal(err)
-	} else if err := d.Remove(id); err != nil {
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		fatal(err)
+	}
+	// the short id in the trash, which restore accepts
+	ids, err := trashShortIDs(d)
+	if err != nil {
 		fatal(err)
 	}
+	FprintEntry(os.Stdout, entry, categories.Path(entry.CategoryID), ids, PrintDefault)
+}
+
+func cmdTrash(d db.DB, purge bool, olderThanS string) {
+	if purge {
+		before := time.Now()
+		if olderThanS != "" {
+			olderThan, err := ParseDuration(olderThanS)
+			if err != nil {
+				fatal(err)
+			}
+			before = before.Add(-olderThan)
+		}
+		if n, err := d.Purge(before); err != nil {
+			fatal(err)
+		} else {
+			fmt.Printf("purged %d entries\n", n)
+		}
+		return
+	}
 	categories, err := d.Categories()
 	if err != nil {
 		fatal(err)
 	}
-	FprintEntry(os.Stdout, entry, categories.Path(entry.CategoryID), PrintDefault)
+	entries, err := d.Trash()
+	if err != nil {
+		fatal(err)
+	}
+	ids, err := trashShortIDs(d)
+	if err != nil {
+		fatal(err)
+	}
+	for i, entry := range entries {
+		if i > 0 {
+			fmt.Println()
+		}
+		FprintTrashedEntry(os.Stdout, entry, categories.Path(entry.CategoryID), ids, PrintDefault)
+	}
+}
+
+func cmdRestore(d db.DB, id string) {
+	var entry *db.Entry
+	err := d.Transaction(func(tx db.DB) error {
+		var err error
+		if entry, err = trashedById(tx, id); err != nil {
+			return err
+		}
+		return tx.Restore(entry.ID)
+	})
+	if err != nil {
+		fatal(err)
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		fatal(err)
+	}
+	ids, err := entryShortIDs(d, []*db.Entry{entry})
+	if err != nil {
+		fatal(err)
+	}
+	FprintEntry(os.Stdout, entry, categories.Path(entry.CategoryID), ids, PrintDefault)
+}
+
+func cmdLog(d db.DB, id string) {
+	categories, err := d.Categories()
+	if err != nil {
+		fatal(err)
+	}
+	if strings.HasPrefix(id, refPrefix) {
+		entry, err := ById(d, id)
+		if err != nil {
+			fatal(err)
+		}
+		id = entry.ID
+	}
+	revisions, err := d.Revisions(id)
+	if err != nil {
+		fatal(err)
+	}
+	for i, r := range revisions {
+		if i > 0 {
+			fmt.Println()
+		}
+		FprintRevision(os.Stdout, r, categories)
+	}
+}
+
+func cmdCategoryRename(d db.DB, srcS, dstS string) {
+	src, dst := ParseCategory(srcS), ParseCategory(dstS)
+	if len(src) > 0 && (len(src) != len(dst) || joinCategory(src[:len(src)-1]) != joinCategory(dst[:len(dst)-1])) {
+		fatal(errors.New("rename can only change the name of a category, use mv to move it"))
+	}
+	if n, err := MoveCategory(d, src, dst, false); err != nil {
+		fatal(err)
+	} else {
+		fmt.Printf("renamed %s to %s (%d entries)\n", srcS, dstS, n)
+	}
+}
+
+func cmdCategoryMv(d db.DB, srcS, dstS string) {
+	if n, err := MoveCategory(d, ParseCategory(srcS), ParseCategory(dstS), true); err != nil {
+		fatal(err)
+	} else {
+		fmt.Printf("moved %s to %s (%d entries)\n", srcS, dstS, n)
+	}
+}
+
+func cmdCategoryMerge(d db.DB, srcS, dstS string) {
+	if n, err := MergeCategory(d, ParseCategory(srcS), ParseCategory(dstS)); err != nil {
+		fatal(err)
+	} else {
+		fmt.Printf("merged %s into %s (%d entries)\n", srcS, dstS, n)
+	}
+}
+
+func cmdCategoryRm(d db.DB, categoryS, reassignS string) {
+	path, err := d.CategoryPath(ParseCategory(categoryS), false)
+	if err != nil {
+		fatal(err)
+	} else if len(path) == 0 {
+		fatal(errors.New("category must not be empty"))
+	}
+	var reassign db.CategoryPath
+	if reassignS != "" {
+		if reassign, err = d.CategoryPath(ParseCategory(reassignS), false); err != nil {
+			fatal(err)
+		}
+	}
+	itr, err := d.Query(db.Query{CategoryID: path.CategoryID()})
+	if err != nil {
+		fatal(err)
+	}
+	entries, err := db.IteratorEntries(itr)
+	if err != nil {
+		fatal(err)
+	} else if len(entries) > 0 && reassignS == "" {
+		fatal(fmt.Errorf("category has %d entries, use --reassign to move them to another category", len(entries)))
+	} else if err := d.RemoveCategory(path.CategoryID(), reassign.CategoryID()); err != nil {
+		fatal(err)
+	} else if reassignS != "" {
+		fmt.Printf("removed %s, reassigned %d entries to %s\n", categoryS, len(entries), reassignS)
+	} else {
+		fmt.Printf("removed %s\n", categoryS)
+	}
 }
 
-func cmdSummary(d db.DB, periodS, firstDayS string) {
+func cmdSummary(d db.DB, categoryS string, exact bool, tags []string, byS, periodS, firstDayS string) {
 	period, err := datetime.ParsePeriod(periodS)
 	if err != nil {
 		fatal(err)
 	}
+	by, err := ParseSummaryGroup(byS)
+	if err != nil {
+		fatal(err)
+	}
 	firstDay, err := datetime.ParseWeekday(firstDayS)
 	if err != nil {
 		fatal(err)
@@ -190,7 +482,12 @@ func cmdSummary(d db.DB, periodS, firstDayS string) {
 	if err != nil {
 		fatal(err)
 	}
-	itr, err := NewSummaryIterator(d, period, firstDay, time.Now())
+	path, err := d.CategoryPath(ParseCategory(categoryS), false)
+	if err != nil {
+		fatal(err)
+	}
+	q := db.Query{CategoryID: path.CategoryID(), Recursive: !exact, Tags: ParseTags(tags)}
+	itr, err := NewSummaryIterator(d, q, by, period, firstDay, time.Now())
 	if err != nil {
 		fatal(err)
 	}
@@ -203,25 +500,31 @@ func cmdSummary(d db.DB, periodS, firstDayS string) {
 		} else {
 			fmt.Printf("%s\n\n", PeriodHeadline(summary.From, summary.To, period))
 			names := make(map[string]string)
-			order := make([]string, 0, len(summary.Categories))
-			for id, _ := range summary.Categories {
-				names[id] = FormatCategory(categories.Path(id))
-				order = append(order, id)
+			order := make([]string, 0, len(summary.Durations))
+			for key, _ := range summary.Durations {
+				if by == ByTag && key == "" {
+					names[key] = "(untagged)"
+				} else if by == ByTag {
+					names[key] = "+" + key
+				} else {
+					names[key] = FormatCategory(categories.Path(key))
+				}
+				order = append(order, key)
 			}
 			slice.Sort(order, func(i, j int) bool {
-				return summary.Categories[order[i]] > summary.Categories[order[j]]
+				return summary.Durations[order[i]] > summary.Durations[order[j]]
 			})
 			t := table.New().Padding(" ")
-			for _, id := range order {
-				d := FormatDuration(summary.Categories[id])
-				t.Add(table.String(names[id]), table.String(d).Align(table.Right))
+			for _, key := range order {
+				d := formatDuration(summary.Durations[key])
+				t.Add(table.String(names[key]), table.String(d).Align(table.Right))
 			}
 			fmt.Printf("%s\n", Indent(t.String(), "  "))
 		}
 	}
 }
 
-func cmdReport(d db.DB, categoryS, periodS, firstDayS string) {
+func cmdReport(d db.DB, categoryS string, exact bool, periodS, firstDayS string) {
 	period, err := datetime.ParsePeriod(periodS)
 	if err != nil {
 		fatal(err)
@@ -236,7 +539,7 @@ func cmdReport(d db.DB, categoryS, periodS, firstDayS string) {
 	if err != nil {
 		fatal(err)
 	}
-	entryItr, err := d.Query(db.Query{CategoryID: path.CategoryID()})
+	entryItr, err := d.Query(db.Query{CategoryID: path.CategoryID(), Recursive: !exact})
 	if err != nil {
 		fatal(err)
 	}
@@ -296,6 +599,314 @@ outer:
 	}
 }
 
+func cmdExport(d db.DB, format, categoryS string, exact, activeOnly bool, fromS, toS, delimiter, timeFormat string) {
+	switch format {
+	case FormatCSV, FormatICS:
+	case FormatJSON, FormatNDJSON:
+		if categoryS != "" || exact || activeOnly || fromS != "" || toS != "" {
+			fatal(fmt.Errorf("the %s format always exports the whole database, filters can't be used", format))
+		}
+		write := db.WriteJSON
+		if format == FormatNDJSON {
+			write = db.WriteNDJSON
+		}
+		if err := write(os.Stdout, d); err != nil {
+			fatal(err)
+		}
+		return
+	default:
+		fatal(fmt.Errorf("unknown export format: %s", format))
+	}
+	comma, err := ParseDelimiter(delimiter)
+	if err != nil && format == FormatCSV {
+		fatal(err)
+	}
+	q := db.Query{Asc: true, Active: activeOnly, Recursive: !exact}
+	if fromS != "" {
+		if q.From, err = ParseTime(fromS, false); err != nil {
+			fatal(err)
+		}
+	}
+	if toS != "" {
+		if q.To, err = ParseTime(toS, true); err != nil {
+			fatal(err)
+		}
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		fatal(err)
+	}
+	path, err := d.CategoryPath(ParseCategory(categoryS), false)
+	if err != nil {
+		fatal(err)
+	}
+	q.CategoryID = path.CategoryID()
+	itr, err := d.Query(q)
+	if err != nil {
+		fatal(err)
+	}
+	if format == FormatICS {
+		err = ExportICS(os.Stdout, itr, categories, time.Now())
+	} else {
+		err = ExportCSV(os.Stdout, itr, categories, comma, timeFormat, time.Now())
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func cmdImport(d db.DB, format, path string, rulesS []string, categoryS, tz, dateFormat string, dryRun bool) {
+	if format == "" {
+		format = ImportFormat(path)
+	}
+	switch format {
+	case FormatJSON, FormatNDJSON:
+		if len(rulesS) > 0 || categoryS != "" || tz != "" || dateFormat != "" || dryRun {
+			fatal(fmt.Errorf("the %s format can't be used with --rule, --category, --tz, --date-format or --dry-run", format))
+		}
+	case FormatICS:
+		if dateFormat != "" {
+			fatal(errors.New("--date-format can only be used with csv reports"))
+		}
+	case FormatToggl, FormatClockify:
+		if len(rulesS) > 0 {
+			fatal(errors.New("--rule can only be used with the ics format"))
+		}
+	case FormatCSV:
+		fatal(fmt.Errorf("use --format %s or --format %s to import a csv report", FormatToggl, FormatClockify))
+	default:
+		fatal(fmt.Errorf("unknown import format: %s", format))
+	}
+	loc := time.Local
+	if tz != "" {
+		var err error
+		if loc, err = time.LoadLocation(tz); err != nil {
+			fatal(err)
+		}
+	}
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			fatal(err)
+		}
+		defer file.Close()
+		r = file
+	}
+	var (
+		entries []*ImportEntry
+		dump    *db.Dump
+		err     error
+	)
+	switch format {
+	case FormatJSON:
+		dump, err = db.ReadJSON(r)
+	case FormatNDJSON:
+		dump, err = db.ReadNDJSON(r)
+	case FormatICS:
+		entries, err = readICS(r, rulesS, ParseCategory(categoryS), loc)
+	default:
+		entries, err = ReadCSVReport(r, format, loc, dateFormat, ParseCategory(categoryS))
+	}
+	if err != nil {
+		fatal(err)
+	}
+	if dump != nil {
+		result, err := db.Import(d, dump)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("imported %d categories and %d entries, %d unchanged\n", result.Categories, result.Entries, result.Unchanged)
+		return
+	}
+	if err := ImportEntries(d, entries, dryRun); err != nil {
+		fatal(err)
+	} else if err := FprintImport(os.Stdout, entries, dryRun); err != nil {
+		fatal(err)
+	}
+}
+
+// readICS returns the events read from r as entries to import, see ImportICS.
+func readICS(r io.Reader, rulesS []string, category []string, loc *time.Location) ([]*ImportEntry, error) {
+	var rules []*ICSRule
+	for _, s := range rulesS {
+		rule, err := ParseICSRule(s)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	events, err := ParseICS(r, loc)
+	if err != nil {
+		return nil, err
+	}
+	return ImportICS(events, rules, category, time.Now()), nil
+}
+
+func cmdFsck(d db.DB, fix bool) {
+	var (
+		t    = table.New().Padding("  ")
+		rows int
+		// attempted holds the problems that were repaired, repairs can reveal
+		// new problems, e.g. of entries that couldn't be read before.
+		attempted = make(map[string]bool)
+	)
+	t.Add(table.String("PROBLEM"), table.String("ID"), table.String("DETAIL"), table.String("STATUS"))
+	add := func(p *db.Problem, status string) {
+		for i, id := range p.IDs {
+			if i == 0 {
+				t.Add(table.String(p.Kind), table.String(id), table.String(p.Detail), table.String(status))
+			} else {
+				t.Add(table.String(""), table.String(id), table.String(""), table.String(""))
+			}
+		}
+		rows++
+	}
+	for fix {
+		problems, err := db.Check(d)
+		if err != nil {
+			fatal(err)
+		}
+		var n int
+		for _, p := range problems {
+			key := p.Kind + " " + strings.Join(p.IDs, " ")
+			if !p.Fixable || attempted[key] {
+				continue
+			}
+			attempted[key] = true
+			n++
+			if err := db.Repair(d, p); err != nil {
+				add(p, err.Error())
+			} else {
+				add(p, "fixed")
+			}
+		}
+		if n == 0 {
+			break
+		}
+	}
+	problems, err := db.Check(d)
+	if err != nil {
+		fatal(err)
+	}
+	for _, p := range problems {
+		if attempted[p.Kind+" "+strings.Join(p.IDs, " ")] {
+			continue
+		} else if p.Fixable {
+			add(p, "fixable")
+		} else {
+			add(p, "manual repair needed")
+		}
+	}
+	if rows == 0 {
+		fmt.Printf("no problems found\n")
+		return
+	}
+	fmt.Printf("%s", t)
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func cmdConvert(src db.DB, backendS string) {
+	if backendS == config.Backend {
+		fatal(fmt.Errorf("already using the %s backend", backendS))
+	}
+	dst, err := db.Open(backendS, config.Dir, db.Options{Command: command()})
+	if err != nil {
+		fatal(err)
+	}
+	defer dst.Close()
+	if empty, err := isEmpty(dst); err != nil {
+		fatal(err)
+	} else if !empty {
+		fatal(fmt.Errorf("the %s backend already holds data", backendS))
+	} else if err := db.Copy(dst, src); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("copied data to the %s backend, set backend = %q in %s or HIRO_BACKEND=%s to use it\n", backendS, backendS, configPath(), backendS)
+}
+
+// isEmpty returns true if d holds no categories and no entries, including
+// the trash.
+func isEmpty(d db.DB) (bool, error) {
+	if categories, err := d.Categories(); err != nil || len(categories) > 0 {
+		return false, err
+	} else if trash, err := d.Trash(); err != nil || len(trash) > 0 {
+		return false, err
+	} else if itr, err := d.Query(db.Query{Limit: 1}); err != nil {
+		return false, err
+	} else if entries, err := db.IteratorEntries(itr); err != nil {
+		return false, err
+	} else {
+		return len(entries) == 0, nil
+	}
+}
+
+func cmdProfileList() {
+	profiles, err := LoadProfiles(profilesPath())
+	if err != nil {
+		fatal(err)
+	}
+	// config has a profile applied already
+	c, err := LoadConfig(configPath())
+	if err != nil {
+		fatal(err)
+	}
+	def, err := profiles.Get(defaultProfile, c)
+	if err != nil {
+		fatal(err)
+	}
+	t := table.New().Padding("  ")
+	t.Add(table.String(""), table.String("NAME"), table.String("DIR"), table.String("BACKEND"))
+	for _, profile := range append([]*Profile{def}, profiles.Sorted()...) {
+		marker, backend := "", profile.Backend
+		if profile.Name == config.Profile {
+			marker = "*"
+		}
+		if backend == "" {
+			backend = "(" + c.Backend + ")"
+		}
+		t.Add(table.String(marker), table.String(profile.Name), table.String(profile.Dir), table.String(backend))
+	}
+	fmt.Printf("%s", t)
+}
+
+func cmdProfileAdd(name, dir, backend string) {
+	profiles, err := LoadProfiles(profilesPath())
+	if err != nil {
+		fatal(err)
+	}
+	if dir == "" {
+		dir = filepath.Join(DefaultConfig().Dir, "profiles", name)
+	} else if dir, err = filepath.Abs(expandHome(dir)); err != nil {
+		fatal(err)
+	}
+	if err := profiles.Add(&Profile{Name: name, Dir: dir, Backend: backend}); err != nil {
+		fatal(err)
+	} else if err := profiles.Save(profilesPath()); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("added profile %s using %s, run hiro profile use %s to activate it\n", name, dir, name)
+}
+
+func cmdProfileUse(name string) {
+	profiles, err := LoadProfiles(profilesPath())
+	if err != nil {
+		fatal(err)
+	} else if _, err := profiles.Get(name, config); err != nil {
+		fatal(err)
+	}
+	profiles.Active = name
+	if name == defaultProfile {
+		profiles.Active = ""
+	}
+	if err := profiles.Save(profilesPath()); err != nil {
+		fatal(err)
+	}
+	fmt.Printf("using profile %s\n", name)
+}
+
 func cmdVersion() {
 	fmt.Printf("%s\n", version)
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
 	"strings"
 	"text/template"
@@ -17,32 +18,54 @@ import (
 const categorySeparator = ":"
 
 var tmpl = template.Must(template.New("entry").Funcs(template.FuncMap{
-	"now":  func() time.Time { return time.Now().Truncate(time.Second) },
 	"join": strings.Join,
-	"format": func(t time.Time) string {
-		return t.Format(timeLayout)
+	"format": func(t time.Time, layout string) string {
+		return t.Format(layout)
 	},
 }).Parse(strings.TrimSpace(`
-Id:       {{.Entry.ID}}
+Id:       {{.ID}}
 Category: {{.Category}}
-Start:    {{format .Entry.Start}}
-{{if not .HideEnd}}End:      {{if .Entry.End.IsZero}}{{else}}{{format .Entry.End}}{{end}}
-{{end}}{{if not .HideDuration}}Duration: {{.Entry.Duration now}}
+{{if or .Entry.Tags .EmptyTags}}Tags:     {{join .Entry.Tags " "}}
+{{end}}Start:    {{format .Entry.Start .TimeLayout}}
+{{if not .HideEnd}}End:      {{if .Entry.End.IsZero}}{{else}}{{format .Entry.End .TimeLayout}}{{end}}
+{{end}}{{if not .HideDuration}}Duration: {{.Duration}}
+{{end}}{{if .Removed}}Removed:  {{.Removed}}
 {{end}}
 {{if .Entry.Note}}{{.Entry.Note}}
 {{end}}
 `)))
 
-func FprintEntry(w io.Writer, e *db.Entry, path db.CategoryPath, m PrintMask) error {
+// FprintEntry prints the given entry with its category path. The id is
+// shortened using ids, unless m has PrintDocument set.
+func FprintEntry(w io.Writer, e *db.Entry, path db.CategoryPath, ids ShortIDs, m PrintMask) error {
+	return fprintEntry(w, e, path, ids, m, "")
+}
+
+// FprintTrashedEntry prints the given entry from the trash, including the
+// time it was removed.
+func FprintTrashedEntry(w io.Writer, e *db.TrashedEntry, path db.CategoryPath, ids ShortIDs, m PrintMask) error {
+	return fprintEntry(w, e.Entry, path, ids, m, e.Removed.Format(config.TimeFormat))
+}
+
+func fprintEntry(w io.Writer, e *db.Entry, path db.CategoryPath, ids ShortIDs, m PrintMask, removed string) error {
+	layout, id := config.TimeFormat, ids.Get(e.ID)
+	if m&PrintDocument > 0 {
+		layout, id = timeLayout, e.ID
+	}
 	return tmpl.Execute(w, map[string]interface{}{
+		"ID":           id,
+		"TimeLayout":   layout,
 		"Entry":        e,
+		"Duration":     formatDuration(e.Duration(time.Now().Truncate(time.Second))),
 		"HideDuration": m&PrintHideDuration > 0,
 		"HideEnd":      m&PrintHideEnd > 0,
+		"EmptyTags":    m&PrintEmptyTags > 0,
 		"Category":     FormatCategory(path),
+		"Removed":      removed,
 	})
 }
 
-func FprintIterator(w io.Writer, itr db.Iterator, categories db.CategoryMap, m PrintMask) error {
+func FprintIterator(w io.Writer, itr db.Iterator, categories db.CategoryMap, ids ShortIDs, m PrintMask) error {
 	for first := true; ; first = false {
 		if entry, err := itr.Next(); err == io.EOF {
 			return nil
@@ -58,13 +81,99 @@ func FprintIterator(w io.Writer, itr db.Iterator, categories db.CategoryMap, m P
 					return err
 				}
 			}
-			if err := FprintEntry(w, entry, categories.Path(entry.CategoryID), m); err != nil {
+			if err := FprintEntry(w, entry, categories.Path(entry.CategoryID), ids, m); err != nil {
 				return err
 			}
 		}
 	}
 }
 
+// FprintRevision prints the given revision, listing the fields that were
+// changed by it.
+func FprintRevision(w io.Writer, r *db.Revision, categories db.CategoryMap) error {
+	action := "update"
+	if r.Old == nil {
+		action = "create"
+	} else if r.New == nil {
+		action = "remove"
+	}
+	kind := strings.ToUpper(r.Kind[:1]) + r.Kind[1:] + ":"
+	if _, err := fmt.Fprintf(
+		w,
+		"Revision: %d\nTime:     %s\nCommand:  %s\nAction:   %s\n%-9s %s\n\n",
+		r.ID, r.Time.Format(config.TimeFormat), r.Command, action, kind, r.ObjectID,
+	); err != nil {
+		return err
+	}
+	oldFields, newFields := revisionFields(r.Old, categories), revisionFields(r.New, categories)
+	t := table.New()
+	for _, field := range revisionFieldNames[r.Kind] {
+		oldVal, oldOk := oldFields[field]
+		newVal, newOk := newFields[field]
+		if oldOk == newOk && oldVal == newVal {
+			continue
+		}
+		if oldOk {
+			t.Add(table.String("  -"), table.String(field+":"), table.String(oldVal))
+		}
+		if newOk {
+			t.Add(table.String("  +"), table.String(field+":"), table.String(newVal))
+		}
+	}
+	_, err := fmt.Fprint(w, t.String())
+	return err
+}
+
+// revisionFieldNames holds the fields shown by FprintRevision for every kind
+// of revision.
+var revisionFieldNames = map[string][]string{
+	db.RevisionEntry:    {"Category", "Start", "End", "Tags", "Note"},
+	db.RevisionCategory: {"Name", "Parent"},
+}
+
+// revisionFields returns the formatted non-empty fields of the given
+// *db.Entry or *db.Category, or nil if obj is nil.
+func revisionFields(obj interface{}, categories db.CategoryMap) map[string]string {
+	formatCategory := func(id string) string {
+		if id == "" {
+			return ""
+		} else if path := categories.Path(id); path != nil {
+			return FormatCategory(path)
+		}
+		return id
+	}
+	formatTime := func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format(config.TimeFormat)
+	}
+	var fields map[string]string
+	switch v := obj.(type) {
+	case *db.Entry:
+		fields = map[string]string{
+			"Category": formatCategory(v.CategoryID),
+			"Start":    formatTime(v.Start),
+			"End":      formatTime(v.End),
+			"Tags":     strings.Join(v.Tags, " "),
+		}
+		if v.Note != "" {
+			fields["Note"] = fmt.Sprintf("%q", v.Note)
+		}
+	case *db.Category:
+		fields = map[string]string{
+			"Name":   v.Name,
+			"Parent": formatCategory(v.ParentID),
+		}
+	}
+	for field, val := range fields {
+		if val == "" {
+			delete(fields, field)
+		}
+	}
+	return fields
+}
+
 func FormatCategory(path db.CategoryPath) string {
 	names := make([]string, len(path))
 	for i, category := range path {
@@ -80,15 +189,62 @@ const (
 	PrintHideDuration PrintMask = 1 << (iota - 1)
 	PrintHideEnd
 	PrintSeparator
+	// PrintEmptyTags prints the tags field even if the entry has no tags.
+	PrintEmptyTags
+	// PrintDocument prints the full id and times in the layout read by
+	// ParseEntryDocument instead of the configured time format.
+	PrintDocument
 )
 
 var entryField = regexp.MustCompile("^([^:]+):\\s*(.*?)\\s*$")
 
 const (
 	timeLayout     = "2006-01-02 15:04:05 -0700"
+	dateLayout     = "2006-01-02"
 	entrySeparator = "8< ----- do not remove this separator ----- >8"
 )
 
+// Snippet returns the lines of note containing words matched by the search
+// query q, with the matched words enclosed in before and after. Lines without
+// matches are replaced by a single "..." line.
+func Snippet(note, q, before, after string) string {
+	var (
+		indexes = db.NoteMatchIndexes(note, q)
+		lines   []string
+		offset  int
+		skipped bool
+	)
+	for _, line := range strings.Split(note, "\n") {
+		var (
+			buf  bytes.Buffer
+			last int
+			end  = offset + len(line)
+		)
+		for len(indexes) > 0 && indexes[0][1] <= end {
+			start, stop := indexes[0][0]-offset, indexes[0][1]-offset
+			buf.WriteString(line[last:start] + before + line[start:stop] + after)
+			last = stop
+			indexes = indexes[1:]
+		}
+		if last > 0 {
+			buf.WriteString(line[last:])
+			lines = append(lines, buf.String())
+			skipped = false
+		} else if !skipped {
+			lines = append(lines, "...")
+			skipped = true
+		}
+		offset = end + 1
+	}
+	return strings.Join(lines, "\n")
+}
+
+// isTerminal returns true if f is a terminal.
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
 func Indent(s, indent string) string {
 	lines := strings.Split(s, "\n")
 	for i, line := range lines {
@@ -108,6 +264,14 @@ func FormatDuration(d time.Duration) string {
 	return fmt.Sprintf("%d:%02d:%02d", hours, minutes, seconds)
 }
 
+// formatDuration formats the duration using the configured duration format.
+func formatDuration(d time.Duration) string {
+	if config.DurationFormat == DurationDecimal {
+		return fmt.Sprintf("%.2f", d.Hours())
+	}
+	return FormatDuration(d)
+}
+
 func PeriodHeadline(from, to time.Time, period datetime.Period) string {
 	switch period {
 	case datetime.Day:
@@ -151,8 +315,8 @@ func FormatReport(r *Report) string {
 	var trackedTotal time.Duration
 	for _, day := range r.Days {
 		trackedTotal += day.Tracked
-		trackedS := FormatDuration(day.Tracked)
-		trackedTotalS := FormatDuration(trackedTotal)
+		trackedS := formatDuration(day.Tracked)
+		trackedTotalS := formatDuration(trackedTotal)
 		// @TODO add better padding support to table
 		t.Add(
 			table.String(day.From.Format("2006-01-02 ")),
@@ -167,7 +331,7 @@ func FormatReport(r *Report) string {
 		if day.Tracked == 0 {
 			continue
 		}
-		trackedS := FormatDuration(day.Tracked)
+		trackedS := formatDuration(day.Tracked)
 		dayS := day.From.Format("2006-01-02 (Monday)")
 		fmt.Fprintf(buf, "%s - %s\n\n", dayS, trackedS)
 		buf.WriteString(Indent(strings.Join(day.Notes, "\n"), "  "))
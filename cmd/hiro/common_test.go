@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/hiroapp/cli/db"
 )
 
 func TestFormatDuration(t *testing.T) {
@@ -41,3 +45,96 @@ func TestFormatDuration(t *testing.T) {
 		}
 	}
 }
+
+func TestFprintEntry(t *testing.T) {
+	defer func(format string) { config.DurationFormat = format }(config.DurationFormat)
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.UTC)
+	e := &db.Entry{ID: "a", Start: start, End: start.Add(90 * time.Minute)}
+	for format, want := range map[string]string{
+		DurationClock:   "Duration: 1:30:00\n",
+		DurationDecimal: "Duration: 1.50\n",
+	} {
+		config.DurationFormat = format
+		var buf bytes.Buffer
+		if err := FprintEntry(&buf, e, nil, nil, PrintDefault); err != nil {
+			t.Fatal(err)
+		} else if !strings.Contains(buf.String(), want) {
+			t.Errorf("%s: got=%q want %q", format, buf.String(), want)
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	tests := []struct {
+		Note  string
+		Query string
+		Want  string
+	}{
+		{
+			Note:  "foo bar",
+			Query: "bar",
+			Want:  "foo [bar]",
+		},
+		{
+			Note:  "Foo bar foo",
+			Query: "foo",
+			Want:  "[Foo] bar [foo]",
+		},
+		{
+			Note:  "a\nb\nfoo\nc\nd\nbar baz",
+			Query: "ba* foo",
+			Want:  "...\n[foo]\n...\n[bar] [baz]",
+		},
+		{
+			Note:  "ABC-123",
+			Query: "abc-123",
+			Want:  "[ABC]-[123]",
+		},
+		{
+			Note:  "foo",
+			Query: "bar",
+			Want:  "...",
+		},
+	}
+	for _, test := range tests {
+		got := Snippet(test.Note, test.Query, "[", "]")
+		if got != test.Want {
+			t.Errorf("test %q: got=%q want=%q", test.Note, got, test.Want)
+		}
+	}
+}
+
+func TestFprintRevision(t *testing.T) {
+	zone := time.FixedZone("", 3600)
+	categories := db.CategoryMap{
+		"1": &db.Category{ID: "1", Name: "Work"},
+		"2": &db.Category{ID: "2", Name: "Hiro", ParentID: "1"},
+	}
+	r := &db.Revision{
+		ID:       3,
+		Time:     time.Date(2015, 10, 4, 13, 0, 0, 0, zone),
+		Kind:     db.RevisionEntry,
+		ObjectID: "a",
+		Old:      &db.Entry{ID: "a", CategoryID: "1", Start: time.Date(2015, 10, 4, 12, 0, 0, 0, zone)},
+		New:      &db.Entry{ID: "a", CategoryID: "2", Start: time.Date(2015, 10, 4, 12, 0, 0, 0, zone), Tags: []string{"x", "y"}, Note: "foo"},
+		Command:  "hiro edit",
+	}
+	buf := &bytes.Buffer{}
+	if err := FprintRevision(buf, r, categories); err != nil {
+		t.Fatal(err)
+	}
+	want := `Revision: 3
+Time:     2015-10-04 13:00:00 +0100
+Command:  hiro edit
+Action:   update
+Entry:    a
+
+  - Category: Work
+  + Category: Work:Hiro
+  + Tags:     x y
+  + Note:     "foo"
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got=%q want=%q", got, want)
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hiroapp/cli/datetime"
+	"github.com/hiroapp/cli/db"
+)
+
+// Config holds the settings of hiro. They are read from the config file, see
+// configPath, and can be overridden by env variables and command line flags.
+//
+// The config file uses a subset of TOML that only allows string values:
+//
+//	dir = "~/Documents/hiro"
+//	first_day = "Sunday"
+//
+//	[summary]
+//	period = "week"
+type Config struct {
+	// Dir is the data directory, a leading ~/ is replaced by the home
+	// directory. Key dir, env variable HIRO_DIR.
+	Dir string
+	// Backend is the storage backend: sqlite|journal. Key backend, env
+	// variable HIRO_BACKEND.
+	Backend string
+	// Overlap is the policy for overlapping entries: allow|reject|warn|trim.
+	// Key overlap, env variable HIRO_OVERLAP.
+	Overlap string
+	// Editor is the command used to edit entries. Key editor, env variable
+	// HIRO_EDITOR, defaults to the EDITOR env variable.
+	Editor string
+	// FirstDay is the default first day of the week. Key first_day.
+	FirstDay string
+	// SummaryPeriod is the default period of the summary command. Key period
+	// in the summary table.
+	SummaryPeriod string
+	// ReportPeriod is the default period of the report command. Key period in
+	// the report table.
+	ReportPeriod string
+	// TimeFormat is the Go time layout used for printing times. Key
+	// time_format.
+	TimeFormat string
+	// DurationFormat is the format of the printed durations, e.g. of entries
+	// and summaries: clock|decimal. Key duration_format.
+	DurationFormat string
+	// Profile is the name of the profile in use, see UseProfile. It's empty
+	// until a profile is applied.
+	Profile string
+}
+
+// Duration formats of Config.DurationFormat.
+const (
+	// DurationClock prints durations as H:MM:SS, see FormatDuration.
+	DurationClock = "clock"
+	// DurationDecimal prints durations as decimal hours, e.g. 1.50.
+	DurationDecimal = "decimal"
+)
+
+// config is the configuration of the running command, it's replaced by the
+// loaded config in main.
+var config = DefaultConfig()
+
+// DefaultConfig returns the configuration used without a config file. The
+// data is stored in the hiro directory of the XDG data directory.
+func DefaultConfig() *Config {
+	return &Config{
+		Dir:            filepath.Join(xdgDir("XDG_DATA_HOME", ".local/share"), "hiro"),
+		Backend:        db.BackendSQLite,
+		Overlap:        "warn",
+		Editor:         os.Getenv("EDITOR"),
+		FirstDay:       "Monday",
+		SummaryPeriod:  "day",
+		ReportPeriod:   "week",
+		TimeFormat:     timeLayout,
+		DurationFormat: DurationClock,
+	}
+}
+
+// xdgDir returns the directory set by the given XDG env variable, or the
+// given default directory relative to the home directory. Relative paths in
+// the env variable are ignored, as required by the XDG base directory spec.
+func xdgDir(env, def string) string {
+	if dir := os.Getenv(env); filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(os.Getenv("HOME"), def)
+}
+
+// configPath returns the path of the config file set by the HIRO_CONFIG env
+// variable, defaulting to hiro/config.toml in the XDG config directory.
+func configPath() string {
+	if path := os.Getenv("HIRO_CONFIG"); path != "" {
+		return path
+	}
+	return filepath.Join(xdgDir("XDG_CONFIG_HOME", ".config"), "hiro", "config.toml")
+}
+
+// LoadConfig returns the DefaultConfig overridden by the config file at the
+// given path, if it exists, and by the env variables, or an error if the
+// file can't be parsed or holds invalid settings.
+func LoadConfig(path string) (*Config, error) {
+	c := DefaultConfig()
+	if file, err := os.Open(path); err == nil {
+		defer file.Close()
+		if err := ParseConfig(file, c); err != nil {
+			return nil, fmt.Errorf("%s:%s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	for env, dst := range map[string]*string{
+		"HIRO_DIR":     &c.Dir,
+		"HIRO_BACKEND": &c.Backend,
+		"HIRO_OVERLAP": &c.Overlap,
+		"HIRO_EDITOR":  &c.Editor,
+	} {
+		if val := os.Getenv(env); val != "" {
+			*dst = val
+		}
+	}
+	c.Dir = expandHome(c.Dir)
+	return c, c.Valid()
+}
+
+// expandHome replaces a leading ~/ in path by the home directory.
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		return filepath.Join(os.Getenv("HOME"), path[2:])
+	}
+	return path
+}
+
+// Valid returns an error if c holds an invalid setting.
+func (c *Config) Valid() error {
+	if c.Dir == "" {
+		return errors.New("data directory must be set")
+	} else if c.Backend != db.BackendSQLite && c.Backend != db.BackendJournal {
+		return fmt.Errorf("unknown backend: %s", c.Backend)
+	} else if _, err := db.ParseOverlapPolicy(c.Overlap); err != nil {
+		return err
+	} else if _, err := datetime.ParseWeekday(c.FirstDay); err != nil {
+		return err
+	} else if _, err := datetime.ParsePeriod(c.SummaryPeriod); err != nil {
+		return err
+	} else if period, err := datetime.ParsePeriod(c.ReportPeriod); err != nil {
+		return err
+	} else if period == datetime.Day {
+		return errors.New("bad report period: day")
+	} else if c.TimeFormat == "" {
+		return errors.New("time format must not be empty")
+	} else if c.DurationFormat != DurationClock && c.DurationFormat != DurationDecimal {
+		return fmt.Errorf("bad duration format: %s", c.DurationFormat)
+	}
+	return nil
+}
+
+// keys returns the settings of c indexed by their keys in the config file.
+// Keys of tables are prefixed with the table name and a dot.
+func (c *Config) keys() map[string]*string {
+	return map[string]*string{
+		"dir":             &c.Dir,
+		"backend":         &c.Backend,
+		"overlap":         &c.Overlap,
+		"editor":          &c.Editor,
+		"first_day":       &c.FirstDay,
+		"time_format":     &c.TimeFormat,
+		"duration_format": &c.DurationFormat,
+		"summary.period":  &c.SummaryPeriod,
+		"report.period":   &c.ReportPeriod,
+	}
+}
+
+var (
+	configTable = regexp.MustCompile(`^\[\s*([A-Za-z0-9_-]+)\s*\]\s*(#.*)?$`)
+	configKey   = regexp.MustCompile(`^([A-Za-z0-9_-]+)\s*=\s*`)
+	configEnd   = regexp.MustCompile(`^\s*(#.*)?$`)
+)
+
+// ParseConfig reads the settings of the config file from r into c. Errors
+// are prefixed with the number of the line they occurred at.
+func ParseConfig(r io.Reader, c *Config) error {
+	keys := c.keys()
+	return parseTOML(r, func(key, val string) error {
+		if keys[key] == nil {
+			return fmt.Errorf("unknown key: %s", key)
+		}
+		*keys[key] = val
+		return nil
+	})
+}
+
+// parseTOML parses the subset of TOML used by the config file from r and
+// calls set for every key and its value. Keys of tables are prefixed with the
+// table name and a dot. Errors, including the ones returned by set, are
+// prefixed with the number of the line they occurred at.
+func parseTOML(r io.Reader, set func(key, val string) error) error {
+	var (
+		scanner = bufio.NewScanner(r)
+		seen    = make(map[string]bool)
+		table   string
+	)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if configEnd.MatchString(line) {
+			continue
+		} else if m := configTable.FindStringSubmatch(line); m != nil {
+			table = m[1] + "."
+			continue
+		}
+		m := configKey.FindStringSubmatch(line)
+		if m == nil {
+			return fmt.Errorf("%d: bad line: %s", n, line)
+		}
+		key := table + m[1]
+		val, rest, err := parseConfigString(line[len(m[0]):])
+		if err != nil {
+			return fmt.Errorf("%d: %s", n, err)
+		} else if !configEnd.MatchString(rest) {
+			return fmt.Errorf("%d: unexpected text after value: %s", n, rest)
+		} else if seen[key] {
+			return fmt.Errorf("%d: duplicate key: %s", n, key)
+		} else if err := set(key, val); err != nil {
+			return fmt.Errorf("%d: %s", n, err)
+		}
+		seen[key] = true
+	}
+	return scanner.Err()
+}
+
+// parseConfigString parses the string at the start of s, which is either a
+// basic string in double quotes that may contain escape sequences, or a
+// literal string in single quotes. It returns the string and the rest of s.
+func parseConfigString(s string) (string, string, error) {
+	if strings.HasPrefix(s, "'") {
+		end := strings.Index(s[1:], "'")
+		if end == -1 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	} else if !strings.HasPrefix(s, `"`) {
+		return "", "", fmt.Errorf("value must be a quoted string: %s", s)
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			val, err := strconv.Unquote(s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("bad string: %s", s[:i+1])
+			}
+			return val, s[i+1:], nil
+		}
+	}
+	return "", "", errors.New("unterminated string")
+}
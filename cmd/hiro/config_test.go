@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		Name   string
+		Config string
+		Want   func(*Config)
+		Err    string
+	}{
+		{
+			Name:   "empty",
+			Config: "",
+			Want:   func(c *Config) {},
+		},
+		{
+			Name: "all keys",
+			Config: `# hiro config
+dir = "/data/hiro"
+backend = 'journal'  # comment
+overlap = "trim"
+editor = "vim -c \"set tw=72\""
+first_day = "Sunday"
+time_format = '2006-01-02 15:04'
+duration_format = "decimal"
+
+[summary]
+period = "week"
+
+[ report ] # the report command
+period = "month"
+`,
+			Want: func(c *Config) {
+				c.Dir = "/data/hiro"
+				c.Backend = "journal"
+				c.Overlap = "trim"
+				c.Editor = `vim -c "set tw=72"`
+				c.FirstDay = "Sunday"
+				c.TimeFormat = "2006-01-02 15:04"
+				c.DurationFormat = "decimal"
+				c.SummaryPeriod = "week"
+				c.ReportPeriod = "month"
+			},
+		},
+		{
+			Name:   "unknown key",
+			Config: "\n[summary]\nfirst_day = \"Sunday\"",
+			Err:    "3: unknown key: summary.first_day",
+		},
+		{
+			Name:   "duplicate key",
+			Config: "dir = \"a\"\ndir = \"b\"",
+			Err:    "2: duplicate key: dir",
+		},
+		{
+			Name:   "unquoted value",
+			Config: "first_day = Sunday",
+			Err:    "1: value must be a quoted string: Sunday",
+		},
+		{
+			Name:   "unterminated string",
+			Config: `dir = "a\"`,
+			Err:    "1: unterminated string",
+		},
+		{
+			Name:   "text after value",
+			Config: `dir = "a" "b"`,
+			Err:    `1: unexpected text after value:  "b"`,
+		},
+		{
+			Name:   "bad line",
+			Config: "dir",
+			Err:    "1: bad line: dir",
+		},
+	}
+	for _, test := range tests {
+		got := &Config{}
+		err := ParseConfig(strings.NewReader(test.Config), got)
+		if test.Err != "" {
+			if err == nil || err.Error() != test.Err {
+				t.Errorf("test %q: got=%v want=%s", test.Name, err, test.Err)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("test %q: %s", test.Name, err)
+			continue
+		}
+		want := &Config{}
+		test.Want(want)
+		if diff := diffConfig.Compare(got, want); diff != "" {
+			t.Errorf("test %q: %s", test.Name, diff)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, env := range []string{"HOME", "XDG_DATA_HOME", "HIRO_DIR", "HIRO_BACKEND", "HIRO_OVERLAP", "HIRO_EDITOR"} {
+		defer os.Setenv(env, os.Getenv(env))
+		os.Unsetenv(env)
+	}
+	os.Setenv("HOME", "/home/test")
+
+	// without a config file
+	path := filepath.Join(dir, "config.toml")
+	if c, err := LoadConfig(path); err != nil {
+		t.Fatal(err)
+	} else if want := "/home/test/.local/share/hiro"; c.Dir != want {
+		t.Fatalf("got=%s want=%s", c.Dir, want)
+	}
+
+	// the env variables override the config file
+	data := "dir = \"~/hiro\"\nbackend = \"journal\"\noverlap = \"reject\"\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("HIRO_OVERLAP", "allow")
+	c, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := DefaultConfig()
+	want.Dir, want.Backend, want.Overlap = "/home/test/hiro", "journal", "allow"
+	if diff := diffConfig.Compare(c, want); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// invalid settings are reported
+	os.Setenv("HIRO_OVERLAP", "ignore")
+	if _, err := LoadConfig(path); err == nil || err.Error() != "bad overlap policy: ignore" {
+		t.Fatalf("got=%v want bad overlap policy error", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("backend = sqlite\n"), 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := LoadConfig(path); err == nil || err.Error() != path+":1: value must be a quoted string: sqlite" {
+		t.Fatalf("got=%v want parse error", err)
+	}
+}
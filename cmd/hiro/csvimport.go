@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hiroapp/cli/db"
+)
+
+// Import formats of the csv reports of other time trackers, see ReadCSVReport.
+const (
+	FormatToggl    = "toggl"
+	FormatClockify = "clockify"
+)
+
+// Columns of a csv report, see csvReportColumns.
+const (
+	colClient = iota
+	colProject
+	colTask
+	colDescription
+	colTags
+	colStartDate
+	colStartTime
+	colEndDate
+	colEndTime
+	colDuration
+	colDecimalDuration
+	numCSVColumns
+)
+
+// csvReportColumns holds the lower case headers of the columns of the csv
+// reports of the supported time trackers, indexed by the col constants.
+// Columns with an empty header are not part of the report.
+var csvReportColumns = map[string][numCSVColumns]string{
+	FormatToggl: {
+		colClient:      "client",
+		colProject:     "project",
+		colTask:        "task",
+		colDescription: "description",
+		colTags:        "tags",
+		colStartDate:   "start date",
+		colStartTime:   "start time",
+		colEndDate:     "end date",
+		colEndTime:     "end time",
+		colDuration:    "duration",
+	},
+	FormatClockify: {
+		colClient:          "client",
+		colProject:         "project",
+		colTask:            "task",
+		colDescription:     "description",
+		colTags:            "tags",
+		colStartDate:       "start date",
+		colStartTime:       "start time",
+		colEndDate:         "end date",
+		colEndTime:         "end time",
+		colDuration:        "duration (h)",
+		colDecimalDuration: "duration (decimal)",
+	},
+}
+
+// csvRequiredColumns are the columns a report must have.
+var csvRequiredColumns = []int{colDescription, colStartDate, colStartTime}
+
+var (
+	// csvDateLayouts are the date layouts tried if no date layout is given,
+	// in addition to the one of slashed dates, see csvSlashedLayout.
+	csvDateLayouts = []string{"2006-01-02", "02.01.2006"}
+	// csvTimeLayouts are the time layouts of the reports.
+	csvTimeLayouts = []string{"15:04:05", "15:04", "3:04:05 PM", "3:04 PM"}
+)
+
+// csvSlashedDate matches slashed dates, which are either MM/DD/YYYY or
+// DD/MM/YYYY, capturing the first two numbers.
+var csvSlashedDate = regexp.MustCompile(`^(\d{1,2})/(\d{1,2})/\d{4}$`)
+
+// csvClockDuration matches durations like 1:30:00.
+var csvClockDuration = regexp.MustCompile(`^(\d+):(\d{2})(?::(\d{2}))?$`)
+
+// ReadCSVReport returns the entries of the detailed csv report of the time
+// tracker of the given format as entries to import with ImportEntries. The
+// category path of an entry is made of the client, project and task of the
+// row, or the given default category if they are empty. The description
+// becomes the note, and the tags the tags of the entry, with whitespace
+// replaced by dashes. Dates and times are parsed in loc, dates using the
+// layout dateFormat, or one of csvDateLayouts if it's empty. In that case, the
+// order of month and day of slashed dates is detected from all dates of the
+// report, and an error is returned if it's ambiguous. Rows that can't be
+// parsed are returned as skipped entries.
+func ReadCSVReport(r io.Reader, format string, loc *time.Location, dateFormat string, category []string) ([]*ImportEntry, error) {
+	headers, ok := csvReportColumns[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown csv report format: %s", format)
+	}
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("empty %s report", format)
+	} else if err != nil {
+		return nil, err
+	}
+	var columns [numCSVColumns]int
+	for col := range columns {
+		columns[col] = -1
+		for i, name := range header {
+			// exports of some spreadsheets start with a byte order mark
+			name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+			if headers[col] != "" && name == headers[col] {
+				columns[col] = i
+			}
+		}
+	}
+	for _, col := range csvRequiredColumns {
+		if columns[col] == -1 {
+			return nil, fmt.Errorf("not a %s report, missing column: %s", format, headers[col])
+		}
+	}
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	dateLayouts := []string{dateFormat}
+	if dateFormat == "" {
+		slashed, err := csvSlashedLayout(records, columns[colStartDate], columns[colEndDate])
+		if err != nil {
+			return nil, err
+		}
+		dateLayouts = append([]string{slashed}, csvDateLayouts...)
+	}
+	entries := make([]*ImportEntry, 0, len(records))
+	for i, record := range records {
+		field := func(col int) string {
+			if i := columns[col]; i != -1 && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		ie := &ImportEntry{Source: fmt.Sprintf("row %d", i+2), Entry: &db.Entry{Note: field(colDescription)}}
+		entries = append(entries, ie)
+		e := ie.Entry
+		for _, col := range []int{colClient, colProject, colTask} {
+			if name := field(col); name != "" {
+				ie.Category = append(ie.Category, name)
+			}
+		}
+		if len(ie.Category) == 0 {
+			ie.Category = category
+		}
+		for _, tag := range strings.Split(field(colTags), ",") {
+			if tag = strings.Join(strings.Fields(tag), "-"); tag != "" {
+				e.Tags = append(e.Tags, tag)
+			}
+		}
+		if e.Start, err = parseCSVTime(field(colStartDate), field(colStartTime), dateLayouts, loc); err != nil {
+			ie.Skipped = "bad start: " + err.Error()
+			continue
+		}
+		if field(colEndTime) != "" {
+			endDate := field(colEndDate)
+			if endDate == "" {
+				endDate = field(colStartDate)
+			}
+			if e.End, err = parseCSVTime(endDate, field(colEndTime), dateLayouts, loc); err != nil {
+				ie.Skipped = "bad end: " + err.Error()
+				continue
+			}
+		} else {
+			d, err := parseCSVDuration(field(colDuration), field(colDecimalDuration))
+			if err != nil {
+				ie.Skipped = err.Error()
+				continue
+			}
+			e.End = e.Start.Add(d)
+		}
+		if err := e.Valid(); err != nil {
+			ie.Skipped = err.Error()
+			continue
+		}
+		// the id only depends on the row, not on the default category, so
+		// importing the report again finds the entries
+		e.ID = importID(strings.Join([]string{
+			format,
+			e.Start.Format(time.RFC3339),
+			e.End.Format(time.RFC3339),
+			field(colClient),
+			field(colProject),
+			field(colTask),
+			e.Note,
+		}, "\x00"))
+	}
+	return entries, nil
+}
+
+// csvSlashedLayout returns the layout of the slashed dates in the given
+// columns of records: 01/02/2006 if the second number of a date is greater
+// than 12, or 02/01/2006 if the first one is. An error is returned if neither
+// or both occur, unless month and day are equal in all dates.
+func csvSlashedLayout(records [][]string, columns ...int) (string, error) {
+	var monthFirst, dayFirst, ambiguous string
+	for _, record := range records {
+		for _, i := range columns {
+			if i == -1 || i >= len(record) {
+				continue
+			}
+			m := csvSlashedDate.FindStringSubmatch(strings.TrimSpace(record[i]))
+			if m == nil {
+				continue
+			}
+			first, _ := strconv.Atoi(m[1])
+			second, _ := strconv.Atoi(m[2])
+			switch {
+			case second > 12:
+				monthFirst = m[0]
+			case first > 12:
+				dayFirst = m[0]
+			case first != second:
+				ambiguous = m[0]
+			}
+		}
+	}
+	switch {
+	case monthFirst != "" && dayFirst != "":
+		return "", fmt.Errorf("inconsistent dates %s and %s, use --date-format", monthFirst, dayFirst)
+	case dayFirst != "":
+		return "02/01/2006", nil
+	case monthFirst == "" && ambiguous != "":
+		return "", fmt.Errorf("ambiguous date %s, use --date-format 01/02/2006 or 02/01/2006", ambiguous)
+	}
+	return "01/02/2006", nil
+}
+
+// parseCSVTime parses the given date and time in loc, trying the given date
+// layouts and the csvTimeLayouts.
+func parseCSVTime(date, clock string, dateLayouts []string, loc *time.Location) (time.Time, error) {
+	if date == "" || clock == "" {
+		return time.Time{}, fmt.Errorf("missing date or time")
+	}
+	for _, dayLayout := range dateLayouts {
+		for _, clockLayout := range csvTimeLayouts {
+			if t, err := time.ParseInLocation(dayLayout+" "+clockLayout, date+" "+clock, loc); err == nil {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s %s", date, clock)
+}
+
+// parseCSVDuration parses a duration like 1:30:00, or decimal hours like 1.5
+// if clock is empty.
+func parseCSVDuration(clock, decimal string) (time.Duration, error) {
+	if m := csvClockDuration.FindStringSubmatch(clock); m != nil {
+		var d time.Duration
+		for i, unit := range []time.Duration{time.Hour, time.Minute, time.Second} {
+			if m[i+1] != "" {
+				n, _ := strconv.Atoi(m[i+1])
+				d += time.Duration(n) * unit
+			}
+		}
+		return d, nil
+	} else if clock != "" {
+		return 0, fmt.Errorf("bad duration: %s", clock)
+	} else if decimal == "" {
+		return 0, fmt.Errorf("missing end time and duration")
+	}
+	hours, err := strconv.ParseFloat(strings.Replace(decimal, ",", ".", 1), 64)
+	if err != nil || hours < 0 {
+		return 0, fmt.Errorf("bad duration: %s", decimal)
+	}
+	return time.Duration(hours*3600+0.5) * time.Second, nil
+}
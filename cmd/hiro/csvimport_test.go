@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadCSVReport(t *testing.T) {
+	loc := time.FixedZone("", -4*3600)
+	tests := []struct {
+		Format     string
+		DateLayout string
+		Report     string
+		Want       []string
+	}{
+		{
+			Format: FormatToggl,
+			Report: "\ufeff" + `User,Email,Client,Project,Task,Description,Billable,Start date,Start time,End date,End time,Duration,Tags,Amount ()
+Jane,jane@example.com,Acme,Website,,Fix header,Yes,2015-06-01,09:00:00,2015-06-01,10:30:00,01:30:00,"design, urgent fix",
+Jane,jane@example.com,,,,Email,No,2015-06-01,23:30:00,2015-06-02,00:15:00,00:45:00,,
+Jane,jane@example.com,Acme,Website,,Broken,No,2015-13-01,09:00:00,2015-13-01,10:00:00,01:00:00,,
+`,
+			Want: []string{
+				"row 2: Acme:Website 2015-06-01 09:00:00 -0400 - 2015-06-01 10:30:00 -0400 [design urgent-fix] Fix header",
+				"row 3: Misc 2015-06-01 23:30:00 -0400 - 2015-06-02 00:15:00 -0400 [] Email",
+				"row 4: skip: bad start: 2015-13-01 09:00:00",
+			},
+		},
+		{
+			Format:     FormatClockify,
+			DateLayout: "01/02/2006",
+			Report: `"Project","Client","Description","Task","User","Group","Email","Tags","Billable","Start Date","Start Time","End Date","End Time","Duration (h)","Duration (decimal)"
+"Website","Acme","Standup","Meetings","Jane","","jane@example.com","","Yes","06/01/2015","09:00:00 AM","06/01/2015","09:15:00 AM","00:15:00","0.25"
+"Website","Acme","Review","","Jane","","jane@example.com","","Yes","06/01/2015","01:00:00 PM","","","","1,5"
+"Website","Acme","Backwards","","Jane","","jane@example.com","","Yes","06/01/2015","02:00:00 PM","06/01/2015","01:00:00 PM","",""
+`,
+			Want: []string{
+				"row 2: Acme:Website:Meetings 2015-06-01 09:00:00 -0400 - 2015-06-01 09:15:00 -0400 [] Standup",
+				"row 3: Acme:Website 2015-06-01 13:00:00 -0400 - 2015-06-01 14:30:00 -0400 [] Review",
+				"row 4: skip: end must be after start",
+			},
+		},
+	}
+	for _, test := range tests {
+		entries, err := ReadCSVReport(strings.NewReader(test.Report), test.Format, loc, test.DateLayout, ParseCategory("Misc"))
+		if err != nil {
+			t.Errorf("%s: %s", test.Format, err)
+			continue
+		}
+		var got []string
+		for _, ie := range entries {
+			if ie.Skipped != "" {
+				got = append(got, ie.Source+": skip: "+ie.Skipped)
+				continue
+			}
+			e := ie.Entry
+			got = append(got, ie.Source+": "+joinCategory(ie.Category)+" "+
+				e.Start.Format(timeLayout)+" - "+e.End.Format(timeLayout)+" ["+
+				strings.Join(e.Tags, " ")+"] "+e.Note)
+		}
+		if diff := diffConfig.Compare(got, test.Want); diff != "" {
+			t.Errorf("%s: %s", test.Format, diff)
+		}
+	}
+	if _, err := ReadCSVReport(strings.NewReader("id,note\n"), FormatToggl, loc, "", nil); err == nil {
+		t.Error("expected error for report without the required columns")
+	}
+}
+
+func TestCSVSlashedLayout(t *testing.T) {
+	tests := []struct {
+		Dates  []string
+		Layout string
+		Err    string
+	}{
+		{Dates: []string{"2015-06-01", "2015-06-13"}, Layout: "01/02/2006"},
+		{Dates: []string{"06/06/2015", "06/13/2015", "06/01/2015"}, Layout: "01/02/2006"},
+		{Dates: []string{"06/01/2015", "13/06/2015"}, Layout: "02/01/2006"},
+		{Dates: []string{"06/06/2015"}, Layout: "01/02/2006"},
+		{Dates: []string{"06/06/2015", "06/01/2015"}, Err: "ambiguous date 06/01/2015, use --date-format 01/02/2006 or 02/01/2006"},
+		{Dates: []string{"06/13/2015", "13/06/2015"}, Err: "inconsistent dates 06/13/2015 and 13/06/2015, use --date-format"},
+	}
+	for _, test := range tests {
+		var records [][]string
+		for _, date := range test.Dates {
+			records = append(records, []string{"", date})
+		}
+		layout, err := csvSlashedLayout(records, 1, -1)
+		var gotErr string
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if layout != test.Layout || gotErr != test.Err {
+			t.Errorf("%v: got=%q %q want=%q %q", test.Dates, layout, gotErr, test.Layout, test.Err)
+		}
+	}
+	report := "Description,Start date,Start time,End date,End time\nEmail,06/01/2015,09:00,06/01/2015,10:00\n"
+	if _, err := ReadCSVReport(strings.NewReader(report), FormatToggl, time.UTC, "", nil); err == nil {
+		t.Error("expected error for ambiguous dates")
+	} else if entries, err := ReadCSVReport(strings.NewReader(report), FormatToggl, time.UTC, "02/01/2006", nil); err != nil {
+		t.Error(err)
+	} else if got := entries[0].Entry.Start; got.Month() != time.January {
+		t.Errorf("got=%s want January", got)
+	}
+}
+
+func TestImportCSVReport(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	report := `Client,Project,Description,Start date,Start time,End date,End time,Duration
+Acme,Website,Fix header,2015-06-01,09:00:00,2015-06-01,10:30:00,01:30:00
+,,Email,2015-06-01,11:00:00,2015-06-01,11:30:00,00:30:00
+`
+	// the default category doesn't change the ids
+	for i, want := range []string{"", "already imported"} {
+		category := ParseCategory(fmt.Sprintf("Misc%d", i))
+		entries, err := ReadCSVReport(strings.NewReader(report), FormatToggl, time.UTC, "", category)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ImportEntries(d, entries, false); err != nil {
+			t.Fatal(err)
+		}
+		for _, ie := range entries {
+			if ie.Skipped != want {
+				t.Fatalf("%s: got=%q want=%q", ie.Source, ie.Skipped, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/hiroapp/cli/db"
+)
+
+// Formats of the export and import commands.
+const (
+	FormatCSV = "csv"
+	FormatICS = "ics"
+	// FormatJSON and FormatNDJSON hold all categories and entries, including
+	// the trash, see db.Dump.
+	FormatJSON   = "json"
+	FormatNDJSON = "ndjson"
+)
+
+// csvHeader holds the names of the columns written by ExportCSV.
+var csvHeader = []string{"id", "category", "start", "end", "duration", "note"}
+
+// ExportCSV writes the entries of itr to w as CSV, starting with a header
+// row. Fields are separated by comma and times are formatted using layout.
+// Running entries have an empty end and their duration until now.
+func ExportCSV(w io.Writer, itr db.Iterator, categories db.CategoryMap, comma rune, layout string, now time.Time) error {
+	cw := csv.NewWriter(w)
+	cw.Comma = comma
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+	defer itr.Close()
+	for {
+		e, err := itr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		var end string
+		if !e.End.IsZero() {
+			end = e.End.Format(layout)
+		}
+		record := []string{
+			e.ID,
+			FormatCategory(categories.Path(e.CategoryID)),
+			e.Start.Format(layout),
+			end,
+			formatDuration(e.Duration(now)),
+			e.Note,
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// ParseDelimiter parses the CSV field delimiter, which must be a single
+// character. The escape sequence \t can be used for tabs.
+func ParseDelimiter(s string) (rune, error) {
+	if s == `\t` {
+		return '\t', nil
+	}
+	r, size := utf8.DecodeRuneInString(s)
+	if size == 0 || size != len(s) || r == utf8.RuneError || r == '"' || r == '\r' || r == '\n' {
+		return 0, fmt.Errorf("bad delimiter: %q", s)
+	}
+	return r, nil
+}
+
+const (
+	// icsTimeLayout is the layout of the times written by ExportICS, which are
+	// converted to UTC as iCalendar has no fixed offsets.
+	icsTimeLayout = "20060102T150405Z"
+	// icsLineLength is the maximum length of a line in octets, longer lines
+	// are folded.
+	icsLineLength = 75
+	// icsNoCategory is the summary of entries without a category.
+	icsNoCategory = "No category"
+)
+
+// icsEscaper escapes the special characters of iCalendar text values.
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// ExportICS writes the entries of itr to w as an iCalendar with one VEVENT
+// per entry. The summary is the category path, the description the note and
+// the categories the tags of the entry. The UID is derived from the entry id,
+// so exporting an entry again updates the event. Running entries end now and
+// are marked as tentative.
+func ExportICS(w io.Writer, itr db.Iterator, categories db.CategoryMap, now time.Time) error {
+	now = now.UTC()
+	iw := &icsWriter{w: w}
+	iw.line("BEGIN", "VCALENDAR")
+	iw.line("VERSION", "2.0")
+	iw.line("PRODID", "-//hiro//hiro "+version+"//EN")
+	iw.line("CALSCALE", "GREGORIAN")
+	defer itr.Close()
+	for {
+		e, err := itr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		end, status := e.End, "CONFIRMED"
+		if end.IsZero() {
+			end, status = now, "TENTATIVE"
+			if !end.After(e.Start) {
+				end = e.Start.Add(time.Second)
+			}
+		}
+		summary := FormatCategory(categories.Path(e.CategoryID))
+		if summary == "" {
+			summary = icsNoCategory
+		}
+		iw.line("BEGIN", "VEVENT")
+		iw.line("UID", e.ID+"@hiro")
+		iw.line("DTSTAMP", now.Format(icsTimeLayout))
+		iw.line("DTSTART", e.Start.UTC().Format(icsTimeLayout))
+		iw.line("DTEND", end.UTC().Format(icsTimeLayout))
+		iw.line("SUMMARY", icsEscaper.Replace(summary))
+		if e.Note != "" {
+			iw.line("DESCRIPTION", icsEscaper.Replace(e.Note))
+		}
+		if len(e.Tags) > 0 {
+			tags := make([]string, len(e.Tags))
+			for i, tag := range e.Tags {
+				tags[i] = icsEscaper.Replace(tag)
+			}
+			iw.line("CATEGORIES", strings.Join(tags, ","))
+		}
+		iw.line("STATUS", status)
+		iw.line("END", "VEVENT")
+	}
+	iw.line("END", "VCALENDAR")
+	return iw.err
+}
+
+// icsWriter writes iCalendar content lines, keeping the first error.
+type icsWriter struct {
+	w   io.Writer
+	err error
+}
+
+// line writes the content line of the given property and value, folding it
+// into multiple lines if it's longer than icsLineLength octets. UTF-8
+// sequences are not split.
+func (iw *icsWriter) line(name, value string) {
+	if iw.err != nil {
+		return
+	}
+	var (
+		buf  bytes.Buffer
+		line = name + ":" + value
+		n    = 0
+	)
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if n+size > icsLineLength {
+			// the space starting a continuation line counts towards its length
+			buf.WriteString("\r\n ")
+			n = 1
+		}
+		buf.WriteRune(r)
+		n += size
+	}
+	buf.WriteString("\r\n")
+	_, iw.err = iw.w.Write(buf.Bytes())
+}
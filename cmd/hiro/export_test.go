@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hiroapp/cli/db"
+)
+
+func TestExportCSV(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	path, err := d.CategoryPath(ParseCategory("Work:Client"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		loc   = time.FixedZone("", 2*60*60)
+		start = time.Date(2015, 6, 1, 9, 0, 0, 0, loc)
+		now   = start.Add(5 * time.Hour)
+	)
+	entries := []*db.Entry{
+		{ID: "a", CategoryID: path.CategoryID(), Start: start, End: start.Add(90 * time.Minute), Note: "Call with \"Bob\"\nand Alice"},
+		{ID: "b", Start: start.Add(4 * time.Hour)},
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := ExportCSV(&buf, db.EntryIterator(entries), categories, ';', timeLayout, now); err != nil {
+		t.Fatal(err)
+	}
+	want := `id;category;start;end;duration;note
+a;Work:Client;2015-06-01 09:00:00 +0200;2015-06-01 10:30:00 +0200;1:30:00;"Call with ""Bob""
+and Alice"
+b;;2015-06-01 13:00:00 +0200;;1:00:00;
+`
+	if got := buf.String(); got != want {
+		t.Fatalf("got=%s want=%s", got, want)
+	}
+}
+
+func TestParseDelimiter(t *testing.T) {
+	for s, want := range map[string]rune{",": ',', ";": ';', `\t`: '\t', "|": '|'} {
+		if got, err := ParseDelimiter(s); err != nil {
+			t.Errorf("%q: %s", s, err)
+		} else if got != want {
+			t.Errorf("%q: got=%q want=%q", s, got, want)
+		}
+	}
+	for _, s := range []string{"", ",,", `"`, "\n"} {
+		if _, err := ParseDelimiter(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestExportICS(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	path, err := d.CategoryPath(ParseCategory("Work:Client, Inc."), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		start = time.Date(2015, 6, 1, 9, 0, 0, 0, time.FixedZone("", 2*60*60))
+		now   = time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+	)
+	entries := []*db.Entry{
+		{
+			ID:         "a",
+			CategoryID: path.CategoryID(),
+			Start:      start,
+			End:        start.Add(90 * time.Minute).In(time.FixedZone("", -4*60*60)),
+			Note:       "Kickoff; agenda:\n" + strings.Repeat("ä", 40),
+			Tags:       []string{"billable", "meeting"},
+		},
+		{ID: "b", Start: start.Add(3 * time.Hour)},
+	}
+	var buf bytes.Buffer
+	if err := ExportICS(&buf, db.EntryIterator(entries), categories, now); err != nil {
+		t.Fatal(err)
+	}
+	want := strings.Replace(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//hiro//hiro ?//EN
+CALSCALE:GREGORIAN
+BEGIN:VEVENT
+UID:a@hiro
+DTSTAMP:20150601T123000Z
+DTSTART:20150601T070000Z
+DTEND:20150601T083000Z
+SUMMARY:Work:Client\, Inc.
+DESCRIPTION:Kickoff\; agenda:\nääääääääääääääääääääää
+ ääääääääääääääääää
+CATEGORIES:billable,meeting
+STATUS:CONFIRMED
+END:VEVENT
+BEGIN:VEVENT
+UID:b@hiro
+DTSTAMP:20150601T123000Z
+DTSTART:20150601T100000Z
+DTEND:20150601T123000Z
+SUMMARY:No category
+STATUS:TENTATIVE
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n", -1)
+	if got := buf.String(); got != want {
+		t.Fatalf("got=%q want=%q", got, want)
+	}
+}
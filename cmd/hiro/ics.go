@@ -0,0 +1,571 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradfitz/slice"
+	"github.com/hiroapp/cli/db"
+)
+
+// ICSEvent is a VEVENT read by ParseICS.
+type ICSEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	// Organizer is the email address of the organizer, and OrganizerName its
+	// common name.
+	Organizer, OrganizerName string
+	Start, End               time.Time
+	// AllDay is true if the event has dates instead of times.
+	AllDay bool
+	// RRule is the recurrence rule of the event, and RDates and ExDates are
+	// the starts of additional and excluded occurrences, see Occurrences.
+	RRule           string
+	RDates, ExDates []time.Time
+	// RecurrenceID is the original start of the occurrence of a recurring
+	// event that is overridden by this event, which has the same UID.
+	RecurrenceID time.Time
+	// Cancelled is true if the status of the event is CANCELLED.
+	Cancelled bool
+	// Err holds the error of a property that couldn't be parsed, e.g. an
+	// unknown time zone. The other fields may be incomplete if it's set.
+	Err error
+	// zone is the time zone of the start, in which occurrences recur.
+	zone *time.Location
+}
+
+// Recurring returns true if the event has a recurrence rule or dates.
+func (e *ICSEvent) Recurring() bool {
+	return e.RRule != "" || len(e.RDates) > 0
+}
+
+// icsUnescaper reverts the escaping of iCalendar text values, see icsEscaper.
+var icsUnescaper = strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n")
+
+// icsFolding matches the line breaks of folded lines.
+var icsFolding = regexp.MustCompile(`\r?\n[ \t]`)
+
+// ParseICS returns the events of the iCalendar read from r. Times without a
+// time zone are in loc, all times are converted to loc. Events with a TZID
+// that is not in the time zone database have their Err set.
+func ParseICS(r io.Reader, loc *time.Location) ([]*ICSEvent, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = icsFolding.ReplaceAll(data, nil)
+	var (
+		events     []*ICSEvent
+		event      *ICSEvent
+		components []string
+		duration   time.Duration
+	)
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		name, params, value, err := parseICSLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", n+1, err)
+		}
+		switch name {
+		case "BEGIN":
+			components = append(components, value)
+			if value == "VEVENT" && len(components) == 2 {
+				event, duration = &ICSEvent{}, 0
+			}
+			continue
+		case "END":
+			if len(components) == 0 || components[len(components)-1] != value {
+				return nil, fmt.Errorf("%d: unexpected END:%s", n+1, value)
+			}
+			if value == "VEVENT" && event != nil {
+				if event.End.IsZero() && !event.Start.IsZero() {
+					event.End = event.Start.Add(duration)
+				}
+				events = append(events, event)
+				event = nil
+			}
+			components = components[:len(components)-1]
+			continue
+		}
+		// properties of nested components like VALARM are ignored
+		if event == nil || len(components) != 2 {
+			continue
+		}
+		switch name {
+		case "UID":
+			event.UID = value
+		case "SUMMARY":
+			event.Summary = icsUnescaper.Replace(value)
+		case "DESCRIPTION":
+			event.Description = icsUnescaper.Replace(value)
+		case "ORGANIZER":
+			event.Organizer = value
+			if strings.HasPrefix(strings.ToLower(value), "mailto:") {
+				event.Organizer = value[len("mailto:"):]
+			}
+			event.OrganizerName = params["CN"]
+		case "DTSTART", "DTEND":
+			t, allDay, err := parseICSTime(value, params, loc)
+			if err != nil {
+				event.Err = err
+				continue
+			}
+			event.AllDay = event.AllDay || allDay
+			if name == "DTSTART" {
+				event.Start, event.zone = t.In(loc), t.Location()
+			} else {
+				event.End = t.In(loc)
+			}
+		case "DURATION":
+			if duration, err = parseICSDuration(value); err != nil {
+				event.Err = err
+			}
+		case "RECURRENCE-ID":
+			t, _, err := parseICSTime(value, params, loc)
+			if err != nil {
+				event.Err = err
+				continue
+			}
+			event.RecurrenceID = t.In(loc)
+		case "RRULE":
+			if event.RRule != "" {
+				event.Err = fmt.Errorf("multiple recurrence rules are not supported")
+			}
+			event.RRule = value
+		case "RDATE", "EXDATE":
+			if params["VALUE"] == "PERIOD" {
+				event.Err = fmt.Errorf("recurrence periods are not supported")
+				continue
+			}
+			for _, v := range strings.Split(value, ",") {
+				t, _, err := parseICSTime(v, params, loc)
+				if err != nil {
+					event.Err = err
+					break
+				} else if name == "RDATE" {
+					event.RDates = append(event.RDates, t.In(loc))
+				} else {
+					event.ExDates = append(event.ExDates, t.In(loc))
+				}
+			}
+		case "STATUS":
+			event.Cancelled = value == "CANCELLED"
+		}
+	}
+	if len(components) > 0 {
+		return nil, fmt.Errorf("missing END:%s", components[len(components)-1])
+	}
+	return events, nil
+}
+
+// parseICSLine splits an unfolded content line into its name, parameters and
+// value. Parameter values may be quoted.
+func parseICSLine(line string) (string, map[string]string, string, error) {
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return "", nil, "", fmt.Errorf("bad line: %s", line)
+	}
+	name, rest := strings.ToUpper(line[:i]), line[i:]
+	params := make(map[string]string)
+	for rest[0] == ';' {
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			return "", nil, "", fmt.Errorf("bad parameter: %s", line)
+		}
+		key := strings.ToUpper(rest[1:eq])
+		rest = rest[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				return "", nil, "", fmt.Errorf("unterminated parameter: %s", line)
+			}
+			val, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, ";:")
+			if end == -1 {
+				return "", nil, "", fmt.Errorf("bad parameter: %s", line)
+			}
+			val, rest = rest[:end], rest[end:]
+		}
+		params[key] = val
+		if rest == "" {
+			break
+		}
+	}
+	if !strings.HasPrefix(rest, ":") {
+		return "", nil, "", fmt.Errorf("bad line: %s", line)
+	}
+	return name, params, rest[1:], nil
+}
+
+// parseICSTime parses a DATE-TIME or DATE value in loc, unless it's in UTC or
+// the TZID parameter is set. The time is returned in the time zone it was
+// parsed in. It returns true for a DATE.
+func parseICSTime(value string, params map[string]string, loc *time.Location) (time.Time, bool, error) {
+	if params["VALUE"] == "DATE" || len(value) == len("20060102") {
+		t, err := time.ParseInLocation("20060102", value, loc)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("bad date: %s", value)
+		}
+		return t, true, nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse(icsTimeLayout, value)
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("bad time: %s", value)
+		}
+		return t, false, nil
+	}
+	tzLoc := loc
+	if tzid := params["TZID"]; tzid != "" {
+		var err error
+		if tzLoc, err = time.LoadLocation(strings.TrimPrefix(tzid, "/")); err != nil {
+			return time.Time{}, false, fmt.Errorf("unknown time zone: %s", tzid)
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, tzLoc)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("bad time: %s", value)
+	}
+	return t, false, nil
+}
+
+// icsDuration matches the DURATION values of events.
+var icsDuration = regexp.MustCompile(`^\+?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseICSDuration parses a DURATION value, e.g. PT1H30M.
+func parseICSDuration(value string) (time.Duration, error) {
+	m := icsDuration.FindStringSubmatch(value)
+	if m == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, fmt.Errorf("bad duration: %s", value)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second} {
+		if m[i+1] != "" {
+			n, err := strconv.Atoi(m[i+1])
+			if err != nil {
+				return 0, fmt.Errorf("bad duration: %s", value)
+			}
+			d += time.Duration(n) * unit
+		}
+	}
+	return d, nil
+}
+
+// icsWeekdays maps the weekdays of recurrence rules to time.Weekday.
+var icsWeekdays = map[string]time.Weekday{
+	"SU": time.Sunday,
+	"MO": time.Monday,
+	"TU": time.Tuesday,
+	"WE": time.Wednesday,
+	"TH": time.Thursday,
+	"FR": time.Friday,
+	"SA": time.Saturday,
+}
+
+// icsMaxOccurrences limits the number of occurrences of a recurring event.
+const icsMaxOccurrences = 10000
+
+// icsRecurrence is a recurrence rule parsed by parseICSRecurrence.
+type icsRecurrence struct {
+	Freq     string
+	Interval int
+	// Count is the maximum number of occurrences, or 0.
+	Count int
+	// Until is the time the last occurrence starts before, or the zero time.
+	Until time.Time
+	// ByDay holds the weekdays an event recurs on, if it's set.
+	ByDay     map[time.Weekday]bool
+	WeekStart time.Weekday
+}
+
+// parseICSRecurrence parses a RRULE value. Only simple rules are supported:
+// DAILY, WEEKLY, MONTHLY and YEARLY rules with INTERVAL, COUNT, UNTIL, WKST,
+// and BYDAY without numbers for DAILY and WEEKLY rules.
+func parseICSRecurrence(value string, loc *time.Location) (*icsRecurrence, error) {
+	r := &icsRecurrence{Interval: 1, WeekStart: time.Monday}
+	unsupported := fmt.Errorf("unsupported recurrence rule: %s", value)
+	for _, part := range strings.Split(value, ";") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad recurrence rule: %s", value)
+		}
+		var err error
+		switch key, val := strings.ToUpper(kv[0]), strings.ToUpper(kv[1]); key {
+		case "FREQ":
+			r.Freq = val
+		case "INTERVAL", "COUNT":
+			n, perr := strconv.Atoi(val)
+			if perr != nil || n <= 0 {
+				return nil, fmt.Errorf("bad recurrence rule: %s", value)
+			} else if key == "INTERVAL" {
+				r.Interval = n
+			} else {
+				r.Count = n
+			}
+		case "UNTIL":
+			var (
+				until time.Time
+				date  bool
+			)
+			if until, date, err = parseICSTime(val, nil, loc); err != nil {
+				return nil, err
+			} else if date {
+				r.Until = until.AddDate(0, 0, 1)
+			} else {
+				r.Until = until.Add(time.Second)
+			}
+		case "BYDAY":
+			r.ByDay = make(map[time.Weekday]bool)
+			for _, day := range strings.Split(val, ",") {
+				weekday, ok := icsWeekdays[day]
+				if !ok {
+					return nil, unsupported
+				}
+				r.ByDay[weekday] = true
+			}
+		case "WKST":
+			var ok bool
+			if r.WeekStart, ok = icsWeekdays[val]; !ok {
+				return nil, fmt.Errorf("bad recurrence rule: %s", value)
+			}
+		default:
+			return nil, unsupported
+		}
+	}
+	switch r.Freq {
+	case "DAILY", "WEEKLY":
+	case "MONTHLY", "YEARLY":
+		if r.ByDay != nil {
+			return nil, unsupported
+		}
+	default:
+		return nil, unsupported
+	}
+	return r, nil
+}
+
+// candidates returns the candidate starts of the occurrences in the given
+// period of the rule, the first period being the one of start, see skip.
+func (r *icsRecurrence) candidates(start time.Time, period int) []time.Time {
+	n := period * r.Interval
+	switch r.Freq {
+	case "DAILY":
+		return []time.Time{start.AddDate(0, 0, n)}
+	case "WEEKLY":
+		if r.ByDay == nil {
+			return []time.Time{start.AddDate(0, 0, 7*n)}
+		}
+		week := start.AddDate(0, 0, 7*n-(int(start.Weekday())-int(r.WeekStart)+7)%7)
+		candidates := make([]time.Time, 7)
+		for i := range candidates {
+			candidates[i] = week.AddDate(0, 0, i)
+		}
+		return candidates
+	case "MONTHLY":
+		return []time.Time{start.AddDate(0, n, 0)}
+	}
+	return []time.Time{start.AddDate(n, 0, 0)}
+}
+
+// skip returns true if the candidate start t is not an occurrence, because
+// its weekday is not in ByDay, or because the day of start doesn't exist in
+// its month, like February 30, which AddDate normalizes.
+func (r *icsRecurrence) skip(start, t time.Time) bool {
+	return (r.ByDay != nil && !r.ByDay[t.Weekday()]) ||
+		(t.Day() != start.Day() && (r.Freq == "MONTHLY" || r.Freq == "YEARLY"))
+}
+
+// Occurrences returns the occurrences of the recurring event e that start
+// before until, ordered by start. Their RecurrenceID is their start, and they
+// have no recurrence rule or dates. Occurrences recur in the time zone of the
+// start of e, so they keep their local time across daylight saving time
+// changes. The start of e is always the first occurrence, and the starts in
+// ExDates are excluded. At most icsMaxOccurrences are returned.
+func (e *ICSEvent) Occurrences(until time.Time) ([]*ICSEvent, error) {
+	zone := e.zone
+	if zone == nil {
+		zone = e.Start.Location()
+	}
+	start := e.Start.In(zone)
+	starts := []time.Time{start}
+	if e.RRule != "" {
+		r, err := parseICSRecurrence(e.RRule, e.Start.Location())
+		if err != nil {
+			return nil, err
+		}
+	periods:
+		for period := 0; ; period++ {
+			for _, t := range r.candidates(start, period) {
+				if !t.After(start) {
+					continue
+				} else if !t.Before(until) || (!r.Until.IsZero() && !t.Before(r.Until)) ||
+					(r.Count > 0 && len(starts) >= r.Count) || len(starts) >= icsMaxOccurrences {
+					break periods
+				} else if !r.skip(start, t) {
+					starts = append(starts, t)
+				}
+			}
+		}
+	}
+	starts = append(starts, e.RDates...)
+	slice.Sort(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+	var occurrences []*ICSEvent
+	for i, t := range starts {
+		if !t.Before(until) || len(occurrences) >= icsMaxOccurrences {
+			break
+		} else if i > 0 && t.Equal(starts[i-1]) {
+			continue
+		}
+		excluded := false
+		for _, exDate := range e.ExDates {
+			excluded = excluded || exDate.Equal(t)
+		}
+		if excluded {
+			continue
+		}
+		occurrence := *e
+		occurrence.Start = t.In(e.Start.Location())
+		occurrence.End = occurrence.Start.Add(e.End.Sub(e.Start))
+		occurrence.RecurrenceID = occurrence.Start
+		occurrence.RRule, occurrence.RDates, occurrence.ExDates = "", nil, nil
+		occurrences = append(occurrences, &occurrence)
+	}
+	return occurrences, nil
+}
+
+// ICSRule maps the events whose summary or organizer matches Pattern to
+// Category, see ParseICSRule.
+type ICSRule struct {
+	// Organizer is true if the rule matches the organizer instead of the
+	// summary.
+	Organizer bool
+	Pattern   *regexp.Regexp
+	Category  []string
+}
+
+// ParseICSRule parses a rule of the form [organizer:]REGEXP=CATEGORY, e.g.
+// "standup|retro=Work:Meetings" or "organizer:@client\.com$=Client". The
+// regular expression is matched case insensitively against the summary, or
+// the email address and the name of the organizer.
+func ParseICSRule(s string) (*ICSRule, error) {
+	r := &ICSRule{}
+	if strings.HasPrefix(s, "organizer:") {
+		r.Organizer, s = true, s[len("organizer:"):]
+	} else {
+		s = strings.TrimPrefix(s, "summary:")
+	}
+	i := strings.LastIndex(s, "=")
+	if i == -1 {
+		return nil, fmt.Errorf("bad rule, want [organizer:]REGEXP=CATEGORY: %s", s)
+	}
+	var err error
+	if r.Pattern, err = regexp.Compile("(?i)" + s[:i]); err != nil {
+		return nil, err
+	}
+	r.Category = ParseCategory(s[i+1:])
+	return r, nil
+}
+
+// Match returns true if r matches the given event.
+func (r *ICSRule) Match(e *ICSEvent) bool {
+	if r.Organizer {
+		return (e.Organizer != "" && r.Pattern.MatchString(e.Organizer)) ||
+			(e.OrganizerName != "" && r.Pattern.MatchString(e.OrganizerName))
+	}
+	return r.Pattern.MatchString(e.Summary)
+}
+
+// ImportICS returns the given events as entries to import with
+// ImportEntries. The category of an entry is the one of the first matching
+// rule, or the given default category, and its note is the summary of the
+// event. The id is derived from the UID and the RecurrenceID of the event, so
+// events are imported only once. Recurring events are imported as their
+// occurrences that start before now, see Occurrences, except for the ones
+// overridden by another event, so importing the events again later imports
+// the new occurrences. All-day and cancelled events are skipped.
+func ImportICS(events []*ICSEvent, rules []*ICSRule, category []string, now time.Time) []*ImportEntry {
+	overridden := make(map[string]bool)
+	for _, event := range events {
+		if !event.RecurrenceID.IsZero() {
+			overridden[icsKey(event)] = true
+		}
+	}
+	var entries []*ImportEntry
+	for _, event := range events {
+		if !event.Recurring() || !event.RecurrenceID.IsZero() || icsSkipReason(event) != "" {
+			entries = append(entries, importICSEvent(event, rules, category))
+			continue
+		}
+		occurrences, err := event.Occurrences(now)
+		if err != nil {
+			ie := importICSEvent(event, rules, category)
+			ie.Skipped = err.Error()
+			entries = append(entries, ie)
+			continue
+		}
+		for _, occurrence := range occurrences {
+			if !overridden[icsKey(occurrence)] {
+				entries = append(entries, importICSEvent(occurrence, rules, category))
+			}
+		}
+	}
+	return entries
+}
+
+// importICSEvent returns the given event as an entry to import, see
+// ImportICS.
+func importICSEvent(event *ICSEvent, rules []*ICSRule, category []string) *ImportEntry {
+	ie := &ImportEntry{
+		Source:   "event " + strings.Replace(icsKey(event), "\x00", " ", 1),
+		Entry:    &db.Entry{ID: importID(icsKey(event)), Start: event.Start, End: event.End, Note: event.Summary},
+		Category: category,
+		Skipped:  icsSkipReason(event),
+	}
+	for _, rule := range rules {
+		if rule.Match(event) {
+			ie.Category = rule.Category
+			break
+		}
+	}
+	return ie
+}
+
+// icsKey returns the key identifying the given event: its UID, followed by
+// its RecurrenceID in UTC for occurrences of recurring events.
+func icsKey(e *ICSEvent) string {
+	if e.RecurrenceID.IsZero() {
+		return e.UID
+	}
+	return e.UID + "\x00" + e.RecurrenceID.UTC().Format(icsTimeLayout)
+}
+
+// icsSkipReason returns the reason the given event can't be imported, or an
+// empty string.
+func icsSkipReason(e *ICSEvent) string {
+	switch {
+	case e.Err != nil:
+		return e.Err.Error()
+	case e.UID == "":
+		return "event has no UID"
+	case e.Cancelled:
+		return "event is cancelled"
+	case e.AllDay:
+		return "all-day event"
+	case e.Start.IsZero():
+		return "event has no start"
+	case !e.End.After(e.Start):
+		return "event has no duration"
+	}
+	return ""
+}
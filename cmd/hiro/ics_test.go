@@ -0,0 +1,292 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var testICS = strings.Replace(`BEGIN:VCALENDAR
+VERSION:2.0
+PRODID:-//Example//Calendar//EN
+BEGIN:VTIMEZONE
+TZID:Europe/Berlin
+END:VTIMEZONE
+BEGIN:VEVENT
+UID:standup-1@example.com
+SUMMARY:Daily standup\, team A
+ORGANIZER;CN="Lead, Team":mailto:lead@example.com
+DTSTART;TZID=Europe/Berlin:20150601T093000
+DTEND;TZID=Europe/Berlin:20150601T094500
+BEGIN:VALARM
+TRIGGER:-PT15M
+DESCRIPTION:Reminder
+END:VALARM
+END:VEVENT
+BEGIN:VEVENT
+UID:review-1@example.com
+SUMMARY:Code review with a summary that is long enough to be folded by the
+  calendar
+ORGANIZER:mailto:dev@client.com
+DTSTART:20150601T120000Z
+DURATION:PT1H30M
+END:VEVENT
+BEGIN:VEVENT
+UID:holiday-1@example.com
+SUMMARY:Holiday
+DTSTART;VALUE=DATE:20150602
+DTEND;VALUE=DATE:20150603
+END:VEVENT
+BEGIN:VEVENT
+UID:weekly-1@example.com
+SUMMARY:Weekly
+RRULE:FREQ=WEEKLY
+DTSTART:20150601T150000Z
+DTEND:20150601T160000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:standup-1@example.com
+SUMMARY:Daily standup
+DTSTART:20150601T073000Z
+DTEND:20150601T074500Z
+END:VEVENT
+END:VCALENDAR
+`, "\n", "\r\n", -1)
+
+func TestParseICS(t *testing.T) {
+	loc := time.FixedZone("", 3600)
+	events, err := ParseICS(strings.NewReader(testICS), loc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*ICSEvent{
+		{
+			UID:           "standup-1@example.com",
+			Summary:       "Daily standup, team A",
+			Organizer:     "lead@example.com",
+			OrganizerName: "Lead, Team",
+			Start:         time.Date(2015, 6, 1, 7, 30, 0, 0, time.UTC).In(loc),
+			End:           time.Date(2015, 6, 1, 7, 45, 0, 0, time.UTC).In(loc),
+		},
+		{
+			UID:       "review-1@example.com",
+			Summary:   "Code review with a summary that is long enough to be folded by the calendar",
+			Organizer: "dev@client.com",
+			Start:     time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC).In(loc),
+			End:       time.Date(2015, 6, 1, 13, 30, 0, 0, time.UTC).In(loc),
+		},
+		{
+			UID:     "holiday-1@example.com",
+			Summary: "Holiday",
+			Start:   time.Date(2015, 6, 2, 0, 0, 0, 0, loc),
+			End:     time.Date(2015, 6, 3, 0, 0, 0, 0, loc),
+			AllDay:  true,
+		},
+		{
+			UID:     "weekly-1@example.com",
+			Summary: "Weekly",
+			Start:   time.Date(2015, 6, 1, 15, 0, 0, 0, time.UTC).In(loc),
+			End:     time.Date(2015, 6, 1, 16, 0, 0, 0, time.UTC).In(loc),
+			RRule:   "FREQ=WEEKLY",
+		},
+		{
+			UID:     "standup-1@example.com",
+			Summary: "Daily standup",
+			Start:   time.Date(2015, 6, 1, 7, 30, 0, 0, time.UTC).In(loc),
+			End:     time.Date(2015, 6, 1, 7, 45, 0, 0, time.UTC).In(loc),
+		},
+	}
+	if diff := diffConfig.Compare(events, want); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, data := range []string{
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nEND:VCALENDAR",
+		"BEGIN:VCALENDAR\nBEGIN:VEVENT\nEND:VEVENT",
+		"BEGIN:VCALENDAR\nSUMMARY;CN=\"a:b\nEND:VCALENDAR",
+	} {
+		if _, err := ParseICS(strings.NewReader(data), loc); err == nil {
+			t.Errorf("%q: expected error", data)
+		}
+	}
+}
+
+func TestParseICSDuration(t *testing.T) {
+	for s, want := range map[string]time.Duration{
+		"PT1H30M": 90 * time.Minute,
+		"P1DT2S":  24*time.Hour + 2*time.Second,
+		"P1W":     7 * 24 * time.Hour,
+		"+PT15M":  15 * time.Minute,
+	} {
+		if got, err := parseICSDuration(s); err != nil {
+			t.Errorf("%s: %s", s, err)
+		} else if got != want {
+			t.Errorf("%s: got=%s want=%s", s, got, want)
+		}
+	}
+	for _, s := range []string{"", "P", "PT", "1H", "-PT15M"} {
+		if _, err := parseICSDuration(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestImportICS(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	events, err := ParseICS(strings.NewReader(testICS), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules []*ICSRule
+	for _, s := range []string{"organizer:client\\.com$=Client:Reviews", "standup=Work:Meetings"} {
+		rule, err := ParseICSRule(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, rule)
+	}
+	want := []string{
+		"Work:Meetings",
+		"Client:Reviews",
+		"skip: all-day event",
+		"Misc",
+		"Misc",
+		"Misc",
+		"skip: duplicate",
+	}
+	importICS := func(dryRun bool) []string {
+		entries := ImportICS(events, rules, ParseCategory("Misc"), time.Date(2015, 6, 20, 0, 0, 0, 0, time.UTC))
+		if err := ImportEntries(d, entries, dryRun); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, ie := range entries {
+			if ie.Skipped == "" {
+				got = append(got, FormatCategory(ie.Path))
+			} else {
+				got = append(got, "skip: "+ie.Skipped)
+			}
+		}
+		return got
+	}
+	// a dry run doesn't change the database
+	if diff := diffConfig.Compare(importICS(true), want); diff != "" {
+		t.Fatal(diff)
+	} else if categories, err := d.Categories(); err != nil {
+		t.Fatal(err)
+	} else if len(categories) != 0 {
+		t.Fatalf("dry run created %d categories", len(categories))
+	}
+
+	if diff := diffConfig.Compare(importICS(false), want); diff != "" {
+		t.Fatal(diff)
+	} else if entry, err := ById(d, importID("standup-1@example.com")); err != nil {
+		t.Fatal(err)
+	} else if entry.Note != "Daily standup, team A" {
+		t.Fatalf("got=%q want the summary as note", entry.Note)
+	}
+
+	// importing the same events again skips them
+	for _, i := range []int{0, 1, 3, 4, 5} {
+		want[i] = "skip: already imported"
+	}
+	if diff := diffConfig.Compare(importICS(false), want); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestImportICS_recurring(t *testing.T) {
+	data := `BEGIN:VCALENDAR
+BEGIN:VEVENT
+UID:sync@example.com
+SUMMARY:Sync
+DTSTART;TZID=Europe/Berlin:20150323T100000
+DTEND;TZID=Europe/Berlin:20150323T103000
+RRULE:FREQ=WEEKLY;BYDAY=MO,TH;COUNT=6
+EXDATE;TZID=Europe/Berlin:20150326T100000
+END:VEVENT
+BEGIN:VEVENT
+UID:sync@example.com
+RECURRENCE-ID;TZID=Europe/Berlin:20150330T100000
+SUMMARY:Sync moved
+DTSTART;TZID=Europe/Berlin:20150330T140000
+DTEND;TZID=Europe/Berlin:20150330T143000
+END:VEVENT
+BEGIN:VEVENT
+UID:sync@example.com
+RECURRENCE-ID;TZID=Europe/Berlin:20150402T100000
+SUMMARY:Sync
+STATUS:CANCELLED
+DTSTART;TZID=Europe/Berlin:20150402T100000
+DTEND;TZID=Europe/Berlin:20150402T103000
+END:VEVENT
+BEGIN:VEVENT
+UID:invoices@example.com
+SUMMARY:Invoices
+DTSTART:20150131T090000Z
+DTEND:20150131T100000Z
+RRULE:FREQ=MONTHLY;UNTIL=20150531
+RDATE:20150215T090000Z
+END:VEVENT
+BEGIN:VEVENT
+UID:payday@example.com
+SUMMARY:Payday
+DTSTART:20150101T090000Z
+DTEND:20150101T100000Z
+RRULE:FREQ=MONTHLY;BYMONTHDAY=1,15
+END:VEVENT
+END:VCALENDAR
+`
+	events, err := ParseICS(strings.NewReader(data), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Now  time.Time
+		Want []string
+	}{
+		{
+			Now: time.Date(2015, 7, 1, 0, 0, 0, 0, time.UTC),
+			Want: []string{
+				"event sync@example.com 20150323T090000Z: 2015-03-23 09:00 Sync",
+				"event sync@example.com 20150406T080000Z: 2015-04-06 08:00 Sync",
+				"event sync@example.com 20150409T080000Z: 2015-04-09 08:00 Sync",
+				"event sync@example.com 20150330T080000Z: 2015-03-30 12:00 Sync moved",
+				"event sync@example.com 20150402T080000Z: skip: event is cancelled",
+				"event invoices@example.com 20150131T090000Z: 2015-01-31 09:00 Invoices",
+				"event invoices@example.com 20150215T090000Z: 2015-02-15 09:00 Invoices",
+				"event invoices@example.com 20150331T090000Z: 2015-03-31 09:00 Invoices",
+				"event invoices@example.com 20150531T090000Z: 2015-05-31 09:00 Invoices",
+				"event payday@example.com: skip: unsupported recurrence rule: FREQ=MONTHLY;BYMONTHDAY=1,15",
+			},
+		},
+		{
+			Now: time.Date(2015, 3, 1, 0, 0, 0, 0, time.UTC),
+			Want: []string{
+				"event sync@example.com 20150330T080000Z: 2015-03-30 12:00 Sync moved",
+				"event sync@example.com 20150402T080000Z: skip: event is cancelled",
+				"event invoices@example.com 20150131T090000Z: 2015-01-31 09:00 Invoices",
+				"event invoices@example.com 20150215T090000Z: 2015-02-15 09:00 Invoices",
+				"event payday@example.com: skip: unsupported recurrence rule: FREQ=MONTHLY;BYMONTHDAY=1,15",
+			},
+		},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, ie := range ImportICS(events, nil, nil, test.Now) {
+			if ie.Skipped != "" {
+				got = append(got, ie.Source+": skip: "+ie.Skipped)
+			} else {
+				got = append(got, ie.Source+": "+ie.Entry.Start.Format("2006-01-02 15:04")+" "+ie.Entry.Note)
+			}
+		}
+		if diff := diffConfig.Compare(got, test.Want); diff != "" {
+			t.Errorf("%s: %s", test.Now, diff)
+		}
+	}
+	// an override replaces the occurrence of the recurring event
+	entries := ImportICS(events, nil, nil, tests[0].Now)
+	if id := importID("sync@example.com\x0020150330T080000Z"); entries[3].Entry.ID != id {
+		t.Errorf("got=%s want=%s", entries[3].Entry.ID, id)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hiroapp/cli/db"
+)
+
+// minShortID is the minimum length of the ids printed by ShortIDs, which is
+// the length of the first group of a uuid.
+const minShortID = 8
+
+// refPrefix starts the symbolic references accepted by ById, see resolveRef.
+const refPrefix = "@"
+
+// ById returns the entry with the given id, or the only entry whose id starts
+// with it, or the entry of a symbolic reference like @last, see resolveRef, or
+// an error. An *AmbiguousIDError is returned if multiple entries start with
+// the given id.
+func ById(d db.DB, id string) (*db.Entry, error) {
+	if id == "" {
+		return nil, errors.New("id must not be empty")
+	} else if strings.HasPrefix(id, refPrefix) {
+		return resolveRef(d, id, time.Now())
+	}
+	itr, err := d.Query(db.Query{IDPrefix: id, Asc: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := db.IteratorEntries(itr)
+	if err != nil {
+		return nil, err
+	}
+	return matchID(id, entries)
+}
+
+// trashedById is like ById for the entries in the trash, which can't be
+// referenced symbolically.
+func trashedById(d db.DB, id string) (*db.Entry, error) {
+	if id == "" {
+		return nil, errors.New("id must not be empty")
+	} else if strings.HasPrefix(id, refPrefix) {
+		return nil, fmt.Errorf("references can't be used for the trash: %s", id)
+	}
+	trash, err := d.Trash()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*db.Entry
+	for _, e := range trash {
+		if strings.HasPrefix(e.ID, id) {
+			entries = append(entries, e.Entry)
+		}
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("entry is not in trash: %s", id)
+	}
+	return matchID(id, entries)
+}
+
+// resolveRef returns the entry of the given symbolic reference at the given
+// time:
+//
+//	@active       the active entry, an *AmbiguousIDError if there are several
+//	@last         the entry that started last
+//	@-N           the Nth entry before the last one in start order, @-0 is @last
+//	@today-first  the first entry that started today
+func resolveRef(d db.DB, ref string, now time.Time) (*db.Entry, error) {
+	var (
+		q     db.Query
+		match = func(*db.Entry) bool { return true }
+	)
+	switch {
+	case ref == "@active":
+		q = db.Query{Active: true, Limit: 2}
+	case ref == "@last":
+		q = db.Query{Limit: 1}
+	case ref == "@today-first":
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		// From also returns the entries running since yesterday
+		q = db.Query{From: today, Asc: true}
+		match = func(e *db.Entry) bool { return !e.Start.Before(today) }
+	case strings.HasPrefix(ref, "@-"):
+		n, err := strconv.Atoi(ref[2:])
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad reference: %s", ref)
+		}
+		q = db.Query{Offset: n, Limit: 1}
+	default:
+		return nil, fmt.Errorf("unknown reference: %s, use @active, @last, @-N or @today-first", ref)
+	}
+	itr, err := d.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := db.IteratorEntries(itr)
+	if err != nil {
+		return nil, err
+	}
+	var matches []*db.Entry
+	for _, e := range entries {
+		if match(e) {
+			matches = append(matches, e)
+		}
+	}
+	switch {
+	case len(matches) == 0:
+		return nil, fmt.Errorf("no entry matches %s", ref)
+	case ref == "@active" && len(matches) > 1:
+		return nil, &AmbiguousIDError{Prefix: ref, Candidates: matches}
+	}
+	return matches[0], nil
+}
+
+// matchID returns the entry with the given id, or the only one of the given
+// entries whose id starts with it.
+func matchID(id string, entries []*db.Entry) (*db.Entry, error) {
+	for _, e := range entries {
+		if e.ID == id {
+			return e, nil
+		}
+	}
+	switch len(entries) {
+	case 0:
+		return nil, fmt.Errorf("entry does not exist: %s", id)
+	case 1:
+		return entries[0], nil
+	}
+	return nil, &AmbiguousIDError{Prefix: id, Candidates: entries}
+}
+
+// AmbiguousIDError is returned by ById if multiple entries start with the
+// given id, or if @active matches multiple entries.
+type AmbiguousIDError struct {
+	Prefix string
+	// Candidates holds the entries starting with Prefix.
+	Candidates []*db.Entry
+}
+
+func (e *AmbiguousIDError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id %s is ambiguous, it matches %d entries:", e.Prefix, len(e.Candidates))
+	for _, c := range e.Candidates {
+		fmt.Fprintf(&buf, "\n  %s  %s", c.ID, c.Start.Format(config.TimeFormat))
+	}
+	return buf.String()
+}
+
+// ShortIDs maps ids to their shortest unique prefixes, see NewShortIDs.
+type ShortIDs map[string]string
+
+// NewShortIDs returns the shortest prefixes of the given ids that are unique
+// among them, but at least minShortID characters long.
+func NewShortIDs(ids []string) ShortIDs {
+	sorted := append([]string(nil), ids...)
+	sort.Strings(sorted)
+	s := make(ShortIDs, len(sorted))
+	for i, id := range sorted {
+		n := minShortID
+		// only the neighbors in sorted order can share a longer prefix
+		for _, j := range []int{i - 1, i + 1} {
+			if j >= 0 && j < len(sorted) {
+				if common := commonPrefix(id, sorted[j]); common >= n {
+					n = common + 1
+				}
+			}
+		}
+		if n > len(id) {
+			n = len(id)
+		}
+		s[id] = id[:n]
+	}
+	return s
+}
+
+// commonPrefix returns the length of the common prefix of a and b.
+func commonPrefix(a, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// Get returns the short id of the given id, or the id itself if it's
+// unknown or s is nil.
+func (s ShortIDs) Get(id string) string {
+	if short, ok := s[id]; ok {
+		return short
+	}
+	return id
+}
+
+// trashShortIDs returns the ShortIDs of the entries in the trash of d.
+func trashShortIDs(d db.DB) (ShortIDs, error) {
+	trash, err := d.Trash()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(trash))
+	for i, e := range trash {
+		ids[i] = e.ID
+	}
+	return NewShortIDs(ids), nil
+}
+
+// entryShortIDs returns the ShortIDs of the given entries, which are unique
+// among all entries in d. Only the ids sharing a prefix with the given ones
+// are queried, so printing a few entries doesn't read the whole table.
+func entryShortIDs(d db.DB, entries []*db.Entry) (ShortIDs, error) {
+	s := make(ShortIDs, len(entries))
+	for _, e := range entries {
+		if _, ok := s[e.ID]; ok {
+			continue
+		}
+		n := minShortID
+		for ; n < len(e.ID); n++ {
+			itr, err := d.Query(db.Query{IDPrefix: e.ID[:n], Limit: 2})
+			if err != nil {
+				return nil, err
+			}
+			matches, err := db.IteratorEntries(itr)
+			if err != nil {
+				return nil, err
+			} else if len(matches) < 2 {
+				break
+			}
+		}
+		if n > len(e.ID) {
+			n = len(e.ID)
+		}
+		s[e.ID] = e.ID[:n]
+	}
+	return s, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hiroapp/cli/db"
+)
+
+func TestNewShortIDs(t *testing.T) {
+	ids := NewShortIDs([]string{
+		"0a1b2c3d-0000-4000-8000-000000000000",
+		"0a1b2c3d-1000-4000-8000-000000000000",
+		"0a1b2c3e-0000-4000-8000-000000000000",
+		"ffffffff-0000-4000-8000-000000000000",
+		"short",
+	})
+	want := map[string]string{
+		"0a1b2c3d-0000-4000-8000-000000000000": "0a1b2c3d-0",
+		"0a1b2c3d-1000-4000-8000-000000000000": "0a1b2c3d-1",
+		"0a1b2c3e-0000-4000-8000-000000000000": "0a1b2c3e",
+		"ffffffff-0000-4000-8000-000000000000": "ffffffff",
+		"short":                                "short",
+	}
+	for id, short := range want {
+		if got := ids.Get(id); got != short {
+			t.Errorf("id %s: got=%s want=%s", id, got, short)
+		}
+	}
+	if got := ids.Get("unknown"); got != "unknown" {
+		t.Errorf("got=%s want=unknown", got)
+	}
+}
+
+func TestEntryShortIDs(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.UTC)
+	var entries []*db.Entry
+	for i, id := range []string{
+		"0a1b2c3d-0000-4000-8000-000000000000",
+		"0a1b2c3d-1000-4000-8000-000000000000",
+		"0a1b2c3e-0000-4000-8000-000000000000",
+		"short",
+	} {
+		e := &db.Entry{ID: id, Start: start.Add(time.Duration(i) * time.Hour), End: start.Add(time.Duration(i)*time.Hour + time.Minute)}
+		if err := d.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	// the ids are unique among all entries, not just the given ones
+	ids, err := entryShortIDs(d, []*db.Entry{entries[0], entries[2], entries[3]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ShortIDs{
+		"0a1b2c3d-0000-4000-8000-000000000000": "0a1b2c3d-0",
+		"0a1b2c3e-0000-4000-8000-000000000000": "0a1b2c3e",
+		"short":                                "short",
+	}
+	if diff := diffConfig.Compare(ids, want); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestMatchID(t *testing.T) {
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.UTC)
+	entries := []*db.Entry{
+		{ID: "ab", Start: start},
+		{ID: "abc1", Start: start},
+		{ID: "abc2", Start: start},
+	}
+	tests := []struct {
+		ID      string
+		Entries []*db.Entry
+		Want    string
+		Err     bool
+	}{
+		{ID: "ab", Entries: entries, Want: "ab"},
+		{ID: "abc1", Entries: entries[1:2], Want: "abc1"},
+		{ID: "abc", Entries: entries[1:], Err: true},
+		{ID: "x", Err: true},
+	}
+	for _, test := range tests {
+		got, err := matchID(test.ID, test.Entries)
+		if test.Err {
+			if err == nil {
+				t.Errorf("id %s: expected error", test.ID)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("id %s: %s", test.ID, err)
+		} else if got.ID != test.Want {
+			t.Errorf("id %s: got=%s want=%s", test.ID, got.ID, test.Want)
+		}
+	}
+	_, err := matchID("abc", entries[1:])
+	if ambiguous, ok := err.(*AmbiguousIDError); !ok || len(ambiguous.Candidates) != 2 {
+		t.Errorf("got=%#v want *AmbiguousIDError with 2 candidates", err)
+	}
+}
+
+func TestResolveRef(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	now := time.Date(2015, 6, 2, 12, 0, 0, 0, time.UTC)
+	entries := []*db.Entry{
+		{Start: now.Add(-27 * time.Hour), End: now.Add(-26 * time.Hour)},
+		{Start: now.Add(-13 * time.Hour), End: now.Add(-11 * time.Hour)},
+		{Start: now.Add(-3 * time.Hour), End: now.Add(-2 * time.Hour)},
+		{Start: now.Add(-1 * time.Hour)},
+	}
+	for _, e := range entries {
+		if err := d.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		Ref  string
+		Want *db.Entry
+		Err  string
+	}{
+		{Ref: "@active", Want: entries[3]},
+		{Ref: "@last", Want: entries[3]},
+		{Ref: "@-0", Want: entries[3]},
+		{Ref: "@-2", Want: entries[1]},
+		{Ref: "@-4", Err: "no entry matches @-4"},
+		{Ref: "@--1", Err: "bad reference: @--1"},
+		// entries[1] runs over midnight
+		{Ref: "@today-first", Want: entries[2]},
+		{Ref: "@first", Err: "unknown reference: @first, use @active, @last, @-N or @today-first"},
+	}
+	for _, test := range tests {
+		got, err := resolveRef(d, test.Ref, now)
+		if test.Err != "" {
+			if err == nil || err.Error() != test.Err {
+				t.Errorf("ref %s: got=%v want=%s", test.Ref, err, test.Err)
+			}
+		} else if err != nil {
+			t.Errorf("ref %s: %s", test.Ref, err)
+		} else if got.ID != test.Want.ID {
+			t.Errorf("ref %s: got=%s want=%s", test.Ref, got.ID, test.Want.ID)
+		}
+	}
+	entries[1].End = time.Time{}
+	if err := d.SaveEntry(entries[1]); err != nil {
+		t.Fatal(err)
+	} else if _, err := resolveRef(d, "@active", now); err == nil {
+		t.Error("expected error for multiple active entries")
+	}
+}
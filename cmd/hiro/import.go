@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/hiroapp/cli/db"
+)
+
+// ImportFormat returns the import format of the file at the given path
+// according to its extension, defaulting to FormatJSON. For csv files, which
+// may come from different time trackers, FormatCSV is returned.
+func ImportFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	case ".ics", ".ical", ".ifb", ".icalendar":
+		return FormatICS
+	case ".csv":
+		return FormatCSV
+	}
+	return FormatJSON
+}
+
+// importNamespace is the namespace of the entry ids derived by importID.
+var importNamespace = uuid.Parse("9c1e1b1e-6d0b-4f4e-8b8a-2f7a6f0e5b3d")
+
+// importID returns the id of the entry imported from the object with the
+// given key, e.g. the UID of a calendar event, so importing the object again
+// finds the existing entry.
+func importID(key string) string {
+	return uuid.NewSHA1(importNamespace, []byte(key)).String()
+}
+
+// ImportEntry is an entry read from a file of another application, see
+// ImportEntries.
+type ImportEntry struct {
+	// Source identifies the origin of the entry in the file, e.g. "row 3".
+	Source string
+	// Entry is the entry to import. Its id is derived from the imported
+	// object by importID, its category is set by ImportEntries.
+	Entry *db.Entry
+	// Category is the category path of Entry, which is created if needed.
+	Category []string
+	// Path is the category path of the imported entry.
+	Path db.CategoryPath
+	// Skipped holds the reason the entry was not imported, if it wasn't.
+	Skipped string
+}
+
+// errDryRun rolls back the transaction of a dry run.
+var errDryRun = errors.New("dry run")
+
+// ImportEntries saves the given entries in d within a transaction, except for
+// the ones that are already skipped. Entries whose id exists in d, including
+// the trash, or that occur twice are skipped, as are entries that can't be
+// saved, e.g. because of overlaps, with the error as the reason. Categories
+// created for skipped entries are removed again. If dryRun is true, the
+// transaction is rolled back, so d is not changed.
+func ImportEntries(d db.DB, entries []*ImportEntry, dryRun bool) error {
+	skipped := make([]string, len(entries))
+	for i, ie := range entries {
+		skipped[i] = ie.Skipped
+	}
+	err := d.Transaction(func(tx db.DB) error {
+		trash, err := tx.Trash()
+		if err != nil {
+			return err
+		}
+		trashed := make(map[string]bool, len(trash))
+		for _, e := range trash {
+			trashed[e.ID] = true
+		}
+		seen := make(map[string]bool)
+		for i, ie := range entries {
+			// the transaction may be retried
+			ie.Skipped, ie.Path = skipped[i], nil
+			if ie.Skipped != "" {
+				continue
+			} else if seen[ie.Entry.ID] {
+				ie.Skipped = "duplicate"
+				continue
+			}
+			seen[ie.Entry.ID] = true
+			if imported, err := isImported(tx, ie.Entry.ID, trashed); err != nil {
+				return err
+			} else if imported {
+				ie.Skipped = "already imported"
+				continue
+			}
+			existing, err := tx.Categories()
+			if err != nil {
+				return err
+			}
+			path, err := tx.CategoryPath(ie.Category, true)
+			if err != nil {
+				ie.Skipped = fmt.Sprintf("%s: %s", joinCategory(ie.Category), err)
+				continue
+			}
+			ie.Entry.CategoryID = path.CategoryID()
+			err = tx.SaveEntry(ie.Entry)
+			if oerr, ok := err.(*db.OverlapError); ok && oerr.Saved {
+				err = nil
+			}
+			if err != nil {
+				ie.Skipped = err.Error()
+				if err := removeCreated(tx, path, existing); err != nil {
+					return err
+				}
+				continue
+			}
+			ie.Path = path
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err == errDryRun {
+		return nil
+	}
+	return err
+}
+
+// removeCreated removes the categories of path that are not in existing,
+// children before their parents.
+func removeCreated(d db.DB, path db.CategoryPath, existing db.CategoryMap) error {
+	for i := len(path) - 1; i >= 0 && existing[path[i].ID] == nil; i-- {
+		if err := d.RemoveCategory(path[i].ID, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isImported returns true if the entry with the given id exists in d or is
+// one of the trashed ids.
+func isImported(d db.DB, id string, trashed map[string]bool) (bool, error) {
+	if trashed[id] {
+		return true, nil
+	}
+	itr, err := d.Query(db.Query{IDs: []string{id}})
+	if err != nil {
+		return false, err
+	}
+	entries, err := db.IteratorEntries(itr)
+	return len(entries) > 0, err
+}
+
+// FprintImport prints the entries passed to ImportEntries, one line per
+// entry, and how many of them were imported.
+func FprintImport(w io.Writer, entries []*ImportEntry, dryRun bool) error {
+	var (
+		buf      bytes.Buffer
+		imported int
+	)
+	for _, ie := range entries {
+		var start string
+		if !ie.Entry.Start.IsZero() {
+			start = ie.Entry.Start.Format(config.TimeFormat) + "  "
+		}
+		note := strings.SplitN(ie.Entry.Note, "\n", 2)[0]
+		if ie.Skipped != "" {
+			fmt.Fprintf(&buf, "skip    %s: %s%s: %s\n", ie.Source, start, note, ie.Skipped)
+			continue
+		}
+		imported++
+		fmt.Fprintf(&buf, "import  %s%s  %s  %s\n", start, formatDuration(ie.Entry.Duration(time.Now())), FormatCategory(ie.Path), note)
+	}
+	if dryRun {
+		fmt.Fprintf(&buf, "dry run, would import %d of %d entries\n", imported, len(entries))
+	} else {
+		fmt.Fprintf(&buf, "imported %d of %d entries\n", imported, len(entries))
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
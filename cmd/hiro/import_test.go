@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hiroapp/cli/db"
+)
+
+func TestImportEntries(t *testing.T) {
+	d, cleanup := tempDB(t)
+	defer cleanup()
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.UTC)
+	entries := []*ImportEntry{
+		{Source: "row 2", Entry: &db.Entry{ID: importID("a"), Start: start, End: start.Add(time.Hour)}, Category: []string{"a"}},
+		{Source: "row 3", Entry: &db.Entry{ID: importID("b"), Start: start.Add(time.Hour), End: start.Add(2 * time.Hour), Tags: []string{"a b"}}, Category: []string{"a", "b"}},
+		{Source: "row 4", Entry: &db.Entry{ID: importID("c"), Start: start.Add(3 * time.Hour), End: start.Add(2 * time.Hour)}, Category: []string{"c"}},
+		{Source: "row 5", Entry: &db.Entry{ID: importID("d"), Start: start.Add(3 * time.Hour), End: start.Add(4 * time.Hour)}},
+	}
+	if err := ImportEntries(d, entries, false); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ie := range entries {
+		got = append(got, ie.Skipped)
+	}
+	want := []string{"", `bad tag: "a b"`, "end must be after start", ""}
+	if diff := diffConfig.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	itr, err := d.Query(db.Query{})
+	if err != nil {
+		t.Fatal(err)
+	} else if saved, err := db.IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else if len(saved) != 2 {
+		t.Fatalf("got=%d entries want=2", len(saved))
+	}
+	// the categories of the skipped entries are removed again
+	if categories, err := d.Categories(); err != nil {
+		t.Fatal(err)
+	} else if len(categories) != 1 {
+		t.Fatalf("got=%d categories want=1", len(categories))
+	}
+	// entries in the trash count as imported
+	if err := d.Remove(entries[0].Entry.ID); err != nil {
+		t.Fatal(err)
+	}
+	entries = entries[:1]
+	if err := ImportEntries(d, entries, false); err != nil {
+		t.Fatal(err)
+	} else if got := entries[0].Skipped; got != "already imported" {
+		t.Errorf("got=%q want=already imported", got)
+	}
+}
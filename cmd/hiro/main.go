@@ -1,9 +1,9 @@
 package main
 
 import (
-	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/hiroapp/cli/db"
 	"github.com/jawher/mow.cli"
@@ -13,41 +13,155 @@ import (
 var version string = "?"
 
 func main() {
+	if c, err := LoadConfig(configPath()); err != nil {
+		fatal(fmt.Errorf("could not load config: %s", err))
+	} else {
+		config = c
+	}
 	app := cli.App("hiro", "Command line time tracking.")
+	profile := app.StringOpt("profile", "", "The profile to use instead of the active one, see profile list")
+	app.Before = func() { useProfile(*profile) }
 	app.Command("start", "Start a new time entry, ending the currently active one", func(cmd *cli.Cmd) {
 		resume := cmd.BoolOpt("resume", false, "Default end time and category of previous entry")
 		category := cmd.StringArg("CATEGORY", "", "The category to assign to the new entry")
-		cmd.Spec = "CATEGORY | --resume [CATEGORY]"
-		cmd.Action = func() { cmdStart(mustDB(), *resume, *category) }
+		tags := cmd.StringsArg("TAGS", nil, "The tags to assign to the new entry, e.g. +meeting")
+		cmd.Spec = "[--resume] [CATEGORY [TAGS...]]"
+		cmd.Action = func() { cmdStart(mustDB(), *resume, *category, *tags) }
 	})
 	app.Command("end", "End the currently active entry", func(cmd *cli.Cmd) {
 		cmd.Action = func() { cmdEnd(mustDB()) }
 	})
 	app.Command("ls", "Lists time entries.", func(cmd *cli.Cmd) {
 		asc := cmd.BoolOpt("asc", false, "Order for listing entries")
+		from := cmd.StringOpt("from", "", "Only return entries running at or after this time")
+		to := cmd.StringOpt("to", "", "Only return entries starting before this time, dates are inclusive")
+		limit := cmd.IntOpt("limit", 0, "Return at most this many entries")
+		exact := cmd.BoolOpt("exact", false, "Exclude entries of sub categories")
+		tags := cmd.StringsOpt("tag", nil, "Only return entries with this tag, may be repeated")
 		category := cmd.StringArg("CATEGORY", "", "Only return entries matching this category")
-		cmd.Spec = "[CATEGORY]"
-		cmd.Action = func() { cmdLs(mustDB(), *category, *asc) }
+		cmd.Spec = "[OPTIONS] [CATEGORY]"
+		cmd.Action = func() { cmdLs(mustDB(), *category, *exact, *tags, *asc, *from, *to, *limit) }
+	})
+	app.Command("search", "Search time entries by note", func(cmd *cli.Cmd) {
+		text := cmd.StringsArg("TEXT", nil, "The words to search for, a trailing * matches word prefixes")
+		cmd.Spec = "TEXT..."
+		cmd.Action = func() { cmdSearch(mustDB(), strings.Join(*text, " ")) }
 	})
 	app.Command("edit", "Edit time entry", func(cmd *cli.Cmd) {
-		id := cmd.StringArg("ID", "", "The id of the entry to edit, defaults to last entry")
+		id := cmd.StringArg("ID", "", "The id, a unique id prefix or a reference like @last of the entry to edit, defaults to @last")
 		cmd.Spec = "[ID]"
 		cmd.Action = func() { cmdEdit(mustDB(), *id) }
 	})
-	app.Command("rm", "Remove time entry", func(cmd *cli.Cmd) {
-		id := cmd.StringArg("ID", "", "The id of the entry to remove")
+	app.Command("rm", "Move time entry to the trash", func(cmd *cli.Cmd) {
+		id := cmd.StringArg("ID", "", "The id, a unique id prefix or a reference like @last of the entry to remove")
 		cmd.Action = func() { cmdRm(mustDB(), *id) }
 	})
+	app.Command("trash", "List removed time entries", func(cmd *cli.Cmd) {
+		purge := cmd.BoolOpt("purge", false, "Permanently delete the entries in the trash")
+		olderThan := cmd.StringOpt("older-than", "", "Only purge entries removed longer ago than this, e.g. 30d")
+		cmd.Spec = "[--purge [--older-than]]"
+		cmd.Action = func() { cmdTrash(mustDB(), *purge, *olderThan) }
+	})
+	app.Command("restore", "Restore a removed time entry", func(cmd *cli.Cmd) {
+		id := cmd.StringArg("ID", "", "The id or a unique id prefix of the entry in the trash")
+		cmd.Action = func() { cmdRestore(mustDB(), *id) }
+	})
+	app.Command("log", "Show the revision history of an entry or category", func(cmd *cli.Cmd) {
+		id := cmd.StringArg("ID", "", "The id of the entry or category, or a reference like @last, defaults to the whole database")
+		cmd.Spec = "[ID]"
+		cmd.Action = func() { cmdLog(mustDB(), *id) }
+	})
+	app.Command("category", "Manage categories", func(cmd *cli.Cmd) {
+		cmd.Command("rename", "Rename a category", func(cmd *cli.Cmd) {
+			src := cmd.StringArg("SRC", "", "The category to rename, e.g. Work:Clinet")
+			dst := cmd.StringArg("DST", "", "The new category, e.g. Work:Client")
+			cmd.Action = func() { cmdCategoryRename(mustDB(), *src, *dst) }
+		})
+		cmd.Command("mv", "Move a category and its sub categories", func(cmd *cli.Cmd) {
+			src := cmd.StringArg("SRC", "", "The category to move, e.g. Work:Old")
+			dst := cmd.StringArg("DST", "", "The new category, e.g. Archive:Old")
+			cmd.Action = func() { cmdCategoryMv(mustDB(), *src, *dst) }
+		})
+		cmd.Command("merge", "Merge a category into another one", func(cmd *cli.Cmd) {
+			src := cmd.StringArg("SRC", "", "The category to merge, or a duplicated category to merge its duplicates")
+			dst := cmd.StringArg("DST", "", "The category to merge into, or SRC again to merge its duplicates")
+			cmd.Action = func() { cmdCategoryMerge(mustDB(), *src, *dst) }
+		})
+		cmd.Command("rm", "Remove a category", func(cmd *cli.Cmd) {
+			reassign := cmd.StringOpt("reassign", "", "The category to move the entries of the removed category to")
+			category := cmd.StringArg("CATEGORY", "", "The category to remove")
+			cmd.Spec = "[--reassign] CATEGORY"
+			cmd.Action = func() { cmdCategoryRm(mustDB(), *category, *reassign) }
+		})
+	})
 	app.Command("summary", "Summarize time entries", func(cmd *cli.Cmd) {
-		period := cmd.StringOpt("period", "day", "Summary period: day|week|month|year")
-		firstDay := cmd.StringOpt("firstDay", "Monday", "First day of the week")
-		cmd.Action = func() { cmdSummary(mustDB(), *period, *firstDay) }
+		period := cmd.StringOpt("period", config.SummaryPeriod, "Summary period: day|week|month|year")
+		firstDay := cmd.StringOpt("firstDay", config.FirstDay, "First day of the week")
+		exact := cmd.BoolOpt("exact", false, "Exclude entries of sub categories")
+		tags := cmd.StringsOpt("tag", nil, "Only summarize entries with this tag, may be repeated")
+		by := cmd.StringOpt("by", "category", "Group durations by: category|tag")
+		category := cmd.StringArg("CATEGORY", "", "Only summarize entries matching this category")
+		cmd.Spec = "[OPTIONS] [CATEGORY]"
+		cmd.Action = func() { cmdSummary(mustDB(), *category, *exact, *tags, *by, *period, *firstDay) }
 	})
 	app.Command("report", "Report on a single category", func(cmd *cli.Cmd) {
-		period := cmd.StringOpt("period", "week", "Summary period: week|month|year")
-		firstDay := cmd.StringOpt("firstDay", "Monday", "First day of the week")
-		category := cmd.StringArg("CATEGORY", "", "The category to assign to the new entry")
-		cmd.Action = func() { cmdReport(mustDB(), *category, *period, *firstDay) }
+		period := cmd.StringOpt("period", config.ReportPeriod, "Summary period: week|month|year")
+		firstDay := cmd.StringOpt("firstDay", config.FirstDay, "First day of the week")
+		exact := cmd.BoolOpt("exact", false, "Exclude entries of sub categories")
+		category := cmd.StringArg("CATEGORY", "", "The category to report on")
+		cmd.Spec = "[OPTIONS] CATEGORY"
+		cmd.Action = func() { cmdReport(mustDB(), *category, *exact, *period, *firstDay) }
+	})
+	app.Command("export", "Export time entries", func(cmd *cli.Cmd) {
+		format := cmd.StringOpt("format", FormatCSV, "The export format: csv|ics|json|ndjson, json and ndjson export all categories and entries, including the trash")
+		from := cmd.StringOpt("from", "", "Only export entries running at or after this time")
+		to := cmd.StringOpt("to", "", "Only export entries starting before this time, dates are inclusive")
+		activeOnly := cmd.BoolOpt("active", false, "Only export entries that are still running")
+		exact := cmd.BoolOpt("exact", false, "Exclude entries of sub categories")
+		delimiter := cmd.StringOpt("delimiter", ",", "The field delimiter of csv, e.g. ; or \\t for tabs")
+		timeFormat := cmd.StringOpt("time-format", config.TimeFormat, "The Go time layout of start and end")
+		category := cmd.StringArg("CATEGORY", "", "Only export entries matching this category")
+		cmd.Spec = "[OPTIONS] [CATEGORY]"
+		cmd.Action = func() {
+			cmdExport(mustDB(), *format, *category, *exact, *activeOnly, *from, *to, *delimiter, *timeFormat)
+		}
+	})
+	app.Command("import", "Import a dump, updating the entries and categories with the same id, calendar events or reports of other time trackers", func(cmd *cli.Cmd) {
+		format := cmd.StringOpt("format", "", "The import format: json|ndjson|ics|toggl|clockify, defaults to the one of the file extension")
+		rules := cmd.StringsOpt("rule", nil, "Map ics events to a category: [organizer:]REGEXP=CATEGORY, may be repeated, the first match wins")
+		category := cmd.StringOpt("category", "", "The category of ics events not matched by a rule, or of report rows without client, project and task")
+		tz := cmd.StringOpt("tz", "", "The time zone of times without offset, e.g. Europe/Berlin, defaults to the local one")
+		dateFormat := cmd.StringOpt("date-format", "", "The Go layout of the dates in reports, e.g. 02/01/2006, defaults to detecting common ones")
+		dryRun := cmd.BoolOpt("dry-run", false, "Show the entries that would be imported without saving them")
+		path := cmd.StringArg("FILE", "", "The file to import, or - for stdin")
+		cmd.Spec = "[OPTIONS] FILE"
+		cmd.Action = func() {
+			cmdImport(mustDB(), *format, *path, *rules, *category, *tz, *dateFormat, *dryRun)
+		}
+	})
+	app.Command("fsck", "Check the database for integrity problems", func(cmd *cli.Cmd) {
+		fix := cmd.BoolOpt("fix", false, "Repair the problems that were found")
+		cmd.Action = func() { cmdFsck(mustDB(), *fix) }
+	})
+	app.Command("convert", "Copy all data into the storage of another backend", func(cmd *cli.Cmd) {
+		backend := cmd.StringArg("BACKEND", "", "The backend to copy the data to: sqlite|journal")
+		cmd.Action = func() { cmdConvert(mustDB(), *backend) }
+	})
+	app.Command("profile", "Manage profiles, each with its own database", func(cmd *cli.Cmd) {
+		cmd.Command("list", "List the profiles, the one in use is marked with *", func(cmd *cli.Cmd) {
+			cmd.Action = cmdProfileList
+		})
+		cmd.Command("add", "Add a profile", func(cmd *cli.Cmd) {
+			dir := cmd.StringOpt("dir", "", "The data directory of the profile, defaults to profiles/NAME in the default data directory")
+			backend := cmd.StringOpt("backend", "", "The backend of the profile: sqlite|journal, defaults to the configured backend")
+			name := cmd.StringArg("NAME", "", "The name of the profile, e.g. consulting")
+			cmd.Spec = "[OPTIONS] NAME"
+			cmd.Action = func() { cmdProfileAdd(*name, *dir, *backend) }
+		})
+		cmd.Command("use", "Make a profile the active one", func(cmd *cli.Cmd) {
+			name := cmd.StringArg("NAME", "", "The name of the profile, or default")
+			cmd.Action = func() { cmdProfileUse(*name) }
+		})
 	})
 	app.Command("version", "Prints the version", func(cmd *cli.Cmd) {
 		cmd.Action = cmdVersion
@@ -55,16 +169,50 @@ func main() {
 	app.Run(os.Args)
 }
 
+// useProfile applies the profile with the given name to config. Without a
+// name, the profile set by the HIRO_PROFILE env variable or the active one
+// is used.
+func useProfile(name string) {
+	profiles, err := LoadProfiles(profilesPath())
+	if err != nil {
+		fatal(fmt.Errorf("could not load profiles: %s", err))
+	}
+	if name == "" {
+		name = os.Getenv("HIRO_PROFILE")
+	}
+	if name == "" {
+		name = profiles.Active
+	}
+	profile, err := profiles.Get(name, config)
+	if err != nil {
+		fatal(err)
+	}
+	config.UseProfile(profile)
+	if err := config.Valid(); err != nil {
+		fatal(fmt.Errorf("bad profile %s: %s", profile.Name, err))
+	}
+}
+
+// mustDB opens the database configured by config. The name of the profile is
+// printed to stderr, unless it's the default one.
 func mustDB() db.DB {
-	dir := os.Getenv("HIRO_DIR")
-	if dir == "" {
-		fatal(errors.New("HIRO_DIR env variable must be set"))
-	} else if d, err := db.New(dir); err != nil {
+	if config.Profile != defaultProfile {
+		fmt.Fprintf(os.Stderr, "profile: %s\n", config.Profile)
+	}
+	overlap, err := db.ParseOverlapPolicy(config.Overlap)
+	if err != nil {
+		fatal(err)
+	}
+	d, err := db.Open(config.Backend, config.Dir, db.Options{Command: command(), Overlap: overlap})
+	if err != nil {
 		fatal(fmt.Errorf("could not open db: %s", err))
-	} else {
-		return d
 	}
-	panic("unreachable")
+	return d
+}
+
+// command returns the command line of the current process.
+func command() string {
+	return strings.Join(append([]string{"hiro"}, os.Args[1:]...), " ")
 }
 
 func fatal(err error) {
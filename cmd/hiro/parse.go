@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"fmt"
 	"io"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -91,6 +93,8 @@ func ParseEntryDocument(r io.Reader) (*EntryDocument, error) {
 				entry.ID = val
 			case "Category":
 				entry.Category = ParseCategory(val)
+			case "Tags":
+				entry.Tags = ParseTags(strings.Fields(val))
 			}
 		}
 	}
@@ -101,7 +105,73 @@ func ParseEntryDocument(r io.Reader) (*EntryDocument, error) {
 type EntryDocument struct {
 	ID       string
 	Category []string
+	Tags     []string
 	Start    time.Time
 	End      time.Time
 	Note     string
 }
+
+// ParseTags returns the given tags without their optional "+" prefix.
+func ParseTags(tags []string) []string {
+	var parsed []string
+	for _, tag := range tags {
+		parsed = append(parsed, strings.TrimPrefix(tag, "+"))
+	}
+	return parsed
+}
+
+// timeLayouts holds the layouts accepted by ParseTime, ordered from most to
+// least precise.
+var timeLayouts = []string{
+	timeLayout,
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	dateLayout,
+}
+
+// ParseTime parses s using the first matching layout of timeLayouts or returns
+// an error. Values without an offset are interpreted in the local time zone.
+// If end is true, date only values refer to the end of the day, i.e. the start
+// of the next day, which allows to use them as exclusive upper bounds.
+func ParseTime(s string, end bool) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		t, err := time.ParseInLocation(layout, s, time.Local)
+		if err != nil {
+			continue
+		}
+		if end && layout == dateLayout {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("bad time: %s", s)
+}
+
+var durationDays = regexp.MustCompile("^(?:(\\d+)w)?(?:(\\d+)d)?(.*)$")
+
+// ParseDuration parses s like time.ParseDuration, but additionally accepts
+// leading weeks and days using the units "w" and "d", e.g. "30d" or "1w2d3h".
+func ParseDuration(s string) (time.Duration, error) {
+	m := durationDays.FindStringSubmatch(s)
+	if s == "" || m == nil {
+		return 0, fmt.Errorf("bad duration: %s", s)
+	}
+	var d time.Duration
+	for i, unit := range []time.Duration{7 * 24 * time.Hour, 24 * time.Hour} {
+		if m[i+1] == "" {
+			continue
+		} else if n, err := strconv.Atoi(m[i+1]); err != nil {
+			return 0, fmt.Errorf("bad duration: %s", s)
+		} else {
+			d += time.Duration(n) * unit
+		}
+	}
+	if m[3] != "" {
+		rest, err := time.ParseDuration(m[3])
+		if err != nil {
+			return 0, fmt.Errorf("bad duration: %s", s)
+		}
+		d += rest
+	}
+	return d, nil
+}
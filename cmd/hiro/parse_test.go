@@ -107,6 +107,19 @@ The cake is a lie!`),
 				Note:     "The cake is a lie!",
 			},
 		},
+		{
+			Name: "tags",
+			R: strings.NewReader(`Id: 1
+Category: Work:Hiro
+Tags: meeting +review
+Start: 2015-10-04 12:59:17 +0200`),
+			Entry: &EntryDocument{
+				ID:       "1",
+				Category: []string{"Work", "Hiro"},
+				Tags:     []string{"meeting", "review"},
+				Start:    time.Date(2015, 10, 04, 12, 59, 17, 0, time.FixedZone("", 2*60*60)),
+			},
+		},
 		{
 			Name: "empty end",
 			R: strings.NewReader(`Id: 1
@@ -132,3 +145,79 @@ The cake is a lie!`),
 		}
 	}
 }
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		S    string
+		End  bool
+		Want time.Time
+		Err  string
+	}{
+		{
+			S:    "2015-10-04 12:59:17 +0200",
+			Want: time.Date(2015, 10, 04, 12, 59, 17, 0, time.FixedZone("", 2*60*60)),
+		},
+		{
+			S:    "2015-10-04 12:59:17",
+			Want: time.Date(2015, 10, 04, 12, 59, 17, 0, time.Local),
+		},
+		{
+			S:    "2015-10-04 12:59",
+			End:  true,
+			Want: time.Date(2015, 10, 04, 12, 59, 0, 0, time.Local),
+		},
+		{
+			S:    "2015-10-04",
+			Want: time.Date(2015, 10, 04, 0, 0, 0, 0, time.Local),
+		},
+		{
+			S:    "2015-10-04",
+			End:  true,
+			Want: time.Date(2015, 10, 05, 0, 0, 0, 0, time.Local),
+		},
+		{
+			S:   "yesterday",
+			Err: "bad time: yesterday",
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseTime(test.S, test.End)
+		var gotErr string
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != test.Err {
+			t.Errorf("test %q: got=%q want=%q", test.S, gotErr, test.Err)
+		} else if !got.Equal(test.Want) {
+			t.Errorf("test %q: got=%s want=%s", test.S, got, test.Want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		S    string
+		Want time.Duration
+		Err  string
+	}{
+		{S: "30d", Want: 30 * 24 * time.Hour},
+		{S: "2w", Want: 14 * 24 * time.Hour},
+		{S: "1w2d3h", Want: 9*24*time.Hour + 3*time.Hour},
+		{S: "90m", Want: 90 * time.Minute},
+		{S: "", Err: "bad duration: "},
+		{S: "3x", Err: "bad duration: 3x"},
+		{S: "d", Err: "bad duration: d"},
+	}
+	for _, test := range tests {
+		got, err := ParseDuration(test.S)
+		var gotErr string
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != test.Err {
+			t.Errorf("test %q: got=%q want=%q", test.S, gotErr, test.Err)
+		} else if got != test.Want {
+			t.Errorf("test %q: got=%s want=%s", test.S, got, test.Want)
+		}
+	}
+}
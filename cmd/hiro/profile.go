@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bradfitz/slice"
+	"github.com/hiroapp/cli/db"
+)
+
+// defaultProfile is the name of the profile that uses the data directory and
+// backend of the config file.
+const defaultProfile = "default"
+
+// Profile is a named database with its own data directory and backend.
+type Profile struct {
+	Name string
+	// Dir is the data directory of the profile.
+	Dir string
+	// Backend is the storage backend of the profile, defaults to the backend
+	// of the config file if empty.
+	Backend string
+}
+
+// Profiles holds the profiles managed by the profile command. They are stored
+// in the profiles file next to the config file, see profilesPath, using the
+// same format:
+//
+//	active = "consulting"
+//
+//	[consulting]
+//	dir = "/home/me/consulting"
+//	backend = "journal"
+type Profiles struct {
+	// Active is the name of the profile used by default, or empty for the
+	// default profile.
+	Active string
+	// Profiles holds the profiles indexed by name, except for the default
+	// profile.
+	Profiles map[string]*Profile
+}
+
+// profileName matches the valid names of profiles.
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// profilesPath returns the path of the profiles file, which is stored in the
+// directory of the config file.
+func profilesPath() string {
+	return filepath.Join(filepath.Dir(configPath()), "profiles.toml")
+}
+
+// LoadProfiles reads the profiles file at the given path. If the file doesn't
+// exist, no profiles are returned.
+func LoadProfiles(path string) (*Profiles, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return &Profiles{Profiles: make(map[string]*Profile)}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	p, err := ParseProfiles(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s:%s", path, err)
+	}
+	return p, nil
+}
+
+// ParseProfiles parses a profiles file from r. Errors are prefixed with the
+// number of the line they occurred at.
+func ParseProfiles(r io.Reader) (*Profiles, error) {
+	p := &Profiles{Profiles: make(map[string]*Profile)}
+	err := parseTOML(r, func(key, val string) error {
+		if key == "active" {
+			p.Active = val
+			return nil
+		}
+		parts := strings.SplitN(key, ".", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("unknown key: %s", key)
+		} else if parts[0] == defaultProfile {
+			return fmt.Errorf("profile name is reserved: %s", parts[0])
+		}
+		profile := p.Profiles[parts[0]]
+		if profile == nil {
+			profile = &Profile{Name: parts[0]}
+			p.Profiles[parts[0]] = profile
+		}
+		switch parts[1] {
+		case "dir":
+			profile.Dir = val
+		case "backend":
+			profile.Backend = val
+		default:
+			return fmt.Errorf("unknown key: %s", key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for name, profile := range p.Profiles {
+		if profile.Dir == "" {
+			return nil, fmt.Errorf("profile has no dir: %s", name)
+		}
+	}
+	if p.Active != "" && p.Active != defaultProfile && p.Profiles[p.Active] == nil {
+		return nil, fmt.Errorf("active profile does not exist: %s", p.Active)
+	}
+	return p, nil
+}
+
+// Get returns the profile with the given name, or an error if it doesn't
+// exist. The default profile is built from the given config.
+func (p *Profiles) Get(name string, c *Config) (*Profile, error) {
+	if name == "" || name == defaultProfile {
+		return &Profile{Name: defaultProfile, Dir: c.Dir, Backend: c.Backend}, nil
+	} else if profile := p.Profiles[name]; profile != nil {
+		return profile, nil
+	}
+	return nil, fmt.Errorf("profile does not exist: %s", name)
+}
+
+// Add adds a new profile, or returns an error if the name is invalid or
+// already taken.
+func (p *Profiles) Add(profile *Profile) error {
+	if !profileName.MatchString(profile.Name) {
+		return fmt.Errorf("bad profile name: %q", profile.Name)
+	} else if profile.Name == defaultProfile || p.Profiles[profile.Name] != nil {
+		return fmt.Errorf("profile already exists: %s", profile.Name)
+	} else if profile.Dir == "" {
+		return errors.New("profile dir must be set")
+	} else if profile.Backend != "" && profile.Backend != db.BackendSQLite && profile.Backend != db.BackendJournal {
+		return fmt.Errorf("unknown backend: %s", profile.Backend)
+	}
+	p.Profiles[profile.Name] = profile
+	return nil
+}
+
+// Sorted returns the profiles ordered by name.
+func (p *Profiles) Sorted() []*Profile {
+	var profiles []*Profile
+	for _, profile := range p.Profiles {
+		profiles = append(profiles, profile)
+	}
+	slice.Sort(profiles, func(i, j int) bool { return profiles[i].Name < profiles[j].Name })
+	return profiles
+}
+
+// String returns p in the format of the profiles file.
+func (p *Profiles) String() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# profiles of hiro, see hiro profile --help\n")
+	if p.Active != "" {
+		fmt.Fprintf(&buf, "active = %s\n", strconv.Quote(p.Active))
+	}
+	for _, profile := range p.Sorted() {
+		fmt.Fprintf(&buf, "\n[%s]\ndir = %s\n", profile.Name, strconv.Quote(profile.Dir))
+		if profile.Backend != "" {
+			fmt.Fprintf(&buf, "backend = %s\n", strconv.Quote(profile.Backend))
+		}
+	}
+	return buf.String()
+}
+
+// Save writes p to the profiles file at the given path, creating its
+// directory if needed.
+func (p *Profiles) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(p.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// UseProfile makes c use the data directory and backend of the given
+// profile. A profile takes precedence over the HIRO_DIR and HIRO_BACKEND env
+// variables, which only apply to the default profile, as it's built from c.
+func (c *Config) UseProfile(profile *Profile) {
+	c.Profile = profile.Name
+	c.Dir = expandHome(profile.Dir)
+	if profile.Backend != "" {
+		c.Backend = profile.Backend
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProfiles(t *testing.T) {
+	p, err := ParseProfiles(strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range []*Profile{
+		{Name: "side-project", Dir: "/data/side \"project\""},
+		{Name: "consulting", Dir: "/data/consulting", Backend: "journal"},
+	} {
+		if err := p.Add(profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, profile := range []*Profile{
+		{Name: "consulting", Dir: "/data/other"},
+		{Name: "default", Dir: "/data/other"},
+		{Name: "bad name", Dir: "/data/other"},
+		{Name: "nodir"},
+		{Name: "badbackend", Dir: "/data/other", Backend: "csv"},
+	} {
+		if err := p.Add(profile); err == nil {
+			t.Errorf("expected error when adding %#v", profile)
+		}
+	}
+	p.Active = "consulting"
+	want := `# profiles of hiro, see hiro profile --help
+active = "consulting"
+
+[consulting]
+dir = "/data/consulting"
+backend = "journal"
+
+[side-project]
+dir = "/data/side \"project\""
+`
+	if got := p.String(); got != want {
+		t.Fatalf("got=%s want=%s", got, want)
+	}
+	parsed, err := ParseProfiles(strings.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	} else if diff := diffConfig.Compare(parsed, p); diff != "" {
+		t.Fatal(diff)
+	}
+	c := &Config{Dir: "/data/hiro", Backend: "sqlite"}
+	if profile, err := p.Get("default", c); err != nil {
+		t.Fatal(err)
+	} else if diff := diffConfig.Compare(profile, &Profile{Name: "default", Dir: "/data/hiro", Backend: "sqlite"}); diff != "" {
+		t.Fatal(diff)
+	} else if _, err := p.Get("missing", c); err == nil {
+		t.Fatal("expected error for missing profile")
+	}
+
+	for _, test := range []struct{ Profiles, Err string }{
+		{"active = \"missing\"", "active profile does not exist: missing"},
+		{"[a]\nbackend = \"sqlite\"", "profile has no dir: a"},
+		{"[a]\ncolor = \"red\"", "2: unknown key: a.color"},
+		{"[default]\ndir = \"/data\"", "2: profile name is reserved: default"},
+	} {
+		if _, err := ParseProfiles(strings.NewReader(test.Profiles)); err == nil || err.Error() != test.Err {
+			t.Errorf("got=%v want=%s", err, test.Err)
+		}
+	}
+}
+
+func TestUseProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profiles := "active = \"consulting\"\n\n[consulting]\ndir = \"/data/consulting\"\nbackend = \"journal\"\n\n[side-project]\ndir = \"/data/side-project\"\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "profiles.toml"), []byte(profiles), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer func(c *Config) { config = c }(config)
+	for _, env := range []string{"HIRO_CONFIG", "HIRO_DIR", "HIRO_BACKEND", "HIRO_PROFILE"} {
+		defer os.Setenv(env, os.Getenv(env))
+	}
+	os.Setenv("HIRO_CONFIG", filepath.Join(dir, "config.toml"))
+	os.Setenv("HIRO_DIR", "/data/env")
+	os.Setenv("HIRO_BACKEND", "sqlite")
+	os.Setenv("HIRO_PROFILE", "")
+	for _, test := range []struct{ Profile, Dir, Backend string }{
+		{"side-project", "/data/side-project", "sqlite"},
+		{"", "/data/consulting", "journal"},
+		{"default", "/data/env", "sqlite"},
+	} {
+		if config, err = LoadConfig(configPath()); err != nil {
+			t.Fatal(err)
+		}
+		useProfile(test.Profile)
+		if config.Dir != test.Dir || config.Backend != test.Backend {
+			t.Errorf("%q: got=%s %s want=%s %s", test.Profile, config.Dir, config.Backend, test.Dir, test.Backend)
+		}
+	}
+}
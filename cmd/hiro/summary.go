@@ -1,24 +1,54 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"strings"
 	"time"
 
 	"github.com/hiroapp/cli/datetime"
 	"github.com/hiroapp/cli/db"
 )
 
-// NewSummaryIterator returns a new summary iterator producing summaries for
-// the given period and firstDay of the week. If the period is datetime.Day,
-// it is is ignored. Callers are required to call Close once they are done
-// with the iterator.
-func NewSummaryIterator(d db.DB, period datetime.Period, firstDay time.Weekday, now time.Time) (*SummaryIterator, error) {
-	entries, err := d.Query(db.Query{})
+// SummaryGroup defines how the durations of a summary are grouped.
+type SummaryGroup int
+
+const (
+	// ByCategory groups durations by category id.
+	ByCategory SummaryGroup = iota
+	// ByTag groups durations by tag. The durations of entries with multiple
+	// tags count towards each of them, and untagged entries are grouped under
+	// the empty string.
+	ByTag
+)
+
+// ParseSummaryGroup returns the SummaryGroup for s, or an error.
+func ParseSummaryGroup(s string) (SummaryGroup, error) {
+	switch strings.ToLower(s) {
+	case "category":
+		return ByCategory, nil
+	case "tag":
+		return ByTag, nil
+	default:
+		return 0, fmt.Errorf("bad summary group: %s", s)
+	}
+}
+
+// NewSummaryIterator returns a new summary iterator producing summaries of the
+// entries matched by q for the given period and firstDay of the week, grouped
+// by the given SummaryGroup. If the period is datetime.Day, it is is ignored.
+// The order of q is ignored. Callers are required to call Close once they are
+// done with the iterator.
+func NewSummaryIterator(d db.DB, q db.Query, by SummaryGroup, period datetime.Period, firstDay time.Weekday, now time.Time) (*SummaryIterator, error) {
+	q.Asc = false
+	entries, err := d.Query(q)
 	if err != nil {
 		return nil, err
 	}
 	return &SummaryIterator{
 		now:      now,
 		entries:  entries,
+		by:       by,
 		period:   period,
 		firstDay: firstDay,
 	}, nil
@@ -29,9 +59,11 @@ type SummaryIterator struct {
 	now      time.Time
 	entries  db.Iterator
 	entry    *db.Entry
+	by       SummaryGroup
 	periods  *datetime.Iterator
 	period   datetime.Period
 	firstDay time.Weekday
+	done     bool
 }
 
 // Next returns the next summary or an error. When there are no more summaries,
@@ -41,39 +73,59 @@ func (s *SummaryIterator) Next() (*Summary, error) {
 	// Doing it here rather than in the constructor to avoid callers having to
 	// implement additional logic when the db is empty.
 	var err error
-	if s.entry == nil {
+	if s.done {
+		return nil, io.EOF
+	} else if s.entry == nil {
 		if s.entry, err = s.entries.Next(); err != nil {
 			return nil, err
 		}
 		s.periods = datetime.NewIterator(s.entry.Start, s.period, false, s.firstDay)
 	}
 
-	summary := &Summary{Categories: make(map[string]time.Duration)}
+	summary := &Summary{Durations: make(map[string]time.Duration)}
 	summary.From, summary.To = s.periods.Next()
 	for {
 		duration := s.entry.PartialDuration(s.now, summary.From, summary.To)
 		if duration > 0 {
-			summary.Categories[s.entry.CategoryID] += duration
+			for _, key := range s.keys(s.entry) {
+				summary.Durations[key] += duration
+			}
 		}
 		if s.entry.Start.Before(summary.From) {
 			break
 		}
-		if s.entry, err = s.entries.Next(); err != nil {
+		if s.entry, err = s.entries.Next(); err == io.EOF {
+			// The last summary is complete once all entries have been consumed.
+			s.done = true
+			break
+		} else if err != nil {
 			return nil, err
 		}
 	}
 	return summary, nil
 }
 
+// keys returns the keys the duration of the given entry is counted towards.
+func (s *SummaryIterator) keys(entry *db.Entry) []string {
+	if s.by == ByTag && len(entry.Tags) > 0 {
+		return entry.Tags
+	} else if s.by == ByTag {
+		return []string{""}
+	}
+	return []string{entry.CategoryID}
+}
+
 // Close closes the iterator.
 func (s *SummaryIterator) Close() error {
 	return s.entries.Close()
 }
 
-// Summary stores how much time was spend in which category for a given time
-// range.
+// Summary stores how much time was spend in which category or with which tag
+// for a given time range.
 type Summary struct {
-	From       time.Time
-	To         time.Time
-	Categories map[string]time.Duration
+	From time.Time
+	To   time.Time
+	// Durations holds the durations indexed by category id or tag, depending
+	// on the SummaryGroup.
+	Durations map[string]time.Duration
 }
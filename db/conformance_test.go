@@ -0,0 +1,817 @@
+package db
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+
+	"code.google.com/p/go-uuid/uuid"
+)
+
+// newDBFunc returns a new, empty DB with the given options.
+type newDBFunc func(*testing.T, Options) DB
+
+// conformanceTests must pass for every DB implementation, see
+// testConformance.
+var conformanceTests = []struct {
+	Name string
+	Test func(*testing.T, newDBFunc)
+}{
+	{Name: "SaveEntry", Test: testSaveEntry},
+	{Name: "SaveEntry_unknownID", Test: testSaveEntry_unknownID},
+	{Name: "SaveEntry_overlap", Test: testSaveEntry_overlap},
+	{Name: "Query", Test: testQuery},
+	{Name: "Query_noteIndex", Test: testQuery_noteIndex},
+	{Name: "Trash", Test: testTrash},
+	{Name: "Revisions", Test: testRevisions},
+	{Name: "Transaction", Test: testTransaction},
+	{Name: "GetOrCreateCategoryPath", Test: testGetOrCreateCategoryPath},
+	{Name: "Categories", Test: testCategories},
+	{Name: "MergeCategory", Test: testMergeCategory},
+	{Name: "RemoveCategory", Test: testRemoveCategory},
+}
+
+// testConformance runs the conformanceTests against the DBs returned by newDB.
+func testConformance(t *testing.T, newDB newDBFunc) {
+	for _, test := range conformanceTests {
+		t.Run(test.Name, func(t *testing.T) { test.Test(t, newDB) })
+	}
+}
+
+// - Start and End are truncated.
+// - Record is validates
+// - ID is assigned on insert, kept on update
+// - Category id is resolved or created (if set)
+// - uuid assignment
+
+// - update
+
+// testSaveEntry performs save operations and validates their results as well as the
+// resulting db state using Query.
+func testSaveEntry(t *testing.T, newDB newDBFunc) {
+	diffConfig := &pretty.Config{Diffable: true, PrintStringers: true}
+	zone := time.FixedZone("", 3600)
+	start := time.Date(2015, 9, 2, 15, 36, 13, 123, zone)
+	tests := []struct {
+		Name    string
+		Entry   *Entry
+		WantErr string
+		Update  bool
+	}{
+		{
+			Name:    "validation is performed",
+			Entry:   &Entry{},
+			WantErr: "start is required",
+		},
+		{
+			Name:  "minimal valid entry",
+			Entry: &Entry{Start: start},
+		},
+		{
+			Name:  "start and end",
+			Entry: &Entry{Start: start, End: start.Add(time.Second)},
+		},
+		{
+			Name:   "update",
+			Entry:  &Entry{Start: start, End: start.Add(time.Second)},
+			Update: true,
+		},
+		{
+			Name:  "tags are normalized",
+			Entry: &Entry{Start: start, Tags: []string{"b", "a", "b"}},
+		},
+		{
+			Name:   "update tags",
+			Entry:  &Entry{Start: start, Tags: []string{"c"}},
+			Update: true,
+		},
+		{
+			Name:    "tags are validated",
+			Entry:   &Entry{Start: start, Tags: []string{"a b"}},
+			WantErr: `bad tag: "a b"`,
+		},
+	}
+	for _, test := range tests {
+		var (
+			fixture = &Entry{Start: start.Add(-time.Second), End: start}
+			d       = newDB(t, Options{})
+		)
+		if err := d.SaveEntry(fixture); err != nil {
+			t.Errorf("test %s: %s", test.Name, err)
+			continue
+		}
+		if test.Update {
+			test.Entry.ID = fixture.ID
+		}
+		var (
+			err    = d.SaveEntry(test.Entry)
+			gotErr string
+		)
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != test.WantErr {
+			t.Errorf("test %q: got=%q want=%q", test.Name, gotErr, test.WantErr)
+		} else if test.WantErr != "" {
+			continue
+		}
+		if uuid.Parse(test.Entry.ID) == nil {
+			t.Errorf("test %q: got=%q want uuid", test.Name, test.Entry.ID)
+		}
+		if got, want := test.Entry.Start, test.Entry.Start.Truncate(time.Second); !got.Equal(want) {
+			t.Errorf("test %q: got=%q want=%q", test.Name, got, want)
+		}
+		if got, want := test.Entry.End, test.Entry.End.Truncate(time.Second); !got.Equal(want) {
+			t.Errorf("test %q: got=%q want=%q", test.Name, got, want)
+		}
+		wantEntries := []*Entry{test.Entry}
+		if !test.Update {
+			wantEntries = append(wantEntries, fixture)
+		}
+		if itr, err := d.Query(Query{}); err != nil {
+			t.Errorf("test %q: %s", test.Name, err)
+		} else if entries, err := IteratorEntries(itr); err != nil {
+			t.Errorf("test %q: %s", test.Name, err)
+		} else if diff := diffConfig.Compare(entries, wantEntries); diff != "" {
+			t.Errorf("test %q: %s", test.Name, diff)
+		}
+	}
+}
+
+// testSaveEntry_unknownID checks that entries and categories with ids that
+// don't exist yet are inserted, and that references to missing categories are
+// rejected.
+func testSaveEntry_unknownID(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{})
+	c := &Category{ID: "c", Name: "a"}
+	e := &Entry{ID: "e", Start: time.Date(2015, 9, 2, 15, 36, 13, 0, time.FixedZone("", 3600)), CategoryID: c.ID}
+	if err := d.SaveEntry(e); err == nil {
+		t.Fatal("expected error for missing category")
+	} else if err := d.SaveCategory(&Category{Name: "b", ParentID: "missing"}); err == nil {
+		t.Fatal("expected error for missing parent category")
+	} else if err := d.SaveCategory(c); err != nil {
+		t.Fatal(err)
+	} else if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	if categories, err := d.Categories(); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(categories, CategoryMap{c.ID: c}); diff != "" {
+		t.Fatal(diff)
+	} else if itr, err := d.Query(Query{}); err != nil {
+		t.Fatal(err)
+	} else if entries, err := IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(entries, []*Entry{e}); diff != "" {
+		t.Fatal(diff)
+	} else if revisions, err := d.Revisions(e.ID); err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 1 || revisions[0].Old != nil {
+		t.Fatalf("got=%#v want one create revision", revisions)
+	}
+}
+
+func testSaveEntry_overlap(t *testing.T, newDB newDBFunc) {
+	zone := time.FixedZone("", 3600)
+	at := func(hour, min int) time.Time { return time.Date(2015, 9, 2, hour, min, 0, 0, zone) }
+	tests := []struct {
+		Name     string
+		Policy   OverlapPolicy
+		Entry    *Entry
+		Update   bool
+		WantErr  string
+		WantSave bool
+		Want     []string
+	}{
+		{
+			Name:  "allow",
+			Entry: &Entry{Start: at(10, 30), End: at(11, 30)},
+			Want:  []string{"10:00-11:00", "10:30-11:30", "12:00-"},
+		},
+		{
+			Name:    "reject",
+			Policy:  OverlapReject,
+			Entry:   &Entry{Start: at(10, 30), End: at(11, 30)},
+			WantErr: "entry overlaps with another entry",
+			Want:    []string{"10:00-11:00", "12:00-"},
+		},
+		{
+			Name:   "reject adjacent",
+			Policy: OverlapReject,
+			Entry:  &Entry{Start: at(11, 0), End: at(12, 0)},
+			Want:   []string{"10:00-11:00", "11:00-12:00", "12:00-"},
+		},
+		{
+			Name:   "reject update without overlap",
+			Policy: OverlapReject,
+			Entry:  &Entry{Start: at(10, 0), End: at(11, 30)},
+			Update: true,
+			Want:   []string{"10:00-11:30", "12:00-"},
+		},
+		{
+			Name:    "reject running",
+			Policy:  OverlapReject,
+			Entry:   &Entry{Start: at(9, 0)},
+			WantErr: "entry overlaps with 2 other entries",
+			Want:    []string{"10:00-11:00", "12:00-"},
+		},
+		{
+			Name:     "warn",
+			Policy:   OverlapWarn,
+			Entry:    &Entry{Start: at(10, 30), End: at(11, 30)},
+			WantErr:  "entry overlaps with another entry",
+			WantSave: true,
+			Want:     []string{"10:00-11:00", "10:30-11:30", "12:00-"},
+		},
+		{
+			Name:   "trim",
+			Policy: OverlapTrim,
+			Entry:  &Entry{Start: at(10, 30), End: at(12, 30)},
+			Want:   []string{"10:00-10:30", "10:30-12:30", "12:30-"},
+		},
+		{
+			Name:    "trim contained",
+			Policy:  OverlapTrim,
+			Entry:   &Entry{Start: at(9, 0), End: at(11, 30)},
+			WantErr: "entry overlaps with another entry",
+			Want:    []string{"10:00-11:00", "12:00-"},
+		},
+		{
+			Name:    "trim containing",
+			Policy:  OverlapTrim,
+			Entry:   &Entry{Start: at(10, 15), End: at(10, 45)},
+			WantErr: "entry overlaps with another entry",
+			Want:    []string{"10:00-11:00", "12:00-"},
+		},
+		{
+			Name:    "trim containing running",
+			Policy:  OverlapTrim,
+			Entry:   &Entry{Start: at(12, 15), End: at(12, 45)},
+			WantErr: "entry overlaps with another entry",
+			Want:    []string{"10:00-11:00", "12:00-"},
+		},
+		{
+			Name:   "trim running",
+			Policy: OverlapTrim,
+			Entry:  &Entry{Start: at(12, 15)},
+			Want:   []string{"10:00-11:00", "12:00-12:15", "12:15-"},
+		},
+	}
+	for _, test := range tests {
+		d := newDB(t, Options{Overlap: test.Policy})
+		fixtures := []*Entry{{Start: at(10, 0), End: at(11, 0)}, {Start: at(12, 0)}}
+		for _, e := range fixtures {
+			if err := d.SaveEntry(e); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if test.Update {
+			test.Entry.ID = fixtures[0].ID
+		}
+		err := d.SaveEntry(test.Entry)
+		var gotErr string
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if gotErr != test.WantErr {
+			t.Errorf("test %q: got=%q want=%q", test.Name, gotErr, test.WantErr)
+		} else if oerr, ok := err.(*OverlapError); err != nil && (!ok || oerr.Saved != test.WantSave || oerr.Entry != test.Entry) {
+			t.Errorf("test %q: bad error: %#v", test.Name, err)
+		}
+		itr, err := d.Query(Query{Asc: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := IteratorEntries(itr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			s := e.Start.Format("15:04") + "-"
+			if !e.End.IsZero() {
+				s += e.End.Format("15:04")
+			}
+			got = append(got, s)
+		}
+		if diff := pretty.Compare(got, test.Want); diff != "" {
+			t.Errorf("test %q: %s", test.Name, diff)
+		}
+	}
+}
+
+func testQuery(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{})
+	zone := time.FixedZone("", 3600)
+	at := func(hour, min int) time.Time { return time.Date(2015, 9, 2, hour, min, 0, 0, zone) }
+	path, err := d.CategoryPath([]string{"a", "b", "c"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := path[0], path[1], path[2]
+	entries := []*Entry{
+		{ID: "ab1", Start: at(10, 0), End: at(11, 0), CategoryID: a.ID, Note: "Meeting about ABC-123", Tags: []string{"meeting", "x"}},
+		{ID: "ab2", Start: at(11, 0), End: at(12, 0), CategoryID: c.ID, Note: "Code review\nABC-124", Tags: []string{"review", "x"}},
+		{ID: "c_3", Start: at(12, 30)},
+	}
+	for _, e := range entries {
+		if err := d.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		Name  string
+		Query Query
+		Want  []int
+	}{
+		{Name: "all", Query: Query{}, Want: []int{2, 1, 0}},
+		{Name: "asc", Query: Query{Asc: true}, Want: []int{0, 1, 2}},
+		{Name: "ids", Query: Query{IDs: []string{entries[0].ID, entries[2].ID}}, Want: []int{2, 0}},
+		{Name: "id prefix", Query: Query{IDPrefix: "ab"}, Want: []int{1, 0}},
+		{Name: "id prefix full id", Query: Query{IDPrefix: "ab2"}, Want: []int{1}},
+		{Name: "id prefix is literal", Query: Query{IDPrefix: "c%"}, Want: nil},
+		{Name: "id prefix without match", Query: Query{IDPrefix: "ab3"}, Want: nil},
+		{Name: "active", Query: Query{Active: true}, Want: []int{2}},
+		{Name: "category", Query: Query{CategoryID: a.ID}, Want: []int{0}},
+		{Name: "category without entries", Query: Query{CategoryID: b.ID}, Want: nil},
+		{Name: "recursive category", Query: Query{CategoryID: a.ID, Recursive: true}, Want: []int{1, 0}},
+		{Name: "recursive child category", Query: Query{CategoryID: b.ID, Recursive: true}, Want: []int{1}},
+		{Name: "recursive leaf category", Query: Query{CategoryID: c.ID, Recursive: true}, Want: []int{1}},
+		{Name: "tag", Query: Query{Tags: []string{"x"}}, Want: []int{1, 0}},
+		{Name: "tags", Query: Query{Tags: []string{"x", "review"}}, Want: []int{1}},
+		{Name: "unknown tag", Query: Query{Tags: []string{"foo"}}, Want: nil},
+		{Name: "note match", Query: Query{NoteMatch: "abc-123"}, Want: []int{0}},
+		{Name: "note match prefix", Query: Query{NoteMatch: "abc-12*"}, Want: []int{1, 0}},
+		{Name: "note match all terms", Query: Query{NoteMatch: "review meeting"}, Want: nil},
+		{Name: "note match no terms", Query: Query{NoteMatch: "*"}, Want: []int{2, 1, 0}},
+		{Name: "from", Query: Query{From: at(11, 0)}, Want: []int{2, 1}},
+		{Name: "from includes running", Query: Query{From: at(18, 0)}, Want: []int{2}},
+		{Name: "to", Query: Query{To: at(11, 0)}, Want: []int{0}},
+		{Name: "from and to", Query: Query{From: at(10, 30), To: at(12, 30)}, Want: []int{1, 0}},
+		{Name: "from and to other zone", Query: Query{From: at(10, 30).UTC(), To: at(12, 30).UTC()}, Want: []int{1, 0}},
+		{Name: "valid at", Query: Query{ValidAt: at(11, 30)}, Want: []int{1}},
+		{Name: "valid at start", Query: Query{ValidAt: at(11, 0)}, Want: []int{1}},
+		{Name: "valid at running", Query: Query{ValidAt: at(18, 0)}, Want: []int{2}},
+		{Name: "valid at gap", Query: Query{ValidAt: at(12, 15)}, Want: nil},
+		{Name: "limit", Query: Query{Limit: 1}, Want: []int{2}},
+		{Name: "limit asc", Query: Query{Limit: 1, Asc: true}, Want: []int{0}},
+		{Name: "limit and offset", Query: Query{Limit: 1, Offset: 1}, Want: []int{1}},
+		{Name: "offset", Query: Query{Offset: 2}, Want: []int{0}},
+	}
+	for _, test := range tests {
+		var want []string
+		for _, i := range test.Want {
+			want = append(want, entries[i].ID)
+		}
+		var got []string
+		if itr, err := d.Query(test.Query); err != nil {
+			t.Errorf("test %q: %s", test.Name, err)
+		} else if gotEntries, err := IteratorEntries(itr); err != nil {
+			t.Errorf("test %q: %s", test.Name, err)
+		} else {
+			for _, e := range gotEntries {
+				got = append(got, e.ID)
+			}
+		}
+		if diff := pretty.Compare(got, want); diff != "" {
+			t.Errorf("test %q: %s", test.Name, diff)
+		}
+	}
+}
+
+// testQuery_noteIndex checks that the note index is updated by SaveEntry and
+// Remove.
+func testQuery_noteIndex(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{})
+	count := func(q string) int {
+		itr, err := d.Query(Query{NoteMatch: q})
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := IteratorEntries(itr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(entries)
+	}
+	e := &Entry{Start: time.Now(), Note: "foo"}
+	if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	} else if got := count("foo"); got != 1 {
+		t.Fatalf("got=%d want=1", got)
+	}
+	e.Note = "bar"
+	if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	} else if got := count("foo"); got != 0 {
+		t.Fatalf("got=%d want=0", got)
+	} else if got := count("bar"); got != 1 {
+		t.Fatalf("got=%d want=1", got)
+	}
+	if err := d.Remove(e.ID); err != nil {
+		t.Fatal(err)
+	} else if got := count("bar"); got != 0 {
+		t.Fatalf("got=%d want=0", got)
+	}
+}
+
+func testTrash(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{})
+	start := time.Date(2015, 9, 2, 15, 36, 13, 0, time.FixedZone("", 3600))
+	a, b := &Entry{Start: start, Note: "a", Tags: []string{"x"}}, &Entry{Start: start.Add(time.Hour), Note: "b"}
+	for _, e := range []*Entry{a, b} {
+		if err := d.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func(q Query) []string {
+		itr, err := d.Query(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries, err := IteratorEntries(itr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+		return ids
+	}
+	before := time.Now().Add(-time.Second)
+	if err := d.Remove(a.ID); err != nil {
+		t.Fatal(err)
+	} else if err := d.Remove(a.ID); err == nil {
+		t.Fatal("expected error when removing entry twice")
+	} else if diff := pretty.Compare(ids(Query{}), []string{b.ID}); diff != "" {
+		t.Fatal(diff)
+	} else if got := ids(Query{NoteMatch: "a"}); len(got) != 0 {
+		t.Fatalf("trashed entry is still indexed: %s", got)
+	}
+	trash, err := d.Trash()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(trash) != 1 {
+		t.Fatalf("got=%d want=1", len(trash))
+	} else if diff := pretty.Compare(trash[0].Entry, a); diff != "" {
+		t.Fatal(diff)
+	} else if trash[0].Removed.Before(before) {
+		t.Fatalf("bad removed time: %s", trash[0].Removed)
+	}
+	if err := d.Restore(a.ID); err != nil {
+		t.Fatal(err)
+	} else if err := d.Restore(a.ID); err == nil {
+		t.Fatal("expected error when restoring entry twice")
+	} else if diff := pretty.Compare(ids(Query{}), []string{b.ID, a.ID}); diff != "" {
+		t.Fatal(diff)
+	} else if diff := pretty.Compare(ids(Query{NoteMatch: "a"}), []string{a.ID}); diff != "" {
+		t.Fatal(diff)
+	} else if diff := pretty.Compare(ids(Query{Tags: []string{"x"}}), []string{a.ID}); diff != "" {
+		t.Fatal(diff)
+	}
+	if err := d.Remove(a.ID); err != nil {
+		t.Fatal(err)
+	} else if n, err := d.Purge(before); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("got=%d want=0", n)
+	} else if n, err := d.Purge(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if n != 1 {
+		t.Fatalf("got=%d want=1", n)
+	} else if trash, err := d.Trash(); err != nil {
+		t.Fatal(err)
+	} else if len(trash) != 0 {
+		t.Fatalf("got=%d want=0", len(trash))
+	}
+}
+
+func testRevisions(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{Command: "hiro test"})
+	start := time.Date(2015, 9, 2, 15, 36, 13, 0, time.FixedZone("", 3600))
+	c := &Category{Name: "a"}
+	if err := d.SaveCategory(c); err != nil {
+		t.Fatal(err)
+	}
+	e := &Entry{Start: start, CategoryID: c.ID}
+	if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	v1 := *e
+	e.Note = "foo"
+	if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	} else if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	v2 := *e
+	if err := d.Remove(e.ID); err != nil {
+		t.Fatal(err)
+	} else if err := d.Restore(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	revisions, err := d.Revisions(e.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][2]interface{}
+	for _, r := range revisions {
+		if r.Kind != RevisionEntry || r.ObjectID != e.ID || r.Command != "hiro test" || r.Time.IsZero() {
+			t.Errorf("bad revision: %#v", r)
+		}
+		got = append(got, [2]interface{}{r.Old, r.New})
+	}
+	want := [][2]interface{}{
+		{nil, &v2},
+		{&v2, nil},
+		{&v1, &v2},
+		{nil, &v1},
+	}
+	diffConfig := &pretty.Config{Diffable: true, PrintStringers: true}
+	if diff := diffConfig.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	if all, err := d.Revisions(""); err != nil {
+		t.Fatal(err)
+	} else if len(all) != 5 {
+		t.Fatalf("got=%d want=5", len(all))
+	} else if diff := pretty.Compare(all[4].New, c); all[4].Kind != RevisionCategory || diff != "" {
+		t.Fatalf("bad category revision: %#v %s", all[4], diff)
+	}
+}
+
+func testTransaction(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{})
+	start := time.Date(2015, 9, 2, 15, 36, 13, 0, time.FixedZone("", 3600))
+	a := &Entry{Start: start}
+	if err := d.SaveEntry(a); err != nil {
+		t.Fatal(err)
+	}
+	type state struct {
+		Entries    []*Entry
+		Trash      []*TrashedEntry
+		Categories CategoryMap
+		Revisions  int
+	}
+	get := func() *state {
+		s := &state{}
+		itr, err := d.Query(Query{Asc: true})
+		if err != nil {
+			t.Fatal(err)
+		} else if s.Entries, err = IteratorEntries(itr); err != nil {
+			t.Fatal(err)
+		} else if s.Trash, err = d.Trash(); err != nil {
+			t.Fatal(err)
+		} else if s.Categories, err = d.Categories(); err != nil {
+			t.Fatal(err)
+		} else if revisions, err := d.Revisions(""); err != nil {
+			t.Fatal(err)
+		} else {
+			s.Revisions = len(revisions)
+		}
+		return s
+	}
+	diffConfig := &pretty.Config{Diffable: true, PrintStringers: true}
+
+	// all changes are discarded if fn fails, including nested transactions
+	before := get()
+	abort := errors.New("abort")
+	err := d.Transaction(func(tx DB) error {
+		c := &Category{Name: "c"}
+		if err := tx.SaveCategory(c); err != nil {
+			return err
+		} else if err := tx.SaveEntry(&Entry{Start: start.Add(time.Hour), CategoryID: c.ID}); err != nil {
+			return err
+		} else if err := tx.Remove(a.ID); err != nil {
+			return err
+		} else if itr, err := tx.Query(Query{}); err != nil {
+			return err
+		} else if entries, err := IteratorEntries(itr); err != nil {
+			return err
+		} else if len(entries) != 1 || entries[0].ID == a.ID {
+			t.Errorf("changes are not visible within the transaction: %s", pretty.Sprint(entries))
+		}
+		return tx.Transaction(func(tx DB) error { return abort })
+	})
+	if err != abort {
+		t.Fatalf("got=%v want=%v", err, abort)
+	} else if diff := diffConfig.Compare(get(), before); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// a failed call inside fn doesn't leave partial changes
+	b := &Entry{Start: start.Add(time.Hour)}
+	err = d.Transaction(func(tx DB) error {
+		if err := tx.SaveEntry(b); err != nil {
+			return err
+		} else if err := tx.SaveCategory(&Category{Name: "orphan", ParentID: "missing"}); err == nil {
+			return errors.New("expected error for missing parent")
+		} else if err := tx.SaveEntry(&Entry{ID: a.ID, Start: start, End: start.Add(-time.Hour)}); err == nil {
+			return errors.New("expected error for invalid entry")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := get()
+	if diff := diffConfig.Compare(after.Entries, append(before.Entries, b)); diff != "" {
+		t.Fatal(diff)
+	} else if len(after.Categories) != 0 {
+		t.Fatalf("got=%d categories want=0", len(after.Categories))
+	} else if after.Revisions != before.Revisions+1 {
+		t.Fatalf("got=%d revisions want=%d", after.Revisions, before.Revisions+1)
+	}
+}
+
+func testGetOrCreateCategoryPath(t *testing.T, newDB newDBFunc) {
+	db := newDB(t, Options{})
+	path, err := db.CategoryPath([]string{"a", "b", "c"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPath := CategoryPath{
+		&Category{ID: path[0].ID, Name: "a"},
+		&Category{ID: path[1].ID, Name: "b", ParentID: path[0].ID},
+		&Category{ID: path[2].ID, Name: "c", ParentID: path[1].ID},
+	}
+	if diff := pretty.Compare(path, wantPath); diff != "" {
+		t.Fatal(diff)
+	} else if path2, err := db.CategoryPath([]string{"a", "b", "c"}, true); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(path2, wantPath); diff != "" {
+		t.Fatal(diff)
+	}
+	path3, err := db.CategoryPath([]string{"a", "d"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantPath = CategoryPath{
+		&Category{ID: path[0].ID, Name: "a"},
+		&Category{ID: path3[1].ID, Name: "d", ParentID: path[0].ID},
+	}
+	if diff := pretty.Compare(path3, wantPath); diff != "" {
+		t.Fatal(diff)
+	}
+	categories, err := db.Categories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCategories := CategoryMap{
+		path[0].ID:  path[0],
+		path[1].ID:  path[1],
+		path[2].ID:  path[2],
+		path3[1].ID: path3[1],
+	}
+	if diff := pretty.Compare(categories, wantCategories); diff != "" {
+		t.Fatal(diff)
+	}
+	// @TODO check actual error
+	if _, err := db.CategoryPath([]string{"a", "e"}, false); err == nil {
+		t.Fatal("expected does not exist error")
+	}
+}
+
+func testCategories(t *testing.T, newDB newDBFunc) {
+	db := newDB(t, Options{})
+	a := &Category{Name: "a"}
+	if err := db.SaveCategory(a); err != nil {
+		t.Fatal(err)
+	}
+	b := &Category{Name: "b", ParentID: a.ID}
+	if err := db.SaveCategory(b); err != nil {
+		t.Fatal(err)
+	}
+	want := CategoryMap{a.ID: a, b.ID: b}
+	if got, err := db.Categories(); err != nil {
+		t.Error(err)
+	} else if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	a.Name, b.Name = "c", "d"
+	if err := db.SaveCategory(a); err != nil {
+		t.Fatal(err)
+	} else if err := db.SaveCategory(b); err != nil {
+		t.Fatal(err)
+	} else if got, err := db.Categories(); err != nil {
+		t.Error(err)
+	} else if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func testMergeCategory(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{})
+	paths := map[string]CategoryPath{}
+	for _, p := range []string{"a:x", "a:y", "b:x:z", "b:w"} {
+		names := strings.Split(p, ":")
+		path, err := d.CategoryPath(names, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := range path {
+			paths[strings.Join(names[:i+1], ":")] = path[:i+1]
+		}
+	}
+	entries := map[string]*Entry{}
+	for i, p := range []string{"a", "a:x", "b", "b:x", "trash"} {
+		categoryID := paths[p].CategoryID()
+		if p == "trash" {
+			categoryID = paths["b"].CategoryID()
+		}
+		entries[p] = &Entry{Start: time.Now().Add(time.Duration(i) * time.Hour), CategoryID: categoryID}
+		if err := d.SaveEntry(entries[p]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Remove(entries["trash"].ID); err != nil {
+		t.Fatal(err)
+	}
+	a, b := paths["a"].CategoryID(), paths["b"].CategoryID()
+	if err := d.MergeCategory(a, paths["a:x"].CategoryID()); err == nil {
+		t.Fatal("expected error when merging category into its child")
+	} else if err := d.MergeCategory(b, a); err != nil {
+		t.Fatal(err)
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for id := range categories {
+		got = append(got, formatPath(categories.Path(id)))
+	}
+	sort.Strings(got)
+	if diff := pretty.Compare(got, []string{"a", "a:w", "a:x", "a:x:z", "a:y"}); diff != "" {
+		t.Fatal(diff)
+	} else if categories[paths["a:x"].CategoryID()] == nil || categories[paths["b:w"].CategoryID()] == nil {
+		t.Fatal("expected merged categories to keep their ids")
+	}
+	wantCategories := map[string]string{"a": "a", "a:x": "a:x", "b": "a", "b:x": "a:x"}
+	for p, want := range wantCategories {
+		itr, err := d.Query(Query{IDs: []string{entries[p].ID}})
+		if err != nil {
+			t.Fatal(err)
+		} else if got, err := IteratorEntries(itr); err != nil {
+			t.Fatal(err)
+		} else if got[0].CategoryID != paths[want].CategoryID() {
+			t.Errorf("entry %s: got=%s want=%s", p, formatPath(categories.Path(got[0].CategoryID)), want)
+		}
+	}
+	if trash, err := d.Trash(); err != nil {
+		t.Fatal(err)
+	} else if trash[0].CategoryID != a {
+		t.Errorf("trash: got=%s want=%s", trash[0].CategoryID, a)
+	}
+}
+
+func testRemoveCategory(t *testing.T, newDB newDBFunc) {
+	d := newDB(t, Options{})
+	path, err := d.CategoryPath([]string{"a", "b"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Category{Name: "c"}
+	if err := d.SaveCategory(c); err != nil {
+		t.Fatal(err)
+	}
+	a, b := path[0].ID, path[1].ID
+	entry := &Entry{Start: time.Now(), CategoryID: b}
+	if err := d.SaveEntry(entry); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemoveCategory(a, c.ID); err == nil || err.Error() != "category has sub categories" {
+		t.Fatalf("got=%v want sub categories error", err)
+	} else if err := d.RemoveCategory(b, ""); err == nil || err.Error() != "category has entries" {
+		t.Fatalf("got=%v want entries error", err)
+	} else if err := d.RemoveCategory(b, c.ID); err != nil {
+		t.Fatal(err)
+	} else if err := d.RemoveCategory(a, ""); err != nil {
+		t.Fatal(err)
+	}
+	if categories, err := d.Categories(); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(categories, CategoryMap{c.ID: c}); diff != "" {
+		t.Fatal(diff)
+	} else if itr, err := d.Query(Query{CategoryID: c.ID}); err != nil {
+		t.Fatal(err)
+	} else if entries, err := IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Fatalf("got=%d want=1", len(entries))
+	}
+}
+
+// formatPath returns the names of the given path joined by ":".
+func formatPath(path CategoryPath) string {
+	names := make([]string, len(path))
+	for i, c := range path {
+		names[i] = c.Name
+	}
+	return strings.Join(names, ":")
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// historyCopier is implemented by databases that can take over the history
+// of another database, which can't be set through the DB interface.
+type historyCopier interface {
+	// replaceRevisions replaces the revision log with the given revisions,
+	// keeping their ids, oldest first.
+	replaceRevisions([]*Revision) error
+	// setRemoved sets the time the entry with the given id was moved into the
+	// trash.
+	setRemoved(id string, removed time.Time) error
+}
+
+// Copy copies all categories and entries, including the entries in the
+// trash, from src into dst, keeping their ids. The revision log of dst is
+// replaced by the one of src, and the entries in the trash keep their
+// removal time. Entries in the trash lose their category if it no longer
+// exists. If an error is returned, nothing is copied.
+func Copy(dst, src DB) error {
+	return dst.Transaction(func(dst DB) error {
+		return copyDB(dst, src)
+	})
+}
+
+// copyDB implements Copy within a transaction of dst.
+func copyDB(dst, src DB) error {
+	history, ok := dst.(historyCopier)
+	if !ok {
+		return fmt.Errorf("can't copy the history into %T", dst)
+	}
+	categories, err := src.Categories()
+	if err != nil {
+		return err
+	}
+	// parents have to be saved before their children
+	var copyCategories func(*CategoryNode) error
+	copyCategories = func(node *CategoryNode) error {
+		for _, child := range node.Children {
+			if err := dst.SaveCategory(child.Category); err != nil {
+				return err
+			} else if err := copyCategories(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := copyCategories(categories.Root()); err != nil {
+		return err
+	}
+	itr, err := src.Query(Query{Asc: true})
+	if err != nil {
+		return err
+	}
+	entries, err := IteratorEntries(itr)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := dst.SaveEntry(e); err != nil {
+			return err
+		}
+	}
+	trash, err := src.Trash()
+	if err != nil {
+		return err
+	}
+	for i := len(trash) - 1; i >= 0; i-- {
+		e := trash[i].Entry
+		if categories[e.CategoryID] == nil {
+			e.CategoryID = ""
+		}
+		if err := dst.SaveEntry(e); err != nil {
+			return err
+		} else if err := dst.Remove(e.ID); err != nil {
+			return err
+		} else if err := history.setRemoved(e.ID, trash[i].Removed); err != nil {
+			return err
+		}
+	}
+	revisions, err := src.Revisions("")
+	if err != nil {
+		return err
+	}
+	for i, j := 0, len(revisions)-1; i < j; i, j = i+1, j-1 {
+		revisions[i], revisions[j] = revisions[j], revisions[i]
+	}
+	return history.replaceRevisions(revisions)
+}
@@ -0,0 +1,74 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestCopy(t *testing.T) {
+	src := mustDB(t)
+	path, err := src.CategoryPath([]string{"a", "b", "c"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 9, 2, 15, 36, 13, 0, time.FixedZone("", 3600))
+	for i, e := range []*Entry{
+		{Start: start, CategoryID: path[2].ID, Note: "a", Tags: []string{"x"}},
+		{Start: start.Add(time.Hour), Note: "b"},
+		{Start: start.Add(2 * time.Hour), CategoryID: path[0].ID},
+	} {
+		if err := src.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		} else if i == 2 {
+			if err := src.Remove(e.ID); err != nil {
+				t.Fatal(err)
+			} else if err := src.(historyCopier).setRemoved(e.ID, start.Add(3*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	journal, err := NewJournal(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	diffConfig := &pretty.Config{Diffable: true, PrintStringers: true}
+	for name, dst := range map[string]DB{"memory": NewMemory(Options{}), "journal": journal, "sqlite": mustDB(t)} {
+		if err := Copy(dst, src); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if name == "journal" {
+			if dst, err = NewJournal(dir, Options{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for kind, get := range map[string]func(DB) (interface{}, error){
+			"categories": func(d DB) (interface{}, error) { return d.Categories() },
+			"entries": func(d DB) (interface{}, error) {
+				itr, err := d.Query(Query{})
+				if err != nil {
+					return nil, err
+				}
+				return IteratorEntries(itr)
+			},
+			"trash":     func(d DB) (interface{}, error) { return d.Trash() },
+			"revisions": func(d DB) (interface{}, error) { return d.Revisions("") },
+		} {
+			if want, err := get(src); err != nil {
+				t.Fatal(err)
+			} else if got, err := get(dst); err != nil {
+				t.Fatal(err)
+			} else if diff := diffConfig.Compare(got, want); diff != "" {
+				t.Errorf("%s: %s: %s", name, kind, diff)
+			}
+		}
+	}
+}
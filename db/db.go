@@ -2,42 +2,78 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
+	"reflect"
 	"strings"
 	"time"
 
 	"code.google.com/p/go-uuid/uuid"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 )
 import "path/filepath"
 
 const (
+	// datetimeLayout is the layout start and end were stored in before
+	// schema version 2.
 	datetimeLayout = "2006-01-02 15:04:05 -07:00"
 )
 
 // DB defines the hiro database api.
 type DB interface {
 	// SaveEntry normalizes, validates and saves the given entry or returns an
-	// error.
+	// error. Entries without an id are assigned a new one, entries with an id
+	// that doesn't exist yet are inserted with it.
 	SaveEntry(*Entry) error
 	// Query returns an Iterator that lists all entries matched by the given
 	// query, or an error. Callers are required to call Close() on the iterator.
 	Query(Query) (Iterator, error)
-	// Remove deletes the entry with the given id from the db or returns an
+	// Remove moves the entry with the given id into the trash or returns an
 	// error.
 	Remove(string) error
+	// Trash returns the entries in the trash, most recently removed first, or
+	// an error.
+	Trash() ([]*TrashedEntry, error)
+	// Restore moves the entry with the given id out of the trash or returns an
+	// error.
+	Restore(string) error
+	// Purge permanently deletes the entries that were moved into the trash at
+	// or before the given time, and returns their number or an error.
+	Purge(before time.Time) (int, error)
 	// CategoryPath returns a category path with the given names, creating
 	// categories as needed if created is true.
 	CategoryPath(names []string, create bool) (CategoryPath, error)
-	// categories as needed
-	// SaveCategory saves the given Category.
+	// SaveCategory saves the given Category. Like SaveEntry, it assigns a new
+	// id if the category has none.
 	SaveCategory(*Category) error
 	// Categories returns all categories indexed by id an error.
 	Categories() (CategoryMap, error)
+	// MergeCategory moves the entries and sub categories of the category src
+	// into the category dst and removes src, or returns an error. Sub
+	// categories of src that have the same name as a sub category of dst are
+	// merged recursively.
+	MergeCategory(src, dst string) error
+	// RemoveCategory removes the category with the given id after moving its
+	// entries into the category reassign, or returns an error. An error is
+	// also returned if the category has sub categories, or if it has entries
+	// and reassign is empty.
+	RemoveCategory(id, reassign string) error
+	// Revisions returns the revision log of the entry or category with the
+	// given id, or of the whole database if id is empty. The most recent
+	// revision is returned first.
+	Revisions(id string) ([]*Revision, error)
+	// Transaction calls fn with a DB that applies the changes made through it
+	// atomically: they are kept if fn returns nil, and discarded if fn returns
+	// an error, which is then returned. A failed call inside fn doesn't leave
+	// partial changes, so fn may handle the error and continue. fn may be
+	// called more than once if the transaction has to be retried, and the DB
+	// passed to it must not be used after it returns or be closed. Calling
+	// Transaction on that DB calls fn directly.
+	Transaction(fn func(DB) error) error
 	// Close closes the database.
 	Close() error
 }
@@ -45,12 +81,35 @@ type DB interface {
 type Query struct {
 	// IDs returns entries matching the given ids if set.
 	IDs []string
+	// IDPrefix returns entries whose id starts with the given prefix, if set.
+	IDPrefix string
 	// Asc returns entries in ascending order if true.
 	Asc bool
 	// Active returns entries without an end time if true.
 	Active bool
 	// Category returns entries with the given category id.
 	CategoryID string
+	// Recursive extends the CategoryID filter to all of its descendant
+	// categories if true.
+	Recursive bool
+	// Tags returns entries that have all of the given tags, if set.
+	Tags []string
+	// NoteMatch returns entries whose note matches the given search query, if
+	// set. The query consists of whitespace separated terms which all have to
+	// occur in the note, ignoring case. A term ending in "*" matches all words
+	// starting with it.
+	NoteMatch string
+	// From returns entries that end after the given time, or are still
+	// running, if set.
+	From time.Time
+	// To returns entries that start before the given time, if set.
+	To time.Time
+	// ValidAt returns entries that were running at the given time, if set.
+	ValidAt time.Time
+	// Limit returns at most the given number of entries, if > 0.
+	Limit int
+	// Offset skips the given number of entries.
+	Offset int
 }
 
 type Iterator interface {
@@ -60,77 +119,231 @@ type Iterator interface {
 	Close() error
 }
 
-func New(dir string) (DB, error) {
+// categoryPath implements DB.CategoryPath on top of the Categories and
+// SaveCategory methods of d.
+func categoryPath(d DB, names []string, create bool) (CategoryPath, error) {
+	categories, err := d.Categories()
+	if err != nil {
+		return nil, err
+	}
+	node := categories.Root()
+	path := make(CategoryPath, 0, len(names))
+	var categoryID string
+	for _, name := range names {
+		var category *Category
+		nodes := node.ChildrenByName(name)
+		if l := len(nodes); l > 1 {
+			return nil, errors.New("category exists more than once")
+		} else if l == 1 {
+			node = nodes[0]
+			category = node.Category
+		} else if create == false {
+			return nil, errors.New("category does not exist")
+		} else {
+			node = nil
+			category = &Category{Name: name, ParentID: categoryID}
+			if err := d.SaveCategory(category); err != nil {
+				return nil, err
+			}
+		}
+		path = append(path, category)
+		categoryID = category.ID
+	}
+	return path, nil
+}
+
+// normalizeEntry truncates the times and normalizes the tags of the given
+// entry as done by DB.SaveEntry, and validates it.
+func normalizeEntry(e *Entry) error {
+	e.Start = e.Start.Truncate(time.Second)
+	e.End = e.End.Truncate(time.Second)
+	e.Tags = NormalizeTags(e.Tags)
+	return e.Valid()
+}
+
+// Options holds the options for opening a database.
+type Options struct {
+	// Command is recorded in the revision log for every change made through
+	// the database, e.g. the command line of the current process.
+	Command string
+	// Overlap defines how SaveEntry handles overlapping entries.
+	Overlap OverlapPolicy
+}
+
+// sqliteParams are the connection parameters used by New. The write-ahead log
+// lets readers proceed while another process writes, immediate transactions
+// take the write lock up front instead of failing when upgrading a read lock,
+// and the busy timeout makes sqlite wait for locks held by other processes.
+const sqliteParams = "_busy_timeout=5000&_journal_mode=WAL&_txlock=immediate&_foreign_keys=1"
+
+// New opens the database stored in the given dir, creating it if needed, and
+// migrates it to the latest schema version. The database may be used by
+// multiple processes at once.
+func New(dir string, o Options) (DB, error) {
+	path := filepath.Join(dir, "hiro.db")
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return nil, err
-	} else if d, err := sql.Open("sqlite3", filepath.Join(dir, "hiro.db")); err != nil {
+	} else if d, err := sql.Open("sqlite3", path+"?"+sqliteParams); err != nil {
 		return nil, err
 	} else {
-		db := &db{DB: d}
+		db := &db{DB: d, path: path, options: o}
 		return db, db.init()
 	}
 }
 
+// Backends that can be opened with Open.
+const (
+	BackendSQLite  = "sqlite"
+	BackendJournal = "journal"
+)
+
+// Open opens the database of the given backend stored in dir, see New and
+// NewJournal.
+func Open(backend, dir string, o Options) (DB, error) {
+	switch backend {
+	case BackendSQLite:
+		return New(dir, o)
+	case BackendJournal:
+		return NewJournal(dir, o)
+	}
+	return nil, fmt.Errorf("unknown backend: %s", backend)
+}
+
 // db implements the DB interface.
 type db struct {
 	*sql.DB
+	// path is the path of the database file, or empty for in-memory databases.
+	path    string
+	options Options
+	// tx is the transaction of a db passed to a Transaction callback, or nil.
+	tx *sql.Tx
+}
+
+// conn returns the transaction of d, or the database if it has none.
+func (d *db) conn() querier {
+	if d.tx != nil {
+		return d.tx
+	}
+	return d.DB
 }
 
 func (d *db) init() error {
-	_, err := d.Exec(`
-PRAGMA foreign_keys = ON;
-
-CREATE TABLE IF NOT EXISTS categories (
-	id TEXT PRIMARY KEY,
-	name TEXT,
-	parent_id TEXT REFERENCES categories
-);
-CREATE INDEX IF NOT EXISTS parent_id ON categories(parent_id);
-CREATE UNIQUE INDEX IF NOT EXISTS name_parent_id ON categories(name, parent_id);
-
-CREATE TABLE IF NOT EXISTS entries (
-	id TEXT PRIMARY KEY,
-	start TEXT,
-	end TEXT,
-	note TEXT,
-	category_id TEXT REFERENCES categories
-);
-CREATE INDEX IF NOT EXISTS category_id ON entries(category_id);
-`)
-	return err
+	if _, err := d.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		return err
+	}
+	return d.migrate()
 }
 
 // SaveEntry is part of the DB interface.
 func (d *db) SaveEntry(e *Entry) error {
-	e.Start = e.Start.Truncate(time.Second)
-	e.End = e.End.Truncate(time.Second)
-	err := e.Valid()
-	if err != nil {
+	return d.saveEntryWith(e, d.options.Overlap)
+}
+
+// saveEntryWith is part of the overlapSaver interface.
+func (d *db) saveEntryWith(e *Entry, policy OverlapPolicy) error {
+	if err := normalizeEntry(e); err != nil {
 		return err
-	}
-	var insert bool
-	if insert = e.ID == ""; insert {
+	} else if e.ID == "" {
 		e.ID = uuid.NewRandom().String()
 	}
-	var start, end interface{}
-	start = e.Start.Format(datetimeLayout)
+	var warning *OverlapError
+	err := d.update(func(tx *sql.Tx) error {
+		var candidates []*Entry
+		if policy != OverlapAllow {
+			var err error
+			if candidates, err = txEntries(tx, overlapQuery(e)); err != nil {
+				return err
+			}
+		}
+		trimmed, oerr := resolveOverlaps(policy, e, candidates)
+		if oerr != nil && !oerr.Saved {
+			return oerr
+		}
+		warning = oerr
+		for _, entry := range append(trimmed, e) {
+			if err := d.saveEntry(tx, entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil && warning != nil {
+		return warning
+	}
+	return err
+}
+
+// saveEntry saves the given normalized entry within the given transaction.
+func (d *db) saveEntry(tx *sql.Tx, e *Entry) error {
+	old, err := txEntry(tx, "entries", e.ID)
+	if err != nil {
+		return err
+	}
+	_, startOffset := e.Start.Zone()
+	var end, endOffset interface{}
 	if !e.End.IsZero() {
-		end = e.End.Format(datetimeLayout)
+		end = e.End.Unix()
+		_, endOffset = e.End.Zone()
 	}
 	categoryID := sql.NullString{String: e.CategoryID, Valid: e.CategoryID != ""}
-	q := "INSERT INTO entries (id, start, end, note, category_id) VALUES (?, ?, ?, ?, ?)"
-	args := []interface{}{e.ID, start, end, e.Note, categoryID}
-	if !insert {
-		q = "UPDATE entries SET id=?, start=?, end=?, note=?, category_id=? WHERE id=?"
+	args := []interface{}{e.ID, e.Start.Unix(), startOffset, end, endOffset, e.Note, categoryID}
+	q := "INSERT INTO entries (id, start, start_offset, end, end_offset, note, category_id) VALUES (?, ?, ?, ?, ?, ?, ?)"
+	if old != nil {
+		q = "UPDATE entries SET id=?, start=?, start_offset=?, end=?, end_offset=?, note=?, category_id=? WHERE id=?"
 		args = append(args, e.ID)
 	}
-	_, err = d.Exec(q, args...)
-	return err
+	if _, err := tx.Exec(q, args...); err != nil {
+		return err
+	} else if _, err := tx.Exec("DELETE FROM entries_fts WHERE id=?", e.ID); err != nil {
+		return err
+	} else if _, err := tx.Exec("INSERT INTO entries_fts (id, note) VALUES (?, ?)", e.ID, e.Note); err != nil {
+		return err
+	} else if _, err := tx.Exec("DELETE FROM entry_tags WHERE entry_id=?", e.ID); err != nil {
+		return err
+	}
+	for _, tag := range e.Tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (name) VALUES (?)", tag); err != nil {
+			return err
+		} else if _, err := tx.Exec("INSERT INTO entry_tags SELECT ?, id FROM tags WHERE name=?", e.ID, tag); err != nil {
+			return err
+		}
+	}
+	return d.logRevision(tx, RevisionEntry, e.ID, old, e)
 }
 
-// @TODO test
+// Query is part of the DB interface.
 func (d *db) Query(q Query) (Iterator, error) {
-	var parts = []string{"SELECT id, start, end, note, category_id", "FROM entries"}
+	sql, args := entryQuery(q)
+	rows, err := d.conn().Query(sql, args...)
+	return &iterator{rows: rows}, err
+}
+
+// txEntries returns the entries matched by q within the given transaction.
+func txEntries(tx *sql.Tx, q Query) ([]*Entry, error) {
+	sql, args := entryQuery(q)
+	rows, err := tx.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	return IteratorEntries(&iterator{rows: rows})
+}
+
+// prefixEnd returns the smallest string greater than all strings starting
+// with prefix, or "" if there is none because prefix consists of 0xff bytes.
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// entryQuery returns the sql query and its arguments for the given Query.
+func entryQuery(q Query) (string, []interface{}) {
+	var parts = []string{"SELECT " + entrySelect("entries"), "FROM entries"}
 	var (
 		args  []interface{}
 		where []string
@@ -141,13 +354,50 @@ func (d *db) Query(q Query) (Iterator, error) {
 			args = append(args, id)
 		}
 	}
+	if q.IDPrefix != "" {
+		// a range instead of a function call, so the primary key index is used
+		where = append(where, "id >= ?")
+		args = append(args, q.IDPrefix)
+		if end := prefixEnd(q.IDPrefix); end != "" {
+			where = append(where, "id < ?")
+			args = append(args, end)
+		}
+	}
 	if q.Active {
 		where = append(where, "end IS NULL")
 	}
-	if q.CategoryID != "" {
+	if q.CategoryID != "" && q.Recursive {
+		where = append(where, `category_id IN (
+	WITH RECURSIVE tree(id) AS (
+		SELECT ? UNION ALL SELECT c.id FROM categories c JOIN tree ON c.parent_id = tree.id
+	)
+	SELECT id FROM tree
+)`)
+		args = append(args, q.CategoryID)
+	} else if q.CategoryID != "" {
 		where = append(where, "category_id = ?")
 		args = append(args, q.CategoryID)
 	}
+	for _, tag := range q.Tags {
+		where = append(where, "id IN (SELECT et.entry_id FROM entry_tags et JOIN tags t ON t.id = et.tag_id WHERE t.name = ?)")
+		args = append(args, tag)
+	}
+	if terms := parseNoteMatch(q.NoteMatch); len(terms) > 0 {
+		where = append(where, "id IN (SELECT id FROM entries_fts WHERE entries_fts MATCH ?)")
+		args = append(args, ftsQuery(terms))
+	}
+	if !q.From.IsZero() {
+		where = append(where, "(end IS NULL OR end > ?)")
+		args = append(args, q.From.Unix())
+	}
+	if !q.To.IsZero() {
+		where = append(where, "start < ?")
+		args = append(args, q.To.Unix())
+	}
+	if !q.ValidAt.IsZero() {
+		where = append(where, "start <= ? AND (end IS NULL OR end > ?)")
+		args = append(args, q.ValidAt.Unix(), q.ValidAt.Unix())
+	}
 	if len(where) > 0 {
 		parts = append(parts, "WHERE "+strings.Join(where, " AND "))
 	}
@@ -155,42 +405,21 @@ func (d *db) Query(q Query) (Iterator, error) {
 	if q.Asc == true {
 		order = "ASC"
 	}
-	parts = append(parts, "ORDER BY DATETIME(start, 'utc') "+order)
-	sql := strings.Join(parts, " ")
-	rows, err := d.DB.Query(sql, args...)
-	return &iterator{db: d.DB, rows: rows}, err
+	parts = append(parts, "ORDER BY start "+order)
+	if q.Limit > 0 || q.Offset > 0 {
+		limit := q.Limit
+		if limit <= 0 {
+			limit = -1
+		}
+		parts = append(parts, "LIMIT ? OFFSET ?")
+		args = append(args, limit, q.Offset)
+	}
+	return strings.Join(parts, " "), args
 }
 
 // CategoryPath is part of the DB interface.
 func (d *db) CategoryPath(names []string, create bool) (CategoryPath, error) {
-	categories, err := d.Categories()
-	if err != nil {
-		return nil, err
-	}
-	node := categories.Root()
-	path := make(CategoryPath, 0, len(names))
-	var categoryID string
-	for _, name := range names {
-		var category *Category
-		nodes := node.ChildrenByName(name)
-		if l := len(nodes); l > 1 {
-			return nil, errors.New("category exists more than once")
-		} else if l == 1 {
-			node = nodes[0]
-			category = node.Category
-		} else if create == false {
-			return nil, errors.New("category does not exist")
-		} else {
-			node = nil
-			category = &Category{Name: name, ParentID: categoryID}
-			if err := d.SaveCategory(category); err != nil {
-				return nil, err
-			}
-		}
-		path = append(path, category)
-		categoryID = category.ID
-	}
-	return path, nil
+	return categoryPath(d, names, create)
 }
 
 // SaveCategory is part of the DB interface.
@@ -200,20 +429,44 @@ func (d *db) SaveCategory(c *Category) error {
 		c.ID = uuid.NewRandom().String()
 	}
 	parentID := sql.NullString{String: c.ParentID, Valid: c.ParentID != ""}
-	q := "INSERT INTO categories (id, name, parent_id) VALUES (?, ?, ?)"
-	args := []interface{}{c.ID, c.Name, parentID}
-	if !insert {
-		q = "UPDATE categories SET id=?, name=?, parent_id=? WHERE id=?"
-		args = append(args, c.ID)
-	}
-	_, err := d.Exec(q, args...)
-	return err
-
+	return d.update(func(tx *sql.Tx) error {
+		var (
+			old  *Category
+			err  error
+			args = []interface{}{c.ID, c.Name, parentID}
+		)
+		if !insert {
+			if old, err = txCategory(tx, c.ID); err != nil {
+				return err
+			}
+		}
+		q := "INSERT INTO categories (id, name, parent_id) VALUES (?, ?, ?)"
+		if old != nil {
+			q = "UPDATE categories SET id=?, name=?, parent_id=? WHERE id=?"
+			args = append(args, c.ID)
+		}
+		if _, err := tx.Exec(q, args...); err != nil {
+			return err
+		}
+		return d.logRevision(tx, RevisionCategory, c.ID, old, c)
+	})
 }
 
 // Categories is part of the DB interface.
 func (d *db) Categories() (CategoryMap, error) {
-	rows, err := d.DB.Query("SELECT id, name, parent_id FROM categories")
+	return queryCategories(d.conn())
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(string, ...interface{}) (sql.Result, error)
+	Query(string, ...interface{}) (*sql.Rows, error)
+	QueryRow(string, ...interface{}) *sql.Row
+}
+
+// queryCategories returns all categories indexed by id.
+func queryCategories(q querier) (CategoryMap, error) {
+	rows, err := q.Query("SELECT id, name, parent_id FROM categories")
 	if err != nil {
 		return nil, err
 	}
@@ -228,15 +481,137 @@ func (d *db) Categories() (CategoryMap, error) {
 		category.ParentID = parentID.String
 		m[category.ID] = category
 	}
-	return m, nil
+	return m, rows.Err()
 }
 
+// MergeCategory is part of the DB interface.
+func (d *db) MergeCategory(src, dst string) error {
+	return d.update(func(tx *sql.Tx) error {
+		categories, err := queryCategories(tx)
+		if err != nil {
+			return err
+		} else if categories[src] == nil || categories[dst] == nil {
+			return errors.New("category does not exist")
+		}
+		for _, category := range categories.Path(dst) {
+			if category.ID == src {
+				return errors.New("category can't be merged into itself")
+			}
+		}
+		return d.mergeCategory(tx, categories, src, dst)
+	})
+}
+
+// mergeCategory implements MergeCategory within the given transaction.
+func (d *db) mergeCategory(tx *sql.Tx, categories CategoryMap, src, dst string) error {
+	root := categories.Root()
+	srcNode, dstNode := root.Find(src), root.Find(dst)
+	for _, child := range srcNode.Children {
+		if nodes := dstNode.ChildrenByName(child.Name); len(nodes) > 0 {
+			if err := d.mergeCategory(tx, categories, child.ID, nodes[0].ID); err != nil {
+				return err
+			}
+			continue
+		}
+		old := *child.Category
+		child.ParentID = dst
+		if _, err := tx.Exec("UPDATE categories SET parent_id=? WHERE id=?", dst, child.ID); err != nil {
+			return err
+		} else if err := d.logRevision(tx, RevisionCategory, child.ID, &old, child.Category); err != nil {
+			return err
+		}
+	}
+	if err := d.reassignEntries(tx, src, dst); err != nil {
+		return err
+	}
+	return d.deleteCategory(tx, categories[src])
+}
+
+// RemoveCategory is part of the DB interface.
+func (d *db) RemoveCategory(id, reassign string) error {
+	return d.update(func(tx *sql.Tx) error {
+		categories, err := queryCategories(tx)
+		if err != nil {
+			return err
+		} else if categories[id] == nil || (reassign != "" && categories[reassign] == nil) {
+			return errors.New("category does not exist")
+		} else if len(categories.Root().Find(id).Children) > 0 {
+			return errors.New("category has sub categories")
+		} else if reassign == id {
+			return errors.New("category can't be reassigned to itself")
+		}
+		var n int
+		if err := tx.QueryRow("SELECT count(*) FROM entries WHERE category_id=?", id).Scan(&n); err != nil {
+			return err
+		} else if n > 0 && reassign == "" {
+			return errors.New("category has entries")
+		} else if err := d.reassignEntries(tx, id, reassign); err != nil {
+			return err
+		}
+		return d.deleteCategory(tx, categories[id])
+	})
+}
+
+// reassignEntries moves all entries, including the ones in the trash, from
+// the category src to the category dst.
+func (d *db) reassignEntries(tx *sql.Tx, src, dst string) error {
+	rows, err := tx.Query("SELECT "+entrySelect("entries")+" FROM entries WHERE category_id=?", src)
+	if err != nil {
+		return err
+	}
+	var entries []*Entry
+	for rows.Next() {
+		entry, err := scanEntry(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	dstID := sql.NullString{String: dst, Valid: dst != ""}
+	for _, entry := range entries {
+		old := *entry
+		entry.CategoryID = dst
+		if _, err := tx.Exec("UPDATE entries SET category_id=? WHERE id=?", dstID, entry.ID); err != nil {
+			return err
+		} else if err := d.logRevision(tx, RevisionEntry, entry.ID, &old, entry); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("UPDATE trash SET category_id=? WHERE category_id=?", dstID, src)
+	return err
+}
+
+// deleteCategory deletes the given category.
+func (d *db) deleteCategory(tx *sql.Tx, c *Category) error {
+	if _, err := tx.Exec("DELETE FROM categories WHERE id=?", c.ID); err != nil {
+		return err
+	}
+	return d.logRevision(tx, RevisionCategory, c.ID, c, nil)
+}
+
+// Transaction is part of the DB interface.
+func (d *db) Transaction(fn func(DB) error) error {
+	if d.tx != nil {
+		return fn(d)
+	}
+	return d.update(func(tx *sql.Tx) error {
+		return fn(&db{DB: d.DB, path: d.path, options: d.options, tx: tx})
+	})
+}
+
+// Close is part of the DB interface.
 func (d *db) Close() error {
+	if d.tx != nil {
+		return errors.New("can't close a transaction")
+	}
 	return d.DB.Close()
 }
 
 type iterator struct {
-	db   *sql.DB
 	rows *sql.Rows
 }
 
@@ -244,33 +619,348 @@ func (i *iterator) Next() (*Entry, error) {
 	if !i.rows.Next() {
 		return nil, io.EOF
 	}
+	entry, err := scanEntry(i.rows)
+	if err != nil {
+		return nil, err
+	}
+	return entry, i.rows.Err()
+}
+
+// entryColumns lists the columns of the entries and trash tables.
+const entryColumns = "id, start, start_offset, end, end_offset, note, category_id"
+
+// entrySelect returns the entryColumns of the given table followed by the
+// tags of the entry, as expected by scanEntry.
+func entrySelect(table string) string {
+	return entryColumns + ", (SELECT group_concat(t.name, ' ') FROM entry_tags et JOIN tags t ON t.id = et.tag_id WHERE et.entry_id = " + table + ".id)"
+}
+
+// scanEntry returns the entry held by the entrySelect columns of the current
+// row, scanning any additional columns into dst.
+func scanEntry(rows *sql.Rows, dst ...interface{}) (*Entry, error) {
 	var (
-		entry      Entry
-		start      sql.NullString
-		end        sql.NullString
-		categoryID sql.NullString
+		entry                  Entry
+		start, end             sql.NullInt64
+		startOff, endOff       sql.NullInt64
+		note, categoryID, tags sql.NullString
 	)
-	if err := i.rows.Scan(&entry.ID, &start, &end, &entry.Note, &categoryID); err != nil {
+	dst = append([]interface{}{&entry.ID, &start, &startOff, &end, &endOff, &note, &categoryID, &tags}, dst...)
+	if err := rows.Scan(dst...); err != nil {
 		return nil, err
 	}
+	entry.Tags = NormalizeTags(strings.Fields(tags.String))
+	entry.Note = note.String
 	entry.CategoryID = categoryID.String
-	for dst, val := range map[*time.Time]sql.NullString{&entry.Start: start, &entry.End: end} {
-		if !val.Valid {
-			continue
-		} else if t, err := time.Parse(datetimeLayout, val.String); err != nil {
-			return nil, err
-		} else {
-			*dst = t
-		}
+	entry.Start = unixTime(start, startOff)
+	entry.End = unixTime(end, endOff)
+	return &entry, nil
+}
+
+// unixTime returns the time for the given unix timestamp in a fixed zone with
+// the given utc offset, or the zero time if the timestamp is null.
+func unixTime(sec, offset sql.NullInt64) time.Time {
+	if !sec.Valid {
+		return time.Time{}
 	}
-	return &entry, i.rows.Err()
+	return time.Unix(sec.Int64, 0).In(time.FixedZone("", int(offset.Int64)))
 }
 
 func (i *iterator) Close() error {
 	return i.rows.Close()
 }
 
+// Remove is part of the DB interface.
 func (d *db) Remove(id string) error {
-	_, err := d.Exec("DELETE FROM entries WHERE id=?", id)
+	return d.update(func(tx *sql.Tx) error {
+		old, err := txEntry(tx, "entries", id)
+		if err != nil {
+			return err
+		} else if res, err := tx.Exec("INSERT INTO trash SELECT "+entryColumns+", ? FROM entries WHERE id=?", time.Now().Unix(), id); err != nil {
+			return err
+		} else if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("entry does not exist: %s", id)
+		} else if _, err := tx.Exec("DELETE FROM entries WHERE id=?", id); err != nil {
+			return err
+		} else if _, err := tx.Exec("DELETE FROM entries_fts WHERE id=?", id); err != nil {
+			return err
+		}
+		return d.logRevision(tx, RevisionEntry, id, old, nil)
+	})
+}
+
+// Trash is part of the DB interface.
+func (d *db) Trash() ([]*TrashedEntry, error) {
+	rows, err := d.conn().Query("SELECT " + entrySelect("trash") + ", removed FROM trash ORDER BY removed DESC, start DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*TrashedEntry
+	for rows.Next() {
+		var removed int64
+		entry, err := scanEntry(rows, &removed)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &TrashedEntry{Entry: entry, Removed: time.Unix(removed, 0)})
+	}
+	return entries, rows.Err()
+}
+
+// Restore is part of the DB interface.
+func (d *db) Restore(id string) error {
+	return d.update(func(tx *sql.Tx) error {
+		if res, err := tx.Exec("INSERT INTO entries SELECT "+entryColumns+" FROM trash WHERE id=?", id); err != nil {
+			return err
+		} else if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("entry is not in trash: %s", id)
+		} else if _, err := tx.Exec("DELETE FROM trash WHERE id=?", id); err != nil {
+			return err
+		} else if _, err := tx.Exec("INSERT INTO entries_fts (id, note) SELECT id, note FROM entries WHERE id=?", id); err != nil {
+			return err
+		}
+		entry, err := txEntry(tx, "entries", id)
+		if err != nil {
+			return err
+		}
+		return d.logRevision(tx, RevisionEntry, id, nil, entry)
+	})
+}
+
+// Purge is part of the DB interface.
+func (d *db) Purge(before time.Time) (int, error) {
+	var n int64
+	err := d.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM entry_tags WHERE entry_id IN (SELECT id FROM trash WHERE removed <= ?)", before.Unix()); err != nil {
+			return err
+		} else if res, err := tx.Exec("DELETE FROM trash WHERE removed <= ?", before.Unix()); err != nil {
+			return err
+		} else {
+			n, err = res.RowsAffected()
+			return err
+		}
+	})
+	return int(n), err
+}
+
+// txEntry returns the entry with the given id from the given table, or nil if
+// it doesn't exist.
+func txEntry(tx *sql.Tx, table, id string) (*Entry, error) {
+	rows, err := tx.Query("SELECT "+entrySelect(table)+" FROM "+table+" WHERE id=?", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanEntry(rows)
+}
+
+// txCategory returns the category with the given id, or nil if it doesn't
+// exist.
+func txCategory(tx *sql.Tx, id string) (*Category, error) {
+	var (
+		c        = &Category{ID: id}
+		parentID sql.NullString
+	)
+	err := tx.QueryRow("SELECT name, parent_id FROM categories WHERE id=?", id).Scan(&c.Name, &parentID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	c.ParentID = parentID.String
+	return c, err
+}
+
+// logRevision appends a revision to the revision log, unless old and new are
+// equal. Either old or new may be nil, if the object was created or deleted.
+func (d *db) logRevision(tx *sql.Tx, kind, id string, old, new interface{}) error {
+	values, err := encodeRevision(old, new)
+	if err != nil || values[0] == values[1] {
+		return err
+	}
+	_, err = tx.Exec(
+		"INSERT INTO revisions (time, kind, object_id, old, new, command) VALUES (?, ?, ?, ?, ?, ?)",
+		time.Now().Unix(), kind, id, values[0], values[1], d.options.Command,
+	)
+	return err
+}
+
+// Revisions is part of the DB interface.
+func (d *db) Revisions(id string) ([]*Revision, error) {
+	q := "SELECT id, time, kind, object_id, old, new, command FROM revisions"
+	var args []interface{}
+	if id != "" {
+		q += " WHERE object_id=?"
+		args = append(args, id)
+	}
+	rows, err := d.conn().Query(q+" ORDER BY id DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revisions []*Revision
+	for rows.Next() {
+		var (
+			r        = &Revision{}
+			t        int64
+			old, new sql.NullString
+		)
+		if err := rows.Scan(&r.ID, &t, &r.Kind, &r.ObjectID, &old, &new, &r.Command); err != nil {
+			return nil, err
+		}
+		r.Time = time.Unix(t, 0)
+		if err := decodeRevision(r, [2]sql.NullString{old, new}); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, r)
+	}
+	return revisions, rows.Err()
+}
+
+// replaceRevisions is part of the historyCopier interface.
+func (d *db) replaceRevisions(revisions []*Revision) error {
+	return d.update(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM revisions"); err != nil {
+			return err
+		}
+		for _, r := range revisions {
+			values, err := encodeRevision(r.Old, r.New)
+			if err != nil {
+				return err
+			} else if _, err := tx.Exec(
+				"INSERT INTO revisions (id, time, kind, object_id, old, new, command) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				r.ID, r.Time.Unix(), r.Kind, r.ObjectID, values[0], values[1], r.Command,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// setRemoved is part of the historyCopier interface.
+func (d *db) setRemoved(id string, removed time.Time) error {
+	return d.update(func(tx *sql.Tx) error {
+		if res, err := tx.Exec("UPDATE trash SET removed=? WHERE id=?", removed.Unix(), id); err != nil {
+			return err
+		} else if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return fmt.Errorf("entry is not in trash: %s", id)
+		}
+		return nil
+	})
+}
+
+// encodeRevision returns the json encoding of the old and new value of a
+// revision. Nil values are encoded as null strings.
+func encodeRevision(old, new interface{}) ([2]sql.NullString, error) {
+	var values [2]sql.NullString
+	for i, val := range []interface{}{old, new} {
+		if val == nil || reflect.ValueOf(val).IsNil() {
+			continue
+		} else if data, err := json.Marshal(val); err != nil {
+			return values, err
+		} else {
+			values[i] = sql.NullString{String: string(data), Valid: true}
+		}
+	}
+	return values, nil
+}
+
+// decodeRevision sets the Old and New fields of r to the values encoded by
+// encodeRevision.
+func decodeRevision(r *Revision, values [2]sql.NullString) error {
+	for i, dst := range []*interface{}{&r.Old, &r.New} {
+		if !values[i].Valid {
+			continue
+		} else if obj, err := decodeRevisionValue(r.Kind, values[i].String); err != nil {
+			return err
+		} else {
+			*dst = obj
+		}
+	}
+	return nil
+}
+
+// decodeRevisionValue returns the *Entry or *Category of the given kind that
+// is encoded in data.
+func decodeRevisionValue(kind, data string) (interface{}, error) {
+	var obj interface{}
+	switch kind {
+	case RevisionEntry:
+		obj = &Entry{}
+	case RevisionCategory:
+		obj = &Category{}
+	default:
+		return nil, fmt.Errorf("bad revision kind: %s", kind)
+	}
+	return obj, json.Unmarshal([]byte(data), obj)
+}
+
+// updateRetries is the number of times update retries a transaction that
+// failed because the database was locked by another process beyond the busy
+// timeout.
+const updateRetries = 5
+
+// update calls fn within a transaction which is committed if fn returns nil,
+// or rolled back otherwise. If the database is locked, the whole transaction
+// is retried, so fn may be called more than once. If d belongs to a
+// Transaction, fn is called within a savepoint of it instead.
+func (d *db) update(fn func(*sql.Tx) error) error {
+	if d.tx != nil {
+		return savepoint(d.tx, fn)
+	}
+	var err error
+	for i := 0; i <= updateRetries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+		}
+		if err = d.tryUpdate(fn); !isBusy(err) {
+			break
+		}
+	}
+	return err
+}
+
+// tryUpdate is update without retries.
+func (d *db) tryUpdate(fn func(*sql.Tx) error) error {
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// savepoint calls fn within a savepoint of tx, which is rolled back if fn
+// returns an error, so a failed change doesn't leave partial changes in tx.
+func savepoint(tx *sql.Tx, fn func(*sql.Tx) error) error {
+	if _, err := tx.Exec("SAVEPOINT hiro"); err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		if _, rerr := tx.Exec("ROLLBACK TO hiro"); rerr != nil {
+			return rerr
+		}
+		tx.Exec("RELEASE hiro")
+		return err
+	}
+	_, err := tx.Exec("RELEASE hiro")
 	return err
 }
+
+// isBusy returns true if err was caused by another connection holding a lock
+// on the database.
+func isBusy(err error) bool {
+	serr, ok := err.(sqlite3.Error)
+	return ok && (serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked)
+}
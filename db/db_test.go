@@ -2,177 +2,15 @@ package db
 
 import (
 	"database/sql"
+	"io/ioutil"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/kylelemons/godebug/pretty"
-
-	"code.google.com/p/go-uuid/uuid"
 )
 
-// - Transactions
-// - Start and End are truncated.
-// - Record is validates
-// - ID is assigned on insert, kept on update
-// - Category id is resolved or created (if set)
-// - uuid assignment
-
-// - update
-
-// TestSaveEntry performs save operations and validates their results as well as the
-// resulting db state using Query.
-func TestSaveEntry(t *testing.T) {
-	diffConfig := &pretty.Config{Diffable: true, PrintStringers: true}
-	zone := time.FixedZone("", 3600)
-	start := time.Date(2015, 9, 2, 15, 36, 13, 123, zone)
-	tests := []struct {
-		Name    string
-		Entry   *Entry
-		WantErr string
-		Update  bool
-	}{
-		{
-			Name:    "validation is performed",
-			Entry:   &Entry{},
-			WantErr: "start is required",
-		},
-		{
-			Name:  "minimal valid entry",
-			Entry: &Entry{Start: start},
-		},
-		{
-			Name:  "start and end",
-			Entry: &Entry{Start: start, End: start.Add(time.Second)},
-		},
-		{
-			Name:   "update",
-			Entry:  &Entry{Start: start, End: start.Add(time.Second)},
-			Update: true,
-		},
-	}
-	for _, test := range tests {
-		var (
-			fixture = &Entry{Start: start.Add(-time.Second), End: start}
-			d       = mustDB(t)
-		)
-		if err := d.SaveEntry(fixture); err != nil {
-			t.Errorf("test %s: %s", test.Name, err)
-			continue
-		}
-		if test.Update {
-			test.Entry.ID = fixture.ID
-		}
-		var (
-			err    = d.SaveEntry(test.Entry)
-			gotErr string
-		)
-		if err != nil {
-			gotErr = err.Error()
-		}
-		if gotErr != test.WantErr {
-			t.Errorf("test %q: got=%q want=%q", test.Name, gotErr, test.WantErr)
-		} else if test.WantErr != "" {
-			continue
-		}
-		if uuid.Parse(test.Entry.ID) == nil {
-			t.Errorf("test %q: got=%q want uuid", test.Name, test.Entry.ID)
-		}
-		if got, want := test.Entry.Start, test.Entry.Start.Truncate(time.Second); !got.Equal(want) {
-			t.Errorf("test %q: got=%q want=%q", test.Name, got, want)
-		}
-		if got, want := test.Entry.End, test.Entry.End.Truncate(time.Second); !got.Equal(want) {
-			t.Errorf("test %q: got=%q want=%q", test.Name, got, want)
-		}
-		wantEntries := []*Entry{test.Entry}
-		if !test.Update {
-			wantEntries = append(wantEntries, fixture)
-		}
-		if itr, err := d.Query(Query{}); err != nil {
-			t.Errorf("test %q: %s", test.Name, err)
-		} else if entries, err := IteratorEntries(itr); err != nil {
-			t.Errorf("test %q: %s", test.Name, err)
-		} else if diff := diffConfig.Compare(entries, wantEntries); diff != "" {
-			t.Errorf("test %q: %s", test.Name, diff)
-		}
-	}
-}
-
-func TestGetOrCreateCategoryPath(t *testing.T) {
-	db := mustDB(t)
-	path, err := db.CategoryPath([]string{"a", "b", "c"}, true)
-	if err != nil {
-		t.Fatal(err)
-	}
-	wantPath := CategoryPath{
-		&Category{ID: path[0].ID, Name: "a"},
-		&Category{ID: path[1].ID, Name: "b", ParentID: path[0].ID},
-		&Category{ID: path[2].ID, Name: "c", ParentID: path[1].ID},
-	}
-	if diff := pretty.Compare(path, wantPath); diff != "" {
-		t.Fatal(diff)
-	} else if path2, err := db.CategoryPath([]string{"a", "b", "c"}, true); err != nil {
-		t.Fatal(err)
-	} else if diff := pretty.Compare(path2, wantPath); diff != "" {
-		t.Fatal(diff)
-	}
-	path3, err := db.CategoryPath([]string{"a", "d"}, true)
-	if err != nil {
-		t.Fatal(err)
-	}
-	wantPath = CategoryPath{
-		&Category{ID: path[0].ID, Name: "a"},
-		&Category{ID: path3[1].ID, Name: "d", ParentID: path[0].ID},
-	}
-	if diff := pretty.Compare(path3, wantPath); diff != "" {
-		t.Fatal(diff)
-	}
-	categories, err := db.Categories()
-	if err != nil {
-		t.Fatal(err)
-	}
-	wantCategories := CategoryMap{
-		path[0].ID:  path[0],
-		path[1].ID:  path[1],
-		path[2].ID:  path[2],
-		path3[1].ID: path3[1],
-	}
-	if diff := pretty.Compare(categories, wantCategories); diff != "" {
-		t.Fatal(diff)
-	}
-	// @TODO check actual error
-	if _, err := db.CategoryPath([]string{"a", "e"}, false); err == nil {
-		t.Fatal("expected does not exist error")
-	}
-}
-
-func TestCategories(t *testing.T) {
-	db := mustDB(t)
-	a := &Category{Name: "a"}
-	if err := db.SaveCategory(a); err != nil {
-		t.Fatal(err)
-	}
-	b := &Category{Name: "b", ParentID: a.ID}
-	if err := db.SaveCategory(b); err != nil {
-		t.Fatal(err)
-	}
-	want := CategoryMap{a.ID: a, b.ID: b}
-	if got, err := db.Categories(); err != nil {
-		t.Error(err)
-	} else if diff := pretty.Compare(got, want); diff != "" {
-		t.Fatal(diff)
-	}
-	a.Name, b.Name = "c", "d"
-	if err := db.SaveCategory(a); err != nil {
-		t.Fatal(err)
-	} else if err := db.SaveCategory(b); err != nil {
-		t.Fatal(err)
-	} else if got, err := db.Categories(); err != nil {
-		t.Error(err)
-	} else if diff := pretty.Compare(got, want); diff != "" {
-		t.Fatal(diff)
-	}
-}
-
 func TestCategoryMap_Root(t *testing.T) {
 	tests := []struct {
 		Name string
@@ -295,11 +133,75 @@ func TestCategoryMap_Path(t *testing.T) {
 	}
 }
 
+func TestSQLite(t *testing.T) {
+	testConformance(t, func(t *testing.T, o Options) DB {
+		d := mustDB(t)
+		d.(*db).options = o
+		return d
+	})
+}
+
+func TestNew_concurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// every writer opens the db on its own, like separate hiro processes do
+	const writers, perWriter = 4, 25
+	var (
+		wg   sync.WaitGroup
+		errs = make(chan error, writers)
+		base = time.Date(2015, 9, 1, 0, 0, 0, 0, time.UTC)
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			d, err := New(dir, Options{})
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer d.Close()
+			for i := 0; i < perWriter; i++ {
+				start := base.Add(time.Duration(w*perWriter+i) * time.Hour)
+				if err := d.SaveEntry(&Entry{Start: start, End: start.Add(time.Minute)}); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	d, err := New(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	itr, err := d.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := IteratorEntries(itr)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(entries) != writers*perWriter {
+		t.Fatalf("got=%d entries want=%d", len(entries), writers*perWriter)
+	}
+}
+
 func mustDB(t *testing.T) DB {
 	sqlLite, err := sql.Open("sqlite3", ":memory:")
 	if err != nil {
 		t.Fatal(err)
 	}
+	// every connection to :memory: opens a separate database
+	sqlLite.SetMaxOpenConns(1)
 	db := &db{DB: sqlLite}
 	if err := db.init(); err != nil {
 		t.Fatal(err)
@@ -0,0 +1,604 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// DumpVersion is the version of the dump format written by WriteJSON and
+// WriteNDJSON. It's increased whenever the format changes in a way that
+// older versions of hiro can't read. Version 1 dumps have no trash.
+const DumpVersion = 2
+
+// dumpTimeLayout is the layout of the times in a dump, which keeps their UTC
+// offset.
+const dumpTimeLayout = time.RFC3339
+
+// Dump is the json representation of a database, holding all categories and
+// entries, including the entries in the trash. The revision log is not part
+// of it.
+//
+//	{
+//	  "version": 2,
+//	  "categories": [
+//	    {"id": "3a0e...", "name": "Work"},
+//	    {"id": "9f12...", "parent_id": "3a0e...", "name": "Client"}
+//	  ],
+//	  "entries": [
+//	    {
+//	      "id": "c7d1...",
+//	      "category_id": "9f12...",
+//	      "start": "2015-06-01T09:00:00+02:00",
+//	      "end": "2015-06-01T10:30:00+02:00",
+//	      "note": "Kickoff",
+//	      "tags": ["meeting"]
+//	    }
+//	  ],
+//	  "trash": [
+//	    {
+//	      "id": "e5a2...",
+//	      "start": "2015-06-01T11:00:00+02:00",
+//	      "removed": "2015-06-02T08:00:00Z"
+//	    }
+//	  ]
+//	}
+//
+// Categories are ordered so that parents come before their children, entries
+// are ordered by start and the trash by removal time, latest first. The end
+// of running entries is omitted.
+type Dump struct {
+	Version    int                 `json:"version"`
+	Categories []*DumpCategory     `json:"categories"`
+	Entries    []*DumpEntry        `json:"entries"`
+	Trash      []*DumpTrashedEntry `json:"trash"`
+}
+
+// DumpCategory is the json representation of a Category.
+type DumpCategory struct {
+	ID       string `json:"id"`
+	ParentID string `json:"parent_id,omitempty"`
+	Name     string `json:"name"`
+}
+
+// DumpEntry is the json representation of an Entry.
+type DumpEntry struct {
+	ID         string   `json:"id"`
+	CategoryID string   `json:"category_id,omitempty"`
+	Start      string   `json:"start"`
+	End        string   `json:"end,omitempty"`
+	Note       string   `json:"note,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+}
+
+// NewDumpEntry returns the json representation of e.
+func NewDumpEntry(e *Entry) *DumpEntry {
+	de := &DumpEntry{
+		ID:         e.ID,
+		CategoryID: e.CategoryID,
+		Start:      e.Start.Format(dumpTimeLayout),
+		Note:       e.Note,
+		Tags:       e.Tags,
+	}
+	if !e.End.IsZero() {
+		de.End = e.End.Format(dumpTimeLayout)
+	}
+	return de
+}
+
+// Entry returns the entry represented by de, or an error if its times can't
+// be parsed.
+func (de *DumpEntry) Entry() (*Entry, error) {
+	if de.ID == "" {
+		return nil, errors.New("entry has no id")
+	}
+	e := &Entry{ID: de.ID, CategoryID: de.CategoryID, Note: de.Note, Tags: NormalizeTags(de.Tags)}
+	start, err := time.Parse(dumpTimeLayout, de.Start)
+	if err != nil {
+		return nil, fmt.Errorf("entry %s: bad start: %s", de.ID, de.Start)
+	}
+	e.Start = fixedZone(start)
+	if de.End != "" {
+		end, err := time.Parse(dumpTimeLayout, de.End)
+		if err != nil {
+			return nil, fmt.Errorf("entry %s: bad end: %s", de.ID, de.End)
+		}
+		e.End = fixedZone(end)
+	}
+	return e, nil
+}
+
+// DumpTrashedEntry is the json representation of a TrashedEntry.
+type DumpTrashedEntry struct {
+	DumpEntry
+	Removed string `json:"removed"`
+}
+
+// NewDumpTrashedEntry returns the json representation of e. The removal time
+// is written in UTC.
+func NewDumpTrashedEntry(e *TrashedEntry) *DumpTrashedEntry {
+	return &DumpTrashedEntry{DumpEntry: *NewDumpEntry(e.Entry), Removed: e.Removed.UTC().Format(dumpTimeLayout)}
+}
+
+// TrashedEntry returns the trashed entry represented by de, or an error if
+// its times can't be parsed.
+func (de *DumpTrashedEntry) TrashedEntry() (*TrashedEntry, error) {
+	e, err := de.Entry()
+	if err != nil {
+		return nil, err
+	}
+	removed, err := time.Parse(dumpTimeLayout, de.Removed)
+	if err != nil {
+		return nil, fmt.Errorf("entry %s: bad removal time: %s", de.ID, de.Removed)
+	}
+	return &TrashedEntry{Entry: e, Removed: removed}, nil
+}
+
+// dumpCategories returns the categories of d, parents before their children.
+func dumpCategories(d DB) ([]*DumpCategory, error) {
+	categories, err := d.Categories()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		dump []*DumpCategory
+		walk func(*CategoryNode)
+	)
+	walk = func(node *CategoryNode) {
+		for _, child := range node.Children {
+			dump = append(dump, &DumpCategory{ID: child.ID, ParentID: child.ParentID, Name: child.Name})
+			walk(child)
+		}
+	}
+	walk(categories.Root())
+	return dump, nil
+}
+
+// NewDump returns the dump of all categories and entries of d, including the
+// trash.
+func NewDump(d DB) (*Dump, error) {
+	categories, err := dumpCategories(d)
+	if err != nil {
+		return nil, err
+	}
+	itr, err := d.Query(Query{Asc: true})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := IteratorEntries(itr)
+	if err != nil {
+		return nil, err
+	}
+	trash, err := d.Trash()
+	if err != nil {
+		return nil, err
+	}
+	dump := &Dump{Version: DumpVersion, Categories: categories, Entries: []*DumpEntry{}, Trash: []*DumpTrashedEntry{}}
+	if dump.Categories == nil {
+		dump.Categories = []*DumpCategory{}
+	}
+	for _, e := range entries {
+		dump.Entries = append(dump.Entries, NewDumpEntry(e))
+	}
+	for _, e := range trash {
+		dump.Trash = append(dump.Trash, NewDumpTrashedEntry(e))
+	}
+	return dump, nil
+}
+
+// WriteJSON writes the dump of d to w as a single json document.
+func WriteJSON(w io.Writer, d DB) error {
+	dump, err := NewDump(d)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// NDJSON record types, see WriteNDJSON.
+const (
+	ndjsonHeader   = "hiro"
+	ndjsonCategory = "category"
+	ndjsonEntry    = "entry"
+	ndjsonTrash    = "trash"
+)
+
+// WriteNDJSON writes the dump of d to w as newline delimited json, one record
+// per line. Every record has a type, the first one is the header holding the
+// version, followed by the categories, entries and trash of the Dump format:
+//
+//	{"type":"hiro","version":2}
+//	{"type":"category","id":"3a0e...","name":"Work"}
+//	{"type":"entry","id":"c7d1...","start":"2015-06-01T09:00:00+02:00"}
+//	{"type":"trash","id":"e5a2...","start":"2015-06-01T11:00:00+02:00","removed":"2015-06-02T08:00:00Z"}
+//
+// The entries are streamed from d, so large databases can be written without
+// holding them in memory.
+func WriteNDJSON(w io.Writer, d DB) error {
+	categories, err := dumpCategories(d)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(struct {
+		Type    string `json:"type"`
+		Version int    `json:"version"`
+	}{ndjsonHeader, DumpVersion}); err != nil {
+		return err
+	}
+	for _, c := range categories {
+		if err := enc.Encode(struct {
+			Type string `json:"type"`
+			*DumpCategory
+		}{ndjsonCategory, c}); err != nil {
+			return err
+		}
+	}
+	if err := writeNDJSONEntries(enc, d); err != nil {
+		return err
+	}
+	trash, err := d.Trash()
+	if err != nil {
+		return err
+	}
+	for _, e := range trash {
+		if err := enc.Encode(struct {
+			Type string `json:"type"`
+			*DumpTrashedEntry
+		}{ndjsonTrash, NewDumpTrashedEntry(e)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeNDJSONEntries streams the entry records of d to enc.
+func writeNDJSONEntries(enc *json.Encoder, d DB) error {
+	itr, err := d.Query(Query{Asc: true})
+	if err != nil {
+		return err
+	}
+	defer itr.Close()
+	for {
+		e, err := itr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := enc.Encode(struct {
+			Type string `json:"type"`
+			*DumpEntry
+		}{ndjsonEntry, NewDumpEntry(e)}); err != nil {
+			return err
+		}
+	}
+}
+
+// checkDumpVersion returns an error if the given dump version can't be read.
+func checkDumpVersion(version int) error {
+	if version < 1 || version > DumpVersion {
+		return fmt.Errorf("unsupported dump version: %d", version)
+	}
+	return nil
+}
+
+// ReadJSON reads a dump written by WriteJSON from r.
+func ReadJSON(r io.Reader) (*Dump, error) {
+	dump := &Dump{}
+	if err := json.NewDecoder(r).Decode(dump); err != nil {
+		return nil, err
+	}
+	return dump, checkDumpVersion(dump.Version)
+}
+
+// ReadNDJSON reads a dump written by WriteNDJSON from r. Errors are prefixed
+// with the number of the line they occurred at.
+func ReadNDJSON(r io.Reader) (*Dump, error) {
+	var (
+		dump = &Dump{}
+		// bufio.Scanner is not used as notes can exceed its line limit
+		br = bufio.NewReader(r)
+	)
+	for n := 1; ; n++ {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		var record struct {
+			Type    string `json:"type"`
+			Version int    `json:"version"`
+		}
+		if err := json.Unmarshal(line, &record); err != nil {
+			return nil, fmt.Errorf("%d: %s", n, err)
+		} else if dump.Version == 0 && record.Type != ndjsonHeader {
+			return nil, fmt.Errorf("%d: missing %s header", n, ndjsonHeader)
+		}
+		switch record.Type {
+		case ndjsonHeader:
+			if dump.Version != 0 {
+				err = errors.New("unexpected header")
+			} else {
+				dump.Version = record.Version
+				err = checkDumpVersion(dump.Version)
+			}
+		case ndjsonCategory:
+			c := &DumpCategory{}
+			err = json.Unmarshal(line, c)
+			dump.Categories = append(dump.Categories, c)
+		case ndjsonEntry:
+			e := &DumpEntry{}
+			err = json.Unmarshal(line, e)
+			dump.Entries = append(dump.Entries, e)
+		case ndjsonTrash:
+			e := &DumpTrashedEntry{}
+			err = json.Unmarshal(line, e)
+			dump.Trash = append(dump.Trash, e)
+		default:
+			err = fmt.Errorf("unknown record type: %q", record.Type)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%d: %s", n, err)
+		}
+	}
+	if dump.Version == 0 {
+		return nil, fmt.Errorf("missing %s header", ndjsonHeader)
+	}
+	return dump, nil
+}
+
+// ImportResult holds the number of objects changed by Import.
+type ImportResult struct {
+	// Categories and Entries are the number of created or updated objects.
+	Categories, Entries int
+	// Unchanged is the number of objects that already existed as they are.
+	Unchanged int
+}
+
+// Import saves the categories and entries of dump into d within a single
+// transaction. Objects are identified by their ids, so existing objects are
+// updated and importing the same dump again changes nothing. Entries in the
+// trash are restored before they are updated, and the trashed entries of
+// the dump are moved into the trash, keeping their removal time. Trashed
+// entries lose their category if it doesn't exist. Entries are imported
+// exactly as they are, overlaps are allowed regardless of the OverlapPolicy
+// of d, unless d is implemented outside of this package, which applies its
+// own and sets the removal time to the time of the import.
+func Import(d DB, dump *Dump) (*ImportResult, error) {
+	if err := checkDumpVersion(dump.Version); err != nil {
+		return nil, err
+	}
+	var result *ImportResult
+	err := d.Transaction(func(tx DB) error {
+		result = &ImportResult{}
+		if err := importCategories(tx, dump.Categories, result); err != nil {
+			return err
+		}
+		return importEntries(tx, dump.Entries, dump.Trash, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// importCategories saves the given categories into d, parents before their
+// children.
+func importCategories(d DB, categories []*DumpCategory, result *ImportResult) error {
+	existing, err := d.Categories()
+	if err != nil {
+		return err
+	}
+	byID := make(map[string]*DumpCategory, len(categories))
+	for _, c := range categories {
+		if c.ID == "" {
+			return errors.New("category has no id")
+		} else if byID[c.ID] != nil {
+			return fmt.Errorf("duplicate category: %s", c.ID)
+		}
+		byID[c.ID] = c
+	}
+	// visiting holds the categories whose parents are being saved, which
+	// detects cycles, and done the ones that have been saved.
+	var (
+		visiting = make(map[string]bool)
+		done     = make(map[string]bool)
+		save     func(*DumpCategory) error
+	)
+	save = func(c *DumpCategory) error {
+		if done[c.ID] {
+			return nil
+		} else if visiting[c.ID] {
+			return fmt.Errorf("category is its own ancestor: %s", c.ID)
+		}
+		visiting[c.ID] = true
+		if parent := byID[c.ParentID]; parent != nil {
+			if err := save(parent); err != nil {
+				return err
+			}
+		} else if c.ParentID != "" && existing[c.ParentID] == nil {
+			return fmt.Errorf("parent of category %s does not exist: %s", c.ID, c.ParentID)
+		}
+		done[c.ID] = true
+		if old := existing[c.ID]; old != nil && old.Name == c.Name && old.ParentID == c.ParentID {
+			result.Unchanged++
+			return nil
+		}
+		result.Categories++
+		return d.SaveCategory(&Category{ID: c.ID, ParentID: c.ParentID, Name: c.Name})
+	}
+	for _, c := range categories {
+		if err := save(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importEntries saves the given entries into d, and moves the given trashed
+// entries into its trash.
+func importEntries(d DB, entries []*DumpEntry, trash []*DumpTrashedEntry, result *ImportResult) error {
+	var (
+		ids      []string
+		imported = make([]*Entry, len(entries))
+		removed  = make([]*TrashedEntry, len(trash))
+	)
+	for i, de := range entries {
+		e, err := de.Entry()
+		if err != nil {
+			return err
+		}
+		ids, imported[i] = append(ids, e.ID), e
+	}
+	for i, de := range trash {
+		e, err := de.TrashedEntry()
+		if err != nil {
+			return err
+		}
+		ids, removed[i] = append(ids, e.ID), e
+	}
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			return fmt.Errorf("duplicate entry: %s", id)
+		}
+		seen[id] = true
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		return err
+	}
+	for _, e := range removed {
+		if categories[e.CategoryID] == nil {
+			e.CategoryID = ""
+		}
+	}
+	for _, e := range append(imported, trashedEntries(removed)...) {
+		if err := normalizeEntry(e); err != nil {
+			return fmt.Errorf("entry %s: %s", e.ID, err)
+		}
+	}
+	existing, err := entriesByID(d, ids)
+	if err != nil {
+		return err
+	}
+	current, err := d.Trash()
+	if err != nil {
+		return err
+	}
+	trashed := make(map[string]*TrashedEntry, len(current))
+	for _, e := range current {
+		trashed[e.ID] = e
+	}
+	for _, e := range imported {
+		if old := existing[e.ID]; old != nil && sameEntry(old, e) {
+			result.Unchanged++
+			continue
+		} else if trashed[e.ID] != nil {
+			if err := d.Restore(e.ID); err != nil {
+				return err
+			}
+		}
+		if err := importEntry(d, e); err != nil {
+			return fmt.Errorf("entry %s: %s", e.ID, err)
+		}
+		result.Entries++
+	}
+	history, _ := d.(historyCopier)
+	for _, e := range removed {
+		if old := trashed[e.ID]; old != nil && sameEntry(old.Entry, e.Entry) && old.Removed.Unix() == e.Removed.Unix() {
+			result.Unchanged++
+			continue
+		} else if old != nil {
+			if err := d.Restore(e.ID); err != nil {
+				return err
+			}
+		}
+		if err := importEntry(d, e.Entry); err != nil {
+			return fmt.Errorf("entry %s: %s", e.ID, err)
+		} else if err := d.Remove(e.ID); err != nil {
+			return err
+		} else if history != nil {
+			if err := history.setRemoved(e.ID, e.Removed); err != nil {
+				return err
+			}
+		}
+		result.Entries++
+	}
+	return nil
+}
+
+// trashedEntries returns the entries of the given trashed entries.
+func trashedEntries(trash []*TrashedEntry) []*Entry {
+	entries := make([]*Entry, len(trash))
+	for i, e := range trash {
+		entries[i] = e.Entry
+	}
+	return entries
+}
+
+// importEntry saves e into d, allowing overlaps if d is an overlapSaver.
+// Otherwise overlaps are only an error if they prevented saving e.
+func importEntry(d DB, e *Entry) error {
+	if s, ok := d.(overlapSaver); ok {
+		return s.saveEntryWith(e, OverlapAllow)
+	}
+	err := d.SaveEntry(e)
+	if oerr, ok := err.(*OverlapError); ok && oerr.Saved {
+		return nil
+	}
+	return err
+}
+
+// maxQueryIDs is the maximum number of ids passed to a single query by
+// entriesByID, which keeps sqlite below its limit of query parameters.
+const maxQueryIDs = 500
+
+// entriesByID returns the entries of d with the given ids by id, querying
+// them in batches of maxQueryIDs.
+func entriesByID(d DB, ids []string) (map[string]*Entry, error) {
+	entries := make(map[string]*Entry, len(ids))
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxQueryIDs {
+			n = maxQueryIDs
+		}
+		itr, err := d.Query(Query{IDs: ids[:n]})
+		if err != nil {
+			return nil, err
+		}
+		found, err := IteratorEntries(itr)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range found {
+			entries[e.ID] = e
+		}
+		ids = ids[n:]
+	}
+	return entries, nil
+}
+
+// sameEntry returns true if a and b are equal, including the UTC offsets of
+// their times.
+func sameEntry(a, b *Entry) bool {
+	_, aStart := a.Start.Zone()
+	_, bStart := b.Start.Zone()
+	_, aEnd := a.End.Zone()
+	_, bEnd := b.End.Zone()
+	return a.Equal(b) && aStart == bStart && aEnd == bEnd
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestDump(t *testing.T) {
+	src := mustDB(t)
+	path, err := src.CategoryPath([]string{"Work", "Client"}, true)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := src.CategoryPath([]string{"Home"}, true); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.FixedZone("", 2*3600))
+	entries := []*Entry{
+		{Start: start, End: start.Add(time.Hour).In(time.FixedZone("", -5*3600)), CategoryID: path[1].ID, Note: "a\n\"b\"", Tags: []string{"x", "y"}},
+		{Start: start.Add(2 * time.Hour), End: start.Add(3 * time.Hour), CategoryID: path[0].ID},
+		{Start: start.Add(4 * time.Hour).UTC()},
+		{Start: start.Add(-2 * time.Hour), End: start.Add(-time.Hour), CategoryID: path[1].ID, Note: "removed", Tags: []string{"z"}},
+	}
+	for _, e := range entries {
+		if err := src.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Remove(entries[3].ID); err != nil {
+		t.Fatal(err)
+	} else if err := src.(historyCopier).setRemoved(entries[3].ID, start.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	for name, format := range map[string]struct {
+		Write func(io.Writer, DB) error
+		Read  func(io.Reader) (*Dump, error)
+	}{
+		"json":   {WriteJSON, ReadJSON},
+		"ndjson": {WriteNDJSON, ReadNDJSON},
+	} {
+		var want bytes.Buffer
+		if err := format.Write(&want, src); err != nil {
+			t.Fatal(err)
+		}
+		dst := NewMemory(Options{})
+		for i, wantResult := range []ImportResult{
+			{Categories: 3, Entries: 4},
+			{Unchanged: 7},
+		} {
+			dump, err := format.Read(bytes.NewReader(want.Bytes()))
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			result, err := Import(dst, dump)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			} else if *result != wantResult {
+				t.Errorf("%s: import %d: got=%+v want=%+v", name, i, *result, wantResult)
+			}
+		}
+		var got bytes.Buffer
+		if err := format.Write(&got, dst); err != nil {
+			t.Fatal(err)
+		} else if got.String() != want.String() {
+			t.Errorf("%s: got=%s want=%s", name, got.String(), want.String())
+		} else if dump, err := format.Read(&got); err != nil {
+			t.Fatal(err)
+		} else if len(dump.Trash) != 1 || dump.Trash[0].Note != "removed" || dump.Trash[0].Removed != "2015-06-02T07:00:00Z" {
+			t.Errorf("%s: got trash=%v want the removed entry", name, dump.Trash)
+		}
+	}
+}
+
+func TestImport_trash(t *testing.T) {
+	d := NewMemory(Options{})
+	e := &Entry{Start: time.Unix(1433149200, 0).UTC(), Note: "a"}
+	if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := NewDump(d)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := d.Remove(e.ID); err != nil {
+		t.Fatal(err)
+	}
+	dump.Entries[0].Note = "b"
+	if _, err := Import(d, dump); err != nil {
+		t.Fatal(err)
+	} else if got, err := d.Trash(); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("got %d entries in trash want 0", len(got))
+	}
+	itr, err := d.Query(Query{IDs: []string{e.ID}})
+	if err != nil {
+		t.Fatal(err)
+	} else if entries, err := IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || entries[0].Note != "b" {
+		t.Fatalf("got=%v want the imported entry", entries)
+	}
+}
+
+func TestImport_trashCategory(t *testing.T) {
+	d := NewMemory(Options{})
+	removed := time.Date(2015, 6, 2, 8, 0, 0, 0, time.UTC)
+	dump := &Dump{Version: DumpVersion, Trash: []*DumpTrashedEntry{{
+		DumpEntry: DumpEntry{ID: "a", CategoryID: "deleted", Start: "2015-06-01T09:00:00Z"},
+		Removed:   removed.Format(dumpTimeLayout),
+	}}}
+	for _, want := range []ImportResult{{Entries: 1}, {Unchanged: 1}} {
+		if result, err := Import(d, dump); err != nil {
+			t.Fatal(err)
+		} else if *result != want {
+			t.Fatalf("got=%+v want=%+v", *result, want)
+		}
+	}
+	if trash, err := d.Trash(); err != nil {
+		t.Fatal(err)
+	} else if len(trash) != 1 || trash[0].CategoryID != "" || !trash[0].Removed.Equal(removed) {
+		t.Fatalf("got=%v want the entry without category removed at %s", trash, removed)
+	}
+	dump.Entries = []*DumpEntry{{ID: "a", Start: "2015-06-01T09:00:00Z"}}
+	if _, err := Import(d, dump); err == nil || err.Error() != "duplicate entry: a" {
+		t.Errorf("got=%v want duplicate entry error", err)
+	}
+}
+
+func TestImport_overlap(t *testing.T) {
+	src := NewMemory(Options{})
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.UTC)
+	for _, e := range []*Entry{
+		{Start: start, End: start.Add(3 * time.Hour)},
+		{Start: start.Add(time.Hour), End: start.Add(2 * time.Hour)},
+		{Start: start.Add(2 * time.Hour)},
+	} {
+		if err := src.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want bytes.Buffer
+	if err := WriteJSON(&want, src); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := ReadJSON(bytes.NewReader(want.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := NewMemory(Options{Overlap: OverlapTrim})
+	if _, err := Import(dst, dump); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if err := WriteJSON(&got, dst); err != nil {
+		t.Fatal(err)
+	} else if got.String() != want.String() {
+		t.Errorf("got=%s want=%s", got.String(), want.String())
+	}
+	// the policy of dst is kept after the import
+	e := &Entry{Start: start.Add(30 * time.Minute), End: start.Add(45 * time.Minute)}
+	if err := dst.SaveEntry(e); err == nil {
+		t.Error("expected overlap error")
+	}
+	// other implementations apply their own policy
+	if _, err := Import(foreignDB{NewMemory(Options{Overlap: OverlapWarn})}, dump); err != nil {
+		t.Error(err)
+	} else if _, err := Import(foreignDB{NewMemory(Options{Overlap: OverlapReject})}, dump); err == nil {
+		t.Error("expected overlap error")
+	}
+}
+
+// foreignDB hides the unexported methods of the wrapped DB, like a DB
+// implemented outside of this package.
+type foreignDB struct {
+	DB
+}
+
+func (f foreignDB) Transaction(fn func(DB) error) error {
+	return f.DB.Transaction(func(tx DB) error {
+		return fn(foreignDB{tx})
+	})
+}
+
+func TestReadNDJSON_errors(t *testing.T) {
+	tests := []struct{ Data, Err string }{
+		{"", "missing hiro header"},
+		{`{"type":"entry","id":"a"}`, "1: missing hiro header"},
+		{`{"type":"hiro","version":3}`, "1: unsupported dump version: 3"},
+		{"{\"type\":\"hiro\",\"version\":1}\n{\"type\":\"hiro\",\"version\":1}", "2: unexpected header"},
+		{"{\"type\":\"hiro\",\"version\":1}\n\n{\"type\":\"revision\"}", "3: unknown record type: \"revision\""},
+	}
+	for _, test := range tests {
+		if _, err := ReadNDJSON(strings.NewReader(test.Data)); err == nil || err.Error() != test.Err {
+			t.Errorf("%q: got=%v want=%s", test.Data, err, test.Err)
+		}
+	}
+}
+
+// sqliteMaxVariables is the default limit of query parameters of sqlite
+// before 3.32, which the "sqlite3_max_variables" driver applies.
+const sqliteMaxVariables = 999
+
+func init() {
+	sql.Register("sqlite3_max_variables", &sqlite3.SQLiteDriver{
+		ConnectHook: func(c *sqlite3.SQLiteConn) error {
+			c.SetLimit(sqlite3.SQLITE_LIMIT_VARIABLE_NUMBER, sqliteMaxVariables)
+			return nil
+		},
+	})
+}
+
+func TestImport_many(t *testing.T) {
+	sqlLite, err := sql.Open("sqlite3_max_variables", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlLite.SetMaxOpenConns(1)
+	d := &db{DB: sqlLite}
+	if err := d.init(); err != nil {
+		t.Fatal(err)
+	}
+	// more entries than sqlite accepts as parameters of a single query
+	const n = sqliteMaxVariables + 1
+	dump := &Dump{Version: DumpVersion}
+	start := time.Date(2015, 6, 1, 9, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		e := &Entry{ID: fmt.Sprintf("%04d", i), Start: start.Add(time.Duration(i) * time.Hour)}
+		e.End = e.Start.Add(time.Minute)
+		dump.Entries = append(dump.Entries, NewDumpEntry(e))
+	}
+	for _, want := range []ImportResult{{Entries: n}, {Unchanged: n}} {
+		if result, err := Import(d, dump); err != nil {
+			t.Fatal(err)
+		} else if *result != want {
+			t.Fatalf("got=%+v want=%+v", *result, want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/bradfitz/slice"
+)
+
+// Kinds of problems found by Check.
+const (
+	// ProblemBadTime is an entry whose start or end time can't be read. IDs
+	// holds the id of the entry.
+	ProblemBadTime = "bad time"
+	// ProblemDuplicateCategory are categories with the same name and parent.
+	// IDs holds their ids, the first one is kept by Repair.
+	ProblemDuplicateCategory = "duplicate category"
+	// ProblemActiveEntries are multiple entries without an end time. IDs holds
+	// their ids ordered by start.
+	ProblemActiveEntries = "multiple active entries"
+	// ProblemMissingCategory is a category that entries or sub categories refer
+	// to, but which doesn't exist. IDs holds the id of the missing category.
+	ProblemMissingCategory = "missing category"
+)
+
+// Problem is an integrity problem of a database.
+type Problem struct {
+	// Kind is the kind of the problem, e.g. ProblemBadTime.
+	Kind string
+	// IDs holds the ids of the entries or categories affected by the problem.
+	IDs []string
+	// Detail describes the problem.
+	Detail string
+	// Fixable is true if the problem can be fixed by Repair.
+	Fixable bool
+}
+
+// rawChecker is implemented by databases that may hold entries which can't
+// be read by Query.
+type rawChecker interface {
+	// checkEntries returns all readable entries ordered by start, and a
+	// ProblemBadTime for every entry that can't be read.
+	checkEntries() ([]*Entry, []*Problem, error)
+	// repairTime converts the unreadable times of the entry with the given id.
+	repairTime(id string) error
+}
+
+// Check scans d for integrity problems and returns them, or an error. The
+// problems are ordered so they can be repaired one after another.
+func Check(d DB) ([]*Problem, error) {
+	var (
+		entries  []*Entry
+		problems []*Problem
+	)
+	if raw, ok := d.(rawChecker); ok {
+		var err error
+		if entries, problems, err = raw.checkEntries(); err != nil {
+			return nil, err
+		}
+	} else if itr, err := d.Query(Query{Asc: true}); err != nil {
+		return nil, err
+	} else if entries, err = IteratorEntries(itr); err != nil {
+		return nil, err
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		return nil, err
+	}
+	problems = append(problems, checkDuplicates(categories)...)
+	missing := make(map[string][2]int)
+	for _, c := range categories {
+		if c.ParentID != "" && categories[c.ParentID] == nil {
+			refs := missing[c.ParentID]
+			refs[0]++
+			missing[c.ParentID] = refs
+		}
+	}
+	for _, e := range entries {
+		if e.CategoryID != "" && categories[e.CategoryID] == nil {
+			refs := missing[e.CategoryID]
+			refs[1]++
+			missing[e.CategoryID] = refs
+		}
+	}
+	var missingIDs []string
+	for id := range missing {
+		missingIDs = append(missingIDs, id)
+	}
+	sort.Strings(missingIDs)
+	for _, id := range missingIDs {
+		problems = append(problems, &Problem{
+			Kind:    ProblemMissingCategory,
+			IDs:     []string{id},
+			Detail:  fmt.Sprintf("used by %d categories and %d entries", missing[id][0], missing[id][1]),
+			Fixable: true,
+		})
+	}
+	var active []string
+	for _, e := range entries {
+		if e.End.IsZero() {
+			active = append(active, e.ID)
+		}
+	}
+	if len(active) > 1 {
+		problems = append(problems, &Problem{
+			Kind:    ProblemActiveEntries,
+			IDs:     active,
+			Detail:  fmt.Sprintf("%d entries are running", len(active)),
+			Fixable: true,
+		})
+	}
+	return problems, nil
+}
+
+// checkDuplicates returns a ProblemDuplicateCategory for every set of
+// categories with the same name and parent.
+func checkDuplicates(categories CategoryMap) []*Problem {
+	var (
+		problems []*Problem
+		walk     func(*CategoryNode)
+	)
+	walk = func(node *CategoryNode) {
+		for i := 0; i < len(node.Children); {
+			// children are ordered by name
+			j := i + 1
+			for j < len(node.Children) && node.Children[j].Name == node.Children[i].Name {
+				j++
+			}
+			if j-i > 1 {
+				var ids []string
+				for _, child := range node.Children[i:j] {
+					ids = append(ids, child.ID)
+				}
+				sort.Strings(ids)
+				problems = append(problems, &Problem{
+					Kind:    ProblemDuplicateCategory,
+					IDs:     ids,
+					Detail:  fmt.Sprintf("%q exists %d times", node.Children[i].Name, j-i),
+					Fixable: true,
+				})
+			}
+			i = j
+		}
+		for _, child := range node.Children {
+			walk(child)
+		}
+	}
+	walk(categories.Root())
+	return problems
+}
+
+// Repair fixes the given problem returned by Check, or returns an error.
+// Unreadable times are converted if they can be parsed, duplicate categories
+// are merged into the first one, all but the last active entry end when the
+// next one starts, or are moved into the trash if it starts at the same time,
+// and missing categories are recreated as root categories
+// named after their id, so they can be renamed or merged afterwards. The
+// problem is either repaired completely or not at all.
+func Repair(d DB, p *Problem) error {
+	if !p.Fixable {
+		return fmt.Errorf("%s can't be repaired: %s", p.Kind, p.Detail)
+	}
+	return d.Transaction(func(d DB) error {
+		switch p.Kind {
+		case ProblemBadTime:
+			raw, ok := d.(rawChecker)
+			if !ok {
+				return fmt.Errorf("%s can't be repaired for this db", p.Kind)
+			}
+			return raw.repairTime(p.IDs[0])
+		case ProblemDuplicateCategory:
+			for _, id := range p.IDs[1:] {
+				if err := d.MergeCategory(id, p.IDs[0]); err != nil {
+					return err
+				}
+			}
+			return nil
+		case ProblemActiveEntries:
+			itr, err := d.Query(Query{IDs: p.IDs, Asc: true})
+			if err != nil {
+				return err
+			}
+			entries, err := IteratorEntries(itr)
+			if err != nil {
+				return err
+			}
+			slice.Sort(entries, func(i, j int) bool { return entryLess(entries[i], entries[j]) })
+			for i := 0; i < len(entries)-1; i++ {
+				if !entries[i+1].Start.After(entries[i].Start) {
+					// ending the entry would leave it without a duration
+					if err := d.Remove(entries[i].ID); err != nil {
+						return err
+					}
+					continue
+				}
+				entries[i].End = entries[i+1].Start
+				err := d.SaveEntry(entries[i])
+				if oerr, ok := err.(*OverlapError); err != nil && (!ok || !oerr.Saved) {
+					return err
+				}
+			}
+			return nil
+		case ProblemMissingCategory:
+			return d.SaveCategory(&Category{ID: p.IDs[0], Name: p.IDs[0]})
+		}
+		return fmt.Errorf("unknown problem: %s", p.Kind)
+	})
+}
+
+// repairLayouts are the layouts tried by repairTime, in addition to the
+// layout used before schema version 2.
+var repairLayouts = []string{
+	datetimeLayout,
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// parseRawTime parses a time stored as text using the repairLayouts. Times
+// without a utc offset are parsed in the local time zone.
+func parseRawTime(s string) (time.Time, error) {
+	for _, layout := range repairLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse time: %q", s)
+}
+
+// badTimeWhere matches the entries with start or end times that are not
+// stored as unix timestamps.
+const badTimeWhere = "typeof(start) != 'integer' OR (end IS NOT NULL AND typeof(end) != 'integer')"
+
+// checkEntries is part of the rawChecker interface.
+func (d *db) checkEntries() ([]*Entry, []*Problem, error) {
+	problems, err := d.badTimes()
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := d.conn().Query("SELECT " + entrySelect("entries") + " FROM entries WHERE NOT (" + badTimeWhere + ") ORDER BY start, id")
+	if err != nil {
+		return nil, nil, err
+	}
+	entries, err := IteratorEntries(&iterator{rows: rows})
+	return entries, problems, err
+}
+
+// badTimes returns a ProblemBadTime for every entry with times that are not
+// stored as unix timestamps.
+func (d *db) badTimes() ([]*Problem, error) {
+	rows, err := d.conn().Query("SELECT id, CAST(start AS TEXT), typeof(start), CAST(end AS TEXT), typeof(end) FROM entries WHERE " + badTimeWhere)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []*Problem
+	for rows.Next() {
+		var (
+			id           string
+			start, end   sql.NullString
+			startT, endT string
+			detail       string
+			fixable      = true
+		)
+		if err := rows.Scan(&id, &start, &startT, &end, &endT); err != nil {
+			return nil, err
+		}
+		for _, val := range []struct {
+			name, typ string
+			s         sql.NullString
+		}{{"start", startT, start}, {"end", endT, end}} {
+			if val.typ == "integer" || val.typ == "null" && val.name == "end" {
+				continue
+			} else if detail != "" {
+				detail += ", "
+			}
+			detail += fmt.Sprintf("%s %q", val.name, val.s.String)
+			if _, err := parseRawTime(val.s.String); err != nil {
+				fixable = false
+			}
+		}
+		problems = append(problems, &Problem{Kind: ProblemBadTime, IDs: []string{id}, Detail: detail, Fixable: fixable})
+	}
+	return problems, rows.Err()
+}
+
+// repairTime is part of the rawChecker interface.
+func (d *db) repairTime(id string) error {
+	return d.update(func(tx *sql.Tx) error {
+		var (
+			start, end   sql.NullString
+			startT, endT string
+		)
+		if err := tx.QueryRow("SELECT CAST(start AS TEXT), typeof(start), CAST(end AS TEXT), typeof(end) FROM entries WHERE id=?", id).Scan(&start, &startT, &end, &endT); err == sql.ErrNoRows {
+			return fmt.Errorf("entry does not exist: %s", id)
+		} else if err != nil {
+			return err
+		}
+		var converted []string
+		for _, val := range []struct {
+			column, typ string
+			s           sql.NullString
+		}{{"start", startT, start}, {"end", endT, end}} {
+			if val.typ == "integer" || val.typ == "null" && val.column == "end" {
+				continue
+			}
+			converted = append(converted, val.column)
+			t, err := parseRawTime(val.s.String)
+			if err != nil {
+				return err
+			}
+			_, offset := t.Zone()
+			q := fmt.Sprintf("UPDATE entries SET %s=?, %s_offset=? WHERE id=?", val.column, val.column)
+			if _, err := tx.Exec(q, t.Unix(), offset, id); err != nil {
+				return err
+			}
+		}
+		entry, err := txEntry(tx, "entries", id)
+		if err != nil {
+			return err
+		} else if err := entry.Valid(); err != nil {
+			return err
+		}
+		// the unreadable times of the original entry are logged as empty
+		old := *entry
+		for _, column := range converted {
+			if column == "start" {
+				old.Start = time.Time{}
+			} else {
+				old.End = time.Time{}
+			}
+		}
+		return d.logRevision(tx, RevisionEntry, id, &old, entry)
+	})
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestCheck(t *testing.T) {
+	d := mustDB(t).(*db)
+	zone := time.FixedZone("", 3600)
+	at := func(hour int) time.Time { return time.Date(2015, 9, 2, hour, 0, 0, 0, zone) }
+	work1, work2 := &Category{Name: "Work"}, &Category{Name: "Work"}
+	for _, c := range []*Category{work1, work2} {
+		if err := d.SaveCategory(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var (
+		parsable = &Entry{Start: at(8), End: at(9), CategoryID: work2.ID}
+		garbage  = &Entry{Start: at(9), End: at(10)}
+		active1  = &Entry{Start: at(10)}
+		active2  = &Entry{ID: "active2", Start: at(11)}
+		active3  = &Entry{ID: "active3", Start: at(11), Note: "started twice"}
+		missing  = &Entry{Start: at(6), End: at(7), CategoryID: "missing"}
+		orphan   = &Category{Name: "orphan", ParentID: "gone"}
+	)
+	for _, e := range []*Entry{parsable, garbage, active1, active2, active3} {
+		if err := d.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := d.Exec("PRAGMA foreign_keys = OFF"); err != nil {
+		t.Fatal(err)
+	} else if err := d.SaveEntry(missing); err != nil {
+		t.Fatal(err)
+	} else if err := d.SaveCategory(orphan); err != nil {
+		t.Fatal(err)
+	} else if _, err := d.Exec("PRAGMA foreign_keys = ON"); err != nil {
+		t.Fatal(err)
+	} else if _, err := d.Exec("UPDATE entries SET start='2015-09-02 08:00:00 +01:00' WHERE id=?", parsable.ID); err != nil {
+		t.Fatal(err)
+	} else if _, err := d.Exec("UPDATE entries SET start='garbage' WHERE id=?", garbage.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{work1.ID, work2.ID}
+	sort.Strings(ids)
+	unfixable := fmt.Sprintf(`bad time %s "start \"garbage\"" false`, []string{garbage.ID})
+	want := []string{
+		fmt.Sprintf(`bad time %s "start \"2015-09-02 08:00:00 +01:00\"" true`, []string{parsable.ID}),
+		unfixable,
+		fmt.Sprintf(`duplicate category %s "\"Work\" exists 2 times" true`, ids),
+		`missing category [gone] "used by 1 categories and 0 entries" true`,
+		`missing category [missing] "used by 0 categories and 1 entries" true`,
+		fmt.Sprintf(`multiple active entries %s "3 entries are running" true`, []string{active1.ID, active2.ID, active3.ID}),
+	}
+	sort.Strings(want)
+	problems, err := Check(d)
+	if err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(formatProblems(problems), want); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, p := range problems {
+		if err := Repair(d, p); err != nil && p.Fixable {
+			t.Errorf("%s: %s", p.Kind, err)
+		} else if err == nil && !p.Fixable {
+			t.Errorf("%s: expected error", p.Kind)
+		}
+	}
+	if problems, err := Check(d); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(formatProblems(problems), []string{unfixable}); diff != "" {
+		t.Fatal(diff)
+	}
+	categories, err := d.Categories()
+	if err != nil {
+		t.Fatal(err)
+	} else if c := categories["missing"]; c == nil || c.Name != "missing" || c.ParentID != "" {
+		t.Errorf("bad recreated category: %#v", c)
+	}
+	entries := map[string]*Entry{}
+	if itr, err := d.Query(Query{IDs: []string{parsable.ID, active1.ID}}); err != nil {
+		t.Fatal(err)
+	} else if got, err := IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else {
+		for _, e := range got {
+			entries[e.ID] = e
+		}
+	}
+	if e := entries[parsable.ID]; e == nil || !e.Start.Equal(at(8)) || categories[e.CategoryID] == nil {
+		t.Errorf("bad repaired entry: %#v", e)
+	} else if e := entries[active1.ID]; e == nil || !e.End.Equal(at(11)) {
+		t.Errorf("bad ended entry: %#v", e)
+	}
+	if trash, err := d.Trash(); err != nil {
+		t.Fatal(err)
+	} else if len(trash) != 1 || trash[0].ID != active2.ID {
+		t.Errorf("got=%v want the entry started at the same time in the trash", trash)
+	}
+	// the conversion is logged with the unreadable start as empty
+	revisions, err := d.Revisions(parsable.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var repaired bool
+	for _, r := range revisions {
+		old, ok := r.Old.(*Entry)
+		repaired = repaired || (ok && old.Start.IsZero() && old.End.Equal(at(9)) && r.New.(*Entry).Start.Equal(at(8)))
+	}
+	if !repaired {
+		t.Errorf("missing revision of repaired entry: %#v", revisions)
+	}
+}
+
+// formatProblems returns the given problems as sorted strings.
+func formatProblems(problems []*Problem) []string {
+	var s []string
+	for _, p := range problems {
+		s = append(s, fmt.Sprintf("%s %s %q %t", p.Kind, p.IDs, p.Detail, p.Fixable))
+	}
+	sort.Strings(s)
+	return s
+}
@@ -0,0 +1,643 @@
+package db
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bradfitz/slice"
+)
+
+// The files of a journal. Entries are stored in one file per month, named
+// after the month they start in, e.g. 2015-09.txt.
+const (
+	journalCategories = "categories.txt"
+	journalTrash      = "trash.txt"
+	journalRevisions  = "revisions.txt"
+	// journalLock is locked while the journal is changed, see lockFiles.
+	journalLock = "lock"
+)
+
+// journalMonth matches the names of the monthly entry files.
+var journalMonth = regexp.MustCompile(`^\d{4}-\d{2}\.txt$`)
+
+// journalTimeLayout is the layout of all times in a journal.
+const journalTimeLayout = time.RFC3339
+
+// journalEscaper escapes the characters that can't occur inside a field of a
+// journal line.
+var journalEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// NewJournal opens the journal stored in the journal sub directory of dir,
+// creating it if needed. A journal keeps all data in plain text files that
+// are suitable for version control: every line holds one object as tab
+// separated fields, and the entries are stored in one file per month, ordered
+// by start time. The files are read into memory when the journal is opened,
+// and changes are written through to them immediately. Changes lock the
+// journal and reload its files first, so several processes can use the same
+// journal, except on windows.
+func NewJournal(dir string, o Options) (DB, error) {
+	j := &journal{
+		memory: NewMemory(o).(*memory),
+		dir:    filepath.Join(dir, "journal"),
+	}
+	if err := os.MkdirAll(j.dir, 0700); err != nil {
+		return nil, err
+	} else if err := j.lockFiles(); err != nil {
+		return nil, err
+	}
+	return j, j.unlockFiles()
+}
+
+// journal implements the DB interface on top of memory, writing all changes
+// to the journal files.
+type journal struct {
+	*memory
+	// mu serializes changes, so they are written in the order they are made.
+	mu  sync.Mutex
+	dir string
+	// locked is the open lock file while a change is made, see lockFiles.
+	locked *os.File
+	// written is the number of revisions in the revisions file.
+	written int
+	// tx is true for a journal passed to a Transaction callback. Its changes
+	// are only written when the transaction succeeds, pending holds the names
+	// of the files to rewrite then.
+	tx      bool
+	pending []string
+}
+
+// SaveEntry is part of the DB interface.
+func (j *journal) SaveEntry(e *Entry) error {
+	return j.saveEntryWith(e, j.options.Overlap)
+}
+
+// saveEntryWith is part of the overlapSaver interface.
+func (j *journal) saveEntryWith(e *Entry, policy OverlapPolicy) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	err := j.memory.saveEntryWith(e, policy)
+	if oerr, ok := err.(*OverlapError); err != nil && (!ok || !oerr.Saved) {
+		return err
+	} else if ferr := j.flush(); ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// Remove is part of the DB interface.
+func (j *journal) Remove(id string) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	if err := j.memory.Remove(id); err != nil {
+		return err
+	}
+	return j.flush(journalTrash)
+}
+
+// Restore is part of the DB interface.
+func (j *journal) Restore(id string) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	if err := j.memory.Restore(id); err != nil {
+		return err
+	}
+	return j.flush(journalTrash)
+}
+
+// Purge is part of the DB interface.
+func (j *journal) Purge(before time.Time) (int, error) {
+	if err := j.begin(); err != nil {
+		return 0, err
+	}
+	defer j.end()
+	n, err := j.memory.Purge(before)
+	if err != nil {
+		return n, err
+	}
+	return n, j.flush(journalTrash)
+}
+
+// CategoryPath is part of the DB interface.
+func (j *journal) CategoryPath(names []string, create bool) (CategoryPath, error) {
+	return categoryPath(j, names, create)
+}
+
+// SaveCategory is part of the DB interface.
+func (j *journal) SaveCategory(c *Category) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	if err := j.memory.SaveCategory(c); err != nil {
+		return err
+	}
+	return j.flush()
+}
+
+// MergeCategory is part of the DB interface.
+func (j *journal) MergeCategory(src, dst string) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	if err := j.memory.MergeCategory(src, dst); err != nil {
+		return err
+	}
+	return j.flush(journalTrash)
+}
+
+// RemoveCategory is part of the DB interface.
+func (j *journal) RemoveCategory(id, reassign string) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	if err := j.memory.RemoveCategory(id, reassign); err != nil {
+		return err
+	}
+	return j.flush(journalTrash)
+}
+
+// replaceRevisions is part of the historyCopier interface. All files are
+// rewritten, as the replaced revisions don't tell which files were changed.
+func (j *journal) replaceRevisions(revisions []*Revision) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	if err := j.memory.replaceRevisions(revisions); err != nil {
+		return err
+	}
+	names := []string{journalCategories, journalTrash, journalRevisions}
+	j.memory.lock()
+	for _, e := range j.entries {
+		names = append(names, journalMonthFile(e.Start))
+	}
+	j.memory.unlock()
+	return j.flush(names...)
+}
+
+// setRemoved is part of the historyCopier interface.
+func (j *journal) setRemoved(id string, removed time.Time) error {
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	if err := j.memory.setRemoved(id, removed); err != nil {
+		return err
+	}
+	return j.flush(journalTrash)
+}
+
+// Transaction is part of the DB interface.
+func (j *journal) Transaction(fn func(DB) error) error {
+	if j.tx {
+		return fn(j)
+	}
+	if err := j.begin(); err != nil {
+		return err
+	}
+	defer j.end()
+	var tx *journal
+	err := j.memory.Transaction(func(m DB) error {
+		tx = &journal{memory: m.(*memory), dir: j.dir, tx: true}
+		return fn(tx)
+	})
+	if err != nil {
+		return err
+	}
+	return j.flush(tx.pending...)
+}
+
+// begin prepares a change of the journal: it acquires the locks of j and of
+// the journal files, see lockFiles. Within a Transaction, the files were
+// locked when it began. The locks are released by end.
+func (j *journal) begin() error {
+	j.mu.Lock()
+	if j.tx {
+		return nil
+	} else if err := j.lockFiles(); err != nil {
+		j.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// end releases the locks acquired by begin.
+func (j *journal) end() {
+	if !j.tx {
+		j.unlockFiles()
+	}
+	j.mu.Unlock()
+}
+
+// lockFiles locks the lock file of the journal, waiting until other processes
+// release it, and reloads the journal files, which they may have changed.
+func (j *journal) lockFiles() error {
+	f, err := os.OpenFile(filepath.Join(j.dir, journalLock), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	} else if err := lockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	j.locked = f
+	if err := j.reload(); err != nil {
+		j.unlockFiles()
+		return err
+	}
+	return nil
+}
+
+// unlockFiles unlocks the lock file locked by lockFiles.
+func (j *journal) unlockFiles() error {
+	f := j.locked
+	j.locked = nil
+	if err := unlockFile(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reload replaces the data of j with the content of the journal files.
+func (j *journal) reload() error {
+	loaded := &journal{memory: NewMemory(Options{}).(*memory), dir: j.dir}
+	if err := loaded.load(); err != nil {
+		return err
+	}
+	m := j.memory
+	m.mu.Lock()
+	m.entries, m.trash, m.categories, m.revisions = loaded.entries, loaded.trash, loaded.categories, loaded.revisions
+	m.mu.Unlock()
+	j.written = loaded.written
+	return nil
+}
+
+// journalMonthFile returns the name of the file holding the entries starting
+// at the given time.
+func journalMonthFile(t time.Time) string {
+	return t.Format("2006-01") + ".txt"
+}
+
+// flush appends new revisions to the revisions file and rewrites the files
+// changed by them, as well as the files with the given names. If the names
+// include the revisions file, it's rewritten instead. Files without any lines
+// are removed. Within a Transaction, the names are only recorded.
+func (j *journal) flush(names ...string) error {
+	if j.tx {
+		j.pending = append(j.pending, names...)
+		return nil
+	}
+	var (
+		contents = make(map[string]string)
+		rewrite  = false
+		written  = j.written
+	)
+	for _, name := range names {
+		rewrite = rewrite || name == journalRevisions
+	}
+	j.memory.mu.Lock()
+	if rewrite {
+		written = len(j.memory.revisions)
+	}
+	var revisions []string
+	for _, r := range j.memory.revisions[written:] {
+		revisions = append(revisions, formatJournalRevision(r))
+		changed, err := journalRevisionFiles(r)
+		if err != nil {
+			j.memory.mu.Unlock()
+			return err
+		}
+		names = append(names, changed...)
+	}
+	for _, name := range names {
+		if _, ok := contents[name]; !ok {
+			contents[name] = j.render(name)
+		}
+	}
+	j.memory.mu.Unlock()
+	for name, content := range contents {
+		path := filepath.Join(j.dir, name)
+		if content == "" {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(content), 0600); err != nil {
+			return err
+		} else if err := os.Rename(tmp, path); err != nil {
+			return err
+		}
+	}
+	if rewrite {
+		j.written = written
+		return nil
+	} else if len(revisions) == 0 {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(j.dir, journalRevisions), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(strings.Join(revisions, "")); err != nil {
+		f.Close()
+		return err
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	j.written += len(revisions)
+	return nil
+}
+
+// journalRevisionFiles returns the names of the files changed by the given
+// revision. Changes of the trash are not recorded as revisions.
+func journalRevisionFiles(r *memoryRevision) ([]string, error) {
+	if r.Kind == RevisionCategory {
+		return []string{journalCategories}, nil
+	}
+	var names []string
+	for _, val := range r.values {
+		if !val.Valid {
+			continue
+		} else if obj, err := decodeRevisionValue(r.Kind, val.String); err != nil {
+			return nil, err
+		} else {
+			names = append(names, journalMonthFile(obj.(*Entry).Start))
+		}
+	}
+	return names, nil
+}
+
+// render returns the content of the file with the given name. The caller
+// must hold the lock of the memory.
+func (j *journal) render(name string) string {
+	var lines []string
+	switch name {
+	case journalCategories:
+		var categories []*Category
+		for _, c := range j.categories {
+			categories = append(categories, c)
+		}
+		slice.Sort(categories, func(a, b int) bool { return categories[a].ID < categories[b].ID })
+		for _, c := range categories {
+			lines = append(lines, formatJournalLine(c.ID, c.ParentID, c.Name))
+		}
+	case journalRevisions:
+		for _, r := range j.revisions {
+			lines = append(lines, formatJournalRevision(r))
+		}
+	case journalTrash:
+		var entries []*TrashedEntry
+		for _, e := range j.trash {
+			entries = append(entries, e)
+		}
+		slice.Sort(entries, func(a, b int) bool {
+			if !entries[a].Removed.Equal(entries[b].Removed) {
+				return entries[a].Removed.Before(entries[b].Removed)
+			}
+			return entryLess(entries[a].Entry, entries[b].Entry)
+		})
+		for _, e := range entries {
+			fields := append([]string{e.Removed.Format(journalTimeLayout)}, journalEntryFields(e.Entry)...)
+			lines = append(lines, formatJournalLine(fields...))
+		}
+	default:
+		var entries []*Entry
+		for _, e := range j.entries {
+			if journalMonthFile(e.Start) == name {
+				entries = append(entries, e)
+			}
+		}
+		slice.Sort(entries, func(a, b int) bool { return entryLess(entries[a], entries[b]) })
+		for _, e := range entries {
+			lines = append(lines, formatJournalLine(journalEntryFields(e)...))
+		}
+	}
+	return strings.Join(lines, "")
+}
+
+// entryLess orders entries by start time and id.
+func entryLess(a, b *Entry) bool {
+	if a.Start.Unix() != b.Start.Unix() {
+		return a.Start.Unix() < b.Start.Unix()
+	}
+	return a.ID < b.ID
+}
+
+// formatJournalLine returns a journal line holding the given fields.
+func formatJournalLine(fields ...string) string {
+	for i, field := range fields {
+		fields[i] = journalEscaper.Replace(field)
+	}
+	return strings.Join(fields, "\t") + "\n"
+}
+
+// journalEntryFields returns the fields of the given entry: start, end, id,
+// category id, tags and note.
+func journalEntryFields(e *Entry) []string {
+	var end string
+	if !e.End.IsZero() {
+		end = e.End.Format(journalTimeLayout)
+	}
+	return []string{e.Start.Format(journalTimeLayout), end, e.ID, e.CategoryID, strings.Join(e.Tags, " "), e.Note}
+}
+
+// formatJournalRevision returns the journal line of the given revision: id,
+// time, kind, object id, command and the json encoded old and new values.
+func formatJournalRevision(r *memoryRevision) string {
+	return formatJournalLine(
+		strconv.FormatInt(r.ID, 10),
+		r.Time.Format(journalTimeLayout),
+		r.Kind,
+		r.ObjectID,
+		r.Command,
+		r.values[0].String,
+		r.values[1].String,
+	)
+}
+
+// load reads all journal files into memory.
+func (j *journal) load() error {
+	infos, err := ioutil.ReadDir(j.dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		path := filepath.Join(j.dir, name)
+		switch {
+		case name == journalCategories:
+			err = readJournal(path, 3, j.loadCategory)
+		case name == journalTrash:
+			err = readJournal(path, 7, j.loadTrashedEntry)
+		case name == journalRevisions:
+			err = readJournal(path, 7, j.loadRevision)
+		case journalMonth.MatchString(name):
+			err = readJournal(path, 6, j.loadEntry)
+		default:
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	j.written = len(j.memory.revisions)
+	return nil
+}
+
+func (j *journal) loadCategory(fields []string) error {
+	if fields[0] == "" {
+		return errors.New("id is required")
+	} else if j.categories[fields[0]] != nil {
+		return fmt.Errorf("duplicate category: %s", fields[0])
+	}
+	j.categories[fields[0]] = &Category{ID: fields[0], ParentID: fields[1], Name: fields[2]}
+	return nil
+}
+
+func (j *journal) loadEntry(fields []string) error {
+	e, err := parseJournalEntry(fields)
+	if err != nil {
+		return err
+	} else if j.entries[e.ID] != nil {
+		return fmt.Errorf("duplicate entry: %s", e.ID)
+	}
+	j.entries[e.ID] = e
+	return nil
+}
+
+func (j *journal) loadTrashedEntry(fields []string) error {
+	removed, err := time.Parse(journalTimeLayout, fields[0])
+	if err != nil {
+		return err
+	}
+	e, err := parseJournalEntry(fields[1:])
+	if err != nil {
+		return err
+	} else if j.trash[e.ID] != nil {
+		return fmt.Errorf("duplicate entry: %s", e.ID)
+	}
+	j.trash[e.ID] = &TrashedEntry{Entry: e, Removed: time.Unix(removed.Unix(), 0)}
+	return nil
+}
+
+func (j *journal) loadRevision(fields []string) error {
+	r := &memoryRevision{}
+	id, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse(journalTimeLayout, fields[1])
+	if err != nil {
+		return err
+	}
+	r.ID, r.Time, r.Kind, r.ObjectID, r.Command = id, time.Unix(t.Unix(), 0), fields[2], fields[3], fields[4]
+	for i, val := range fields[5:] {
+		r.values[i] = sql.NullString{String: val, Valid: val != ""}
+	}
+	j.memory.revisions = append(j.memory.revisions, r)
+	return nil
+}
+
+// parseJournalEntry returns the entry held by the fields returned by
+// journalEntryFields.
+func parseJournalEntry(fields []string) (*Entry, error) {
+	e := &Entry{ID: fields[2], CategoryID: fields[3], Tags: NormalizeTags(strings.Fields(fields[4])), Note: fields[5]}
+	start, err := time.Parse(journalTimeLayout, fields[0])
+	if err != nil {
+		return nil, err
+	}
+	e.Start = fixedZone(start)
+	if fields[1] != "" {
+		end, err := time.Parse(journalTimeLayout, fields[1])
+		if err != nil {
+			return nil, err
+		}
+		e.End = fixedZone(end)
+	}
+	if e.ID == "" {
+		return nil, errors.New("id is required")
+	}
+	return e, e.Valid()
+}
+
+// readJournal calls fn with the unescaped fields of every line of the given
+// file, skipping empty lines and lines starting with "#". An error is returned
+// if a line doesn't have the given number of fields.
+func readJournal(path string, n int, fn func([]string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != n {
+			err = fmt.Errorf("got %d fields want %d", len(fields), n)
+		}
+		for i := 0; err == nil && i < len(fields); i++ {
+			fields[i], err = journalUnescape(fields[i])
+		}
+		if err == nil {
+			err = fn(fields)
+		}
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// journalUnescape reverses journalEscaper.
+func journalUnescape(s string) (string, error) {
+	if strings.IndexByte(s, '\\') == -1 {
+		return s, nil
+	}
+	var buf []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			buf = append(buf, s[i])
+			continue
+		} else if i++; i == len(s) {
+			return "", errors.New("bad escape at end of field")
+		}
+		switch s[i] {
+		case '\\':
+			buf = append(buf, '\\')
+		case 't':
+			buf = append(buf, '\t')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		default:
+			return "", fmt.Errorf("bad escape: \\%c", s[i])
+		}
+	}
+	return string(buf), nil
+}
@@ -0,0 +1,267 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var n int
+	testConformance(t, func(t *testing.T, o Options) DB {
+		n++
+		d, err := NewJournal(filepath.Join(dir, fmt.Sprint(n)), o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	})
+}
+
+// TestJournal_reopen checks that a reopened journal holds the same data, and
+// that the entries are stored in one file per month.
+func TestJournal_reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewJournal(dir, Options{Command: "hiro test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := time.FixedZone("", 3600)
+	path, err := d.CategoryPath([]string{"a", "b"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []*Entry{
+		{ID: "1", Start: time.Date(2015, 9, 2, 10, 0, 0, 0, zone), End: time.Date(2015, 9, 2, 11, 0, 0, 0, zone), CategoryID: path[1].ID},
+		{ID: "2", Start: time.Date(2015, 9, 30, 10, 0, 0, 0, zone), Note: "tabs\tand\nnew lines\\", Tags: []string{"x", "y"}},
+		{ID: "3", Start: time.Date(2015, 10, 1, 10, 0, 0, 0, zone), Note: "removed"},
+	}
+	for _, e := range entries {
+		if err := d.SaveEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Remove("3"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "journal", "2015-09.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "2015-09-02T10:00:00+01:00\t2015-09-02T11:00:00+01:00\t1\t" + path[1].ID + "\t\t\n" +
+		"2015-09-30T10:00:00+01:00\t\t2\t\tx y\ttabs\\tand\\nnew lines\\\\\n"
+	if diff := pretty.Compare(string(data), want); diff != "" {
+		t.Fatal(diff)
+	} else if _, err := os.Stat(filepath.Join(dir, "journal", "2015-10.txt")); !os.IsNotExist(err) {
+		t.Fatalf("got=%v want empty month file to be removed", err)
+	}
+
+	reopened, err := NewJournal(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []DB{d, reopened} {
+		defer d.Close()
+	}
+	diffConfig := &pretty.Config{Diffable: true, PrintStringers: true}
+	for name, get := range map[string]func(DB) (interface{}, error){
+		"categories": func(d DB) (interface{}, error) { return d.Categories() },
+		"trash":      func(d DB) (interface{}, error) { return d.Trash() },
+		"revisions":  func(d DB) (interface{}, error) { return d.Revisions("") },
+		"entries": func(d DB) (interface{}, error) {
+			itr, err := d.Query(Query{})
+			if err != nil {
+				return nil, err
+			}
+			return IteratorEntries(itr)
+		},
+	} {
+		if want, err := get(d); err != nil {
+			t.Fatal(err)
+		} else if got, err := get(reopened); err != nil {
+			t.Fatal(err)
+		} else if diff := diffConfig.Compare(got, want); diff != "" {
+			t.Errorf("%s: %s", name, diff)
+		}
+	}
+	// new revisions are appended after the ones that were read
+	if err := reopened.Restore("3"); err != nil {
+		t.Fatal(err)
+	} else if again, err := NewJournal(dir, Options{}); err != nil {
+		t.Fatal(err)
+	} else if revisions, err := again.Revisions(""); err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 7 || revisions[0].ID != 7 || revisions[0].ObjectID != "3" {
+		t.Fatalf("bad revisions: %s", pretty.Sprint(revisions))
+	}
+}
+
+func TestJournal_badLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "journal"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "journal", "2015-09.txt")
+	if err := ioutil.WriteFile(path, []byte("# comment\n\n2015-09-02T10:00:00+01:00\t\t1\t\t\tbad \\x escape\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	want := path + ":3: bad escape: \\x"
+	if _, err := NewJournal(dir, Options{}); err == nil || err.Error() != want {
+		t.Fatalf("got=%v want=%s", err, want)
+	}
+}
+
+// TestJournal_trim checks that entries trimmed by OverlapTrim are written to
+// their own month file.
+func TestJournal_trim(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewJournal(dir, Options{Overlap: OverlapTrim})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := time.FixedZone("", 3600)
+	running := &Entry{Start: time.Date(2015, 8, 31, 22, 0, 0, 0, zone)}
+	if err := d.SaveEntry(running); err != nil {
+		t.Fatal(err)
+	} else if err := d.SaveEntry(&Entry{Start: time.Date(2015, 9, 1, 9, 0, 0, 0, zone)}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewJournal(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	itr, err := reopened.Query(Query{IDs: []string{running.ID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := IteratorEntries(itr)
+	if err != nil {
+		t.Fatal(err)
+	} else if want := time.Date(2015, 9, 1, 9, 0, 0, 0, zone); len(entries) != 1 || !entries[0].End.Equal(want) {
+		t.Fatalf("got=%s want end=%s", pretty.Sprint(entries), want)
+	}
+}
+
+// TestJournal_transaction checks that the changes of a transaction are only
+// written when it succeeds.
+func TestJournal_transaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d, err := NewJournal(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	zone := time.FixedZone("", 3600)
+	save := func(tx DB) error {
+		if _, err := tx.CategoryPath([]string{"a"}, true); err != nil {
+			return err
+		} else if err := tx.SaveEntry(&Entry{Start: time.Date(2015, 9, 2, 10, 0, 0, 0, zone)}); err != nil {
+			return err
+		} else if _, err := os.Stat(filepath.Join(dir, "journal", "2015-09.txt")); !os.IsNotExist(err) {
+			t.Errorf("got=%v want no file to be written within a transaction", err)
+		}
+		return nil
+	}
+	abort := fmt.Errorf("abort")
+	if err := d.Transaction(func(tx DB) error {
+		if err := save(tx); err != nil {
+			return err
+		}
+		return abort
+	}); err != abort {
+		t.Fatalf("got=%v want=%v", err, abort)
+	} else if files, err := ioutil.ReadDir(filepath.Join(dir, "journal")); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 1 || files[0].Name() != journalLock {
+		t.Fatalf("got=%d files want only the lock file", len(files))
+	} else if err := d.Transaction(save); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewJournal(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itr, err := reopened.Query(Query{}); err != nil {
+		t.Fatal(err)
+	} else if entries, err := IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Fatalf("got=%d entries want=1", len(entries))
+	} else if categories, err := reopened.Categories(); err != nil {
+		t.Fatal(err)
+	} else if len(categories) != 1 {
+		t.Fatalf("got=%d categories want=1", len(categories))
+	} else if revisions, err := reopened.Revisions(""); err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 2 {
+		t.Fatalf("got=%d revisions want=2", len(revisions))
+	}
+}
+
+// TestJournal_shared checks that journals opened on the same directory, as by
+// several processes, see each other's changes before making their own.
+func TestJournal_shared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var journals []DB
+	for i := 0; i < 2; i++ {
+		d, err := NewJournal(dir, Options{Overlap: OverlapReject})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer d.Close()
+		journals = append(journals, d)
+	}
+	start := time.Date(2015, 9, 2, 10, 0, 0, 0, time.UTC)
+	if err := journals[0].SaveEntry(&Entry{Start: start, End: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	} else if err := journals[1].SaveEntry(&Entry{Start: start.Add(30 * time.Minute)}); err == nil {
+		t.Fatal("expected overlap with the entry saved by the other journal")
+	} else if err := journals[1].SaveEntry(&Entry{Start: start.Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := NewJournal(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	if itr, err := reopened.Query(Query{}); err != nil {
+		t.Fatal(err)
+	} else if entries, err := IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 2 {
+		t.Fatalf("got=%d entries want=2", len(entries))
+	} else if revisions, err := reopened.Revisions(""); err != nil {
+		t.Fatal(err)
+	} else if len(revisions) != 2 || revisions[0].ID != 2 {
+		t.Fatalf("got=%d revisions want=2 with unique ids", len(revisions))
+	}
+}
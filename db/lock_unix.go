@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package db
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile acquires an exclusive lock on the given file, waiting until other
+// processes release it.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+// unlockFile releases the lock acquired by lockFile.
+func unlockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
@@ -0,0 +1,14 @@
+package db
+
+import "os"
+
+// lockFile does nothing, files are not locked on windows, so a journal must
+// not be changed by several processes at once.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+// unlockFile does nothing, see lockFile.
+func unlockFile(f *os.File) error {
+	return nil
+}
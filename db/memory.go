@@ -0,0 +1,548 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"code.google.com/p/go-uuid/uuid"
+	"github.com/bradfitz/slice"
+)
+
+// NewMemory returns a new, empty database that is kept in memory only. It
+// implements the same ordering, validation and category semantics as the
+// database returned by New, and is safe for concurrent use.
+func NewMemory(o Options) DB {
+	return &memory{
+		options:    o,
+		entries:    make(map[string]*Entry),
+		trash:      make(map[string]*TrashedEntry),
+		categories: make(CategoryMap),
+	}
+}
+
+// memory implements the DB interface in memory. All entries and categories
+// are copied when they are saved or returned, so callers can't modify them.
+type memory struct {
+	mu         sync.Mutex
+	options    Options
+	entries    map[string]*Entry
+	trash      map[string]*TrashedEntry
+	categories CategoryMap
+	revisions  []*memoryRevision
+	// tx is true for a memory passed to a Transaction callback, which works
+	// on copies of the maps while the lock of the original memory is held.
+	tx bool
+}
+
+// lock acquires the lock, unless m belongs to a Transaction.
+func (m *memory) lock() {
+	if !m.tx {
+		m.mu.Lock()
+	}
+}
+
+// unlock releases the lock acquired by lock.
+func (m *memory) unlock() {
+	if !m.tx {
+		m.mu.Unlock()
+	}
+}
+
+// memoryRevision is a revision with its old and new value encoded by
+// encodeRevision, so it's decoded the same way as the revisions of the sqlite
+// database.
+type memoryRevision struct {
+	Revision
+	values [2]sql.NullString
+}
+
+// SaveEntry is part of the DB interface.
+func (m *memory) SaveEntry(e *Entry) error {
+	return m.saveEntryWith(e, m.options.Overlap)
+}
+
+// saveEntryWith is part of the overlapSaver interface.
+func (m *memory) saveEntryWith(e *Entry, policy OverlapPolicy) error {
+	if err := normalizeEntry(e); err != nil {
+		return err
+	}
+	m.lock()
+	defer m.unlock()
+	if e.CategoryID != "" && m.categories[e.CategoryID] == nil {
+		return errors.New("category does not exist")
+	} else if e.ID == "" {
+		e.ID = uuid.NewRandom().String()
+	}
+	var candidates []*Entry
+	if policy != OverlapAllow {
+		candidates = m.query(overlapQuery(e))
+	}
+	trimmed, oerr := resolveOverlaps(policy, e, candidates)
+	if oerr != nil && !oerr.Saved {
+		return oerr
+	}
+	for _, entry := range append(trimmed, e) {
+		if err := m.saveEntry(entry); err != nil {
+			return err
+		}
+	}
+	if oerr != nil {
+		return oerr
+	}
+	return nil
+}
+
+// saveEntry saves a copy of the given normalized entry.
+func (m *memory) saveEntry(e *Entry) error {
+	entry := copyEntry(e)
+	entry.Start = fixedZone(entry.Start)
+	entry.End = fixedZone(entry.End)
+	if err := m.logRevision(RevisionEntry, e.ID, m.entries[e.ID], entry); err != nil {
+		return err
+	}
+	m.entries[e.ID] = entry
+	return nil
+}
+
+// Query is part of the DB interface.
+func (m *memory) Query(q Query) (Iterator, error) {
+	m.lock()
+	defer m.unlock()
+	return EntryIterator(m.query(q)), nil
+}
+
+// query returns copies of the entries matched by q. The caller must hold the
+// lock.
+func (m *memory) query(q Query) []*Entry {
+	var (
+		ids        map[string]bool
+		categories map[string]bool
+		entries    []*Entry
+	)
+	if len(q.IDs) > 0 {
+		ids = make(map[string]bool)
+		for _, id := range q.IDs {
+			ids[id] = true
+		}
+	}
+	if q.CategoryID != "" {
+		categories = map[string]bool{q.CategoryID: true}
+		if node := m.categories.Root().Find(q.CategoryID); node != nil && q.Recursive {
+			var add func(*CategoryNode)
+			add = func(node *CategoryNode) {
+				for _, child := range node.Children {
+					categories[child.ID] = true
+					add(child)
+				}
+			}
+			add(node)
+		}
+	}
+	hasTerms := len(parseNoteMatch(q.NoteMatch)) > 0
+	for _, e := range m.entries {
+		if ids != nil && !ids[e.ID] {
+			continue
+		} else if !strings.HasPrefix(e.ID, q.IDPrefix) {
+			continue
+		} else if q.Active && !e.End.IsZero() {
+			continue
+		} else if categories != nil && !categories[e.CategoryID] {
+			continue
+		} else if !hasTags(e, q.Tags) {
+			continue
+		} else if hasTerms && NoteMatchIndexes(e.Note, q.NoteMatch) == nil {
+			continue
+		} else if !q.From.IsZero() && !e.End.IsZero() && e.End.Unix() <= q.From.Unix() {
+			continue
+		} else if !q.To.IsZero() && e.Start.Unix() >= q.To.Unix() {
+			continue
+		} else if !q.ValidAt.IsZero() && (e.Start.Unix() > q.ValidAt.Unix() ||
+			(!e.End.IsZero() && e.End.Unix() <= q.ValidAt.Unix())) {
+			continue
+		}
+		entries = append(entries, copyEntry(e))
+	}
+	// entries with the same start are ordered by id, the order of the sqlite
+	// database is undefined for them.
+	slice.Sort(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !q.Asc {
+			a, b = b, a
+		}
+		if a.Start.Unix() != b.Start.Unix() {
+			return a.Start.Unix() < b.Start.Unix()
+		}
+		return a.ID < b.ID
+	})
+	if q.Offset >= len(entries) {
+		entries = nil
+	} else if q.Offset > 0 {
+		entries = entries[q.Offset:]
+	}
+	if q.Limit > 0 && q.Limit < len(entries) {
+		entries = entries[:q.Limit]
+	}
+	return entries
+}
+
+// hasTags returns true if the entry has all of the given tags.
+func hasTags(e *Entry, tags []string) bool {
+outer:
+	for _, tag := range tags {
+		for _, t := range e.Tags {
+			if t == tag {
+				continue outer
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Remove is part of the DB interface.
+func (m *memory) Remove(id string) error {
+	m.lock()
+	defer m.unlock()
+	entry := m.entries[id]
+	if entry == nil {
+		return fmt.Errorf("entry does not exist: %s", id)
+	} else if m.trash[id] != nil {
+		return fmt.Errorf("entry is already in trash: %s", id)
+	} else if err := m.logRevision(RevisionEntry, id, entry, nil); err != nil {
+		return err
+	}
+	delete(m.entries, id)
+	m.trash[id] = &TrashedEntry{Entry: entry, Removed: time.Unix(time.Now().Unix(), 0)}
+	return nil
+}
+
+// Trash is part of the DB interface.
+func (m *memory) Trash() ([]*TrashedEntry, error) {
+	m.lock()
+	defer m.unlock()
+	var entries []*TrashedEntry
+	for _, e := range m.trash {
+		entries = append(entries, &TrashedEntry{Entry: copyEntry(e.Entry), Removed: e.Removed})
+	}
+	slice.Sort(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.Removed.Equal(b.Removed) {
+			return a.Removed.After(b.Removed)
+		} else if a.Start.Unix() != b.Start.Unix() {
+			return a.Start.Unix() > b.Start.Unix()
+		}
+		return a.ID < b.ID
+	})
+	return entries, nil
+}
+
+// Restore is part of the DB interface.
+func (m *memory) Restore(id string) error {
+	m.lock()
+	defer m.unlock()
+	trashed := m.trash[id]
+	if trashed == nil {
+		return fmt.Errorf("entry is not in trash: %s", id)
+	} else if m.entries[id] != nil {
+		return fmt.Errorf("entry already exists: %s", id)
+	} else if err := m.logRevision(RevisionEntry, id, nil, trashed.Entry); err != nil {
+		return err
+	}
+	delete(m.trash, id)
+	m.entries[id] = trashed.Entry
+	return nil
+}
+
+// Purge is part of the DB interface.
+func (m *memory) Purge(before time.Time) (int, error) {
+	m.lock()
+	defer m.unlock()
+	var n int
+	for id, e := range m.trash {
+		if e.Removed.Unix() <= before.Unix() {
+			delete(m.trash, id)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// CategoryPath is part of the DB interface.
+func (m *memory) CategoryPath(names []string, create bool) (CategoryPath, error) {
+	return categoryPath(m, names, create)
+}
+
+// SaveCategory is part of the DB interface.
+func (m *memory) SaveCategory(c *Category) error {
+	m.lock()
+	defer m.unlock()
+	if c.ParentID != "" && m.categories[c.ParentID] == nil {
+		return errors.New("category does not exist")
+	}
+	// like the unique index of the sqlite database, this allows root
+	// categories with the same name.
+	for _, other := range m.categories {
+		if c.ParentID != "" && other.ID != c.ID && other.ParentID == c.ParentID && other.Name == c.Name {
+			return fmt.Errorf("category already exists: %s", c.Name)
+		}
+	}
+	if c.ID == "" {
+		c.ID = uuid.NewRandom().String()
+	}
+	category := *c
+	if err := m.logRevision(RevisionCategory, c.ID, m.categories[c.ID], &category); err != nil {
+		return err
+	}
+	m.categories[c.ID] = &category
+	return nil
+}
+
+// Categories is part of the DB interface.
+func (m *memory) Categories() (CategoryMap, error) {
+	m.lock()
+	defer m.unlock()
+	categories := make(CategoryMap, len(m.categories))
+	for id, c := range m.categories {
+		category := *c
+		categories[id] = &category
+	}
+	return categories, nil
+}
+
+// MergeCategory is part of the DB interface.
+func (m *memory) MergeCategory(src, dst string) error {
+	m.lock()
+	defer m.unlock()
+	if m.categories[src] == nil || m.categories[dst] == nil {
+		return errors.New("category does not exist")
+	}
+	for _, category := range m.categories.Path(dst) {
+		if category.ID == src {
+			return errors.New("category can't be merged into itself")
+		}
+	}
+	return m.mergeCategory(m.categories.Root(), src, dst)
+}
+
+// mergeCategory implements MergeCategory using the category tree root, which
+// is not updated while the categories are merged.
+func (m *memory) mergeCategory(root *CategoryNode, src, dst string) error {
+	srcNode, dstNode := root.Find(src), root.Find(dst)
+	for _, child := range srcNode.Children {
+		if nodes := dstNode.ChildrenByName(child.Name); len(nodes) > 0 {
+			if err := m.mergeCategory(root, child.ID, nodes[0].ID); err != nil {
+				return err
+			}
+			continue
+		}
+		category := *child.Category
+		category.ParentID = dst
+		if err := m.logRevision(RevisionCategory, child.ID, child.Category, &category); err != nil {
+			return err
+		}
+		m.categories[child.ID] = &category
+	}
+	if err := m.reassignEntries(src, dst); err != nil {
+		return err
+	}
+	return m.deleteCategory(src)
+}
+
+// RemoveCategory is part of the DB interface.
+func (m *memory) RemoveCategory(id, reassign string) error {
+	m.lock()
+	defer m.unlock()
+	if m.categories[id] == nil || (reassign != "" && m.categories[reassign] == nil) {
+		return errors.New("category does not exist")
+	} else if len(m.categories.Root().Find(id).Children) > 0 {
+		return errors.New("category has sub categories")
+	} else if reassign == id {
+		return errors.New("category can't be reassigned to itself")
+	}
+	for _, e := range m.entries {
+		if e.CategoryID == id && reassign == "" {
+			return errors.New("category has entries")
+		}
+	}
+	if err := m.reassignEntries(id, reassign); err != nil {
+		return err
+	}
+	return m.deleteCategory(id)
+}
+
+// reassignEntries moves all entries, including the ones in the trash, from
+// the category src to the category dst.
+func (m *memory) reassignEntries(src, dst string) error {
+	for id, e := range m.entries {
+		if e.CategoryID != src {
+			continue
+		}
+		entry := copyEntry(e)
+		entry.CategoryID = dst
+		if err := m.logRevision(RevisionEntry, id, e, entry); err != nil {
+			return err
+		}
+		m.entries[id] = entry
+	}
+	// trashed entries are replaced rather than modified, since they may be
+	// shared with the memory a Transaction was started from.
+	for id, e := range m.trash {
+		if e.CategoryID == src {
+			entry := copyEntry(e.Entry)
+			entry.CategoryID = dst
+			m.trash[id] = &TrashedEntry{Entry: entry, Removed: e.Removed}
+		}
+	}
+	return nil
+}
+
+// deleteCategory deletes the category with the given id.
+func (m *memory) deleteCategory(id string) error {
+	if err := m.logRevision(RevisionCategory, id, m.categories[id], nil); err != nil {
+		return err
+	}
+	delete(m.categories, id)
+	return nil
+}
+
+// logRevision appends a revision to the revision log, unless old and new are
+// equal. Either old or new may be nil, if the object was created or deleted.
+func (m *memory) logRevision(kind, id string, old, new interface{}) error {
+	values, err := encodeRevision(old, new)
+	if err != nil || values[0] == values[1] {
+		return err
+	}
+	var last int64
+	if len(m.revisions) > 0 {
+		last = m.revisions[len(m.revisions)-1].ID
+	}
+	m.revisions = append(m.revisions, &memoryRevision{
+		Revision: Revision{
+			ID:       last + 1,
+			Time:     time.Unix(time.Now().Unix(), 0),
+			Kind:     kind,
+			ObjectID: id,
+			Command:  m.options.Command,
+		},
+		values: values,
+	})
+	return nil
+}
+
+// replaceRevisions is part of the historyCopier interface.
+func (m *memory) replaceRevisions(revisions []*Revision) error {
+	m.lock()
+	defer m.unlock()
+	replaced := make([]*memoryRevision, len(revisions))
+	for i, r := range revisions {
+		values, err := encodeRevision(r.Old, r.New)
+		if err != nil {
+			return err
+		}
+		replaced[i] = &memoryRevision{
+			Revision: Revision{
+				ID:       r.ID,
+				Time:     time.Unix(r.Time.Unix(), 0),
+				Kind:     r.Kind,
+				ObjectID: r.ObjectID,
+				Command:  r.Command,
+			},
+			values: values,
+		}
+	}
+	m.revisions = replaced
+	return nil
+}
+
+// setRemoved is part of the historyCopier interface.
+func (m *memory) setRemoved(id string, removed time.Time) error {
+	m.lock()
+	defer m.unlock()
+	e := m.trash[id]
+	if e == nil {
+		return fmt.Errorf("entry is not in trash: %s", id)
+	}
+	m.trash[id] = &TrashedEntry{Entry: e.Entry, Removed: time.Unix(removed.Unix(), 0)}
+	return nil
+}
+
+// Revisions is part of the DB interface.
+func (m *memory) Revisions(id string) ([]*Revision, error) {
+	m.lock()
+	defer m.unlock()
+	var revisions []*Revision
+	for i := len(m.revisions) - 1; i >= 0; i-- {
+		if id != "" && m.revisions[i].ObjectID != id {
+			continue
+		}
+		r := m.revisions[i].Revision
+		if err := decodeRevision(&r, m.revisions[i].values); err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, &r)
+	}
+	return revisions, nil
+}
+
+// Transaction is part of the DB interface. The entries and categories are
+// never modified in place, so the transaction works on shallow copies of the
+// maps that replace the original ones if fn succeeds.
+func (m *memory) Transaction(fn func(DB) error) error {
+	if m.tx {
+		return fn(m)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tx := &memory{
+		options:    m.options,
+		entries:    make(map[string]*Entry, len(m.entries)),
+		trash:      make(map[string]*TrashedEntry, len(m.trash)),
+		categories: make(CategoryMap, len(m.categories)),
+		// appending to the revisions of tx must not modify the ones of m
+		revisions: m.revisions[:len(m.revisions):len(m.revisions)],
+		tx:        true,
+	}
+	for id, e := range m.entries {
+		tx.entries[id] = e
+	}
+	for id, e := range m.trash {
+		tx.trash[id] = e
+	}
+	for id, c := range m.categories {
+		tx.categories[id] = c
+	}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	m.entries, m.trash, m.categories, m.revisions = tx.entries, tx.trash, tx.categories, tx.revisions
+	return nil
+}
+
+// Close is part of the DB interface.
+func (m *memory) Close() error {
+	return nil
+}
+
+// copyEntry returns a copy of the given entry that doesn't share its tags.
+func copyEntry(e *Entry) *Entry {
+	entry := *e
+	entry.Tags = append([]string(nil), e.Tags...)
+	if len(entry.Tags) == 0 {
+		entry.Tags = nil
+	}
+	return &entry
+}
+
+// fixedZone returns t in a fixed zone with its utc offset, the way the sqlite
+// database returns stored times.
+func fixedZone(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	_, offset := t.Zone()
+	return time.Unix(t.Unix(), 0).In(time.FixedZone("", offset))
+}
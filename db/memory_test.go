@@ -0,0 +1,38 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemory(t *testing.T) {
+	testConformance(t, func(t *testing.T, o Options) DB { return NewMemory(o) })
+}
+
+// TestMemory_copies checks that callers can't modify the stored entries.
+func TestMemory_copies(t *testing.T) {
+	d := NewMemory(Options{})
+	e := &Entry{Start: time.Now(), Tags: []string{"a"}}
+	if err := d.SaveEntry(e); err != nil {
+		t.Fatal(err)
+	}
+	e.Note, e.Tags[0] = "changed", "b"
+	itr, err := d.Query(Query{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := IteratorEntries(itr)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := entries[0]; got.Note != "" || got.Tags[0] != "a" {
+		t.Fatalf("stored entry was modified: %#v", got)
+	}
+	entries[0].Tags[0] = "c"
+	if itr, err := d.Query(Query{Tags: []string{"a"}}); err != nil {
+		t.Fatal(err)
+	} else if entries, err := IteratorEntries(itr); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 {
+		t.Fatalf("got=%d want=1", len(entries))
+	}
+}
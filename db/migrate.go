@@ -0,0 +1,218 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migrations holds the schema migrations in the order they are applied. The
+// schema version of a database is the number of migrations that have been
+// applied to it, and is stored in its user_version pragma.
+//
+// Migrations must never be changed or removed once they have been released,
+// new schema changes have to be appended as a new migration instead.
+var migrations = []migration{
+	// 1: initial schema. Databases created before versioning was introduced
+	// already have these tables, so this migration must remain idempotent.
+	migrateSQL(`
+CREATE TABLE IF NOT EXISTS categories (
+	id TEXT PRIMARY KEY,
+	name TEXT,
+	parent_id TEXT REFERENCES categories
+);
+CREATE INDEX IF NOT EXISTS parent_id ON categories(parent_id);
+CREATE UNIQUE INDEX IF NOT EXISTS name_parent_id ON categories(name, parent_id);
+
+CREATE TABLE IF NOT EXISTS entries (
+	id TEXT PRIMARY KEY,
+	start TEXT,
+	end TEXT,
+	note TEXT,
+	category_id TEXT REFERENCES categories
+);
+CREATE INDEX IF NOT EXISTS category_id ON entries(category_id);
+`),
+	// 2: store start and end as indexed unix timestamps plus their utc offset.
+	migrateEntryTimestamps,
+	// 3: full text index for entry notes, see Query.NoteMatch.
+	migrateSQL(`
+CREATE VIRTUAL TABLE entries_fts USING fts4(id, note, notindexed=id);
+INSERT INTO entries_fts (id, note) SELECT id, note FROM entries;
+`),
+	// 4: trash for removed entries. The category_id is not a foreign key, so
+	// categories can be removed without purging the trash.
+	migrateSQL(`
+CREATE TABLE trash (
+	id TEXT PRIMARY KEY,
+	start INTEGER,
+	start_offset INTEGER,
+	end INTEGER,
+	end_offset INTEGER,
+	note TEXT,
+	category_id TEXT,
+	removed INTEGER
+);
+CREATE INDEX trash_removed ON trash(removed);
+`),
+	// 5: append-only revision log of entries and categories.
+	migrateSQL(`
+CREATE TABLE revisions (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time INTEGER,
+	kind TEXT,
+	object_id TEXT,
+	old TEXT,
+	new TEXT,
+	command TEXT
+);
+CREATE INDEX revisions_object_id ON revisions(object_id);
+`),
+	// 6: tags of entries. The entry_id is not a foreign key, so entries keep
+	// their tags while they are in the trash.
+	migrateSQL(`
+CREATE TABLE tags (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	name TEXT UNIQUE
+);
+CREATE TABLE entry_tags (
+	entry_id TEXT,
+	tag_id INTEGER REFERENCES tags,
+	PRIMARY KEY (entry_id, tag_id)
+);
+CREATE INDEX entry_tags_tag_id ON entry_tags(tag_id);
+`),
+}
+
+// migration upgrades the schema within the given transaction.
+type migration func(*sql.Tx) error
+
+// migrateSQL returns a migration executing the given sql statements.
+func migrateSQL(q string) migration {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(q)
+		return err
+	}
+}
+
+// SchemaVersion returns the schema version understood by this package.
+func SchemaVersion() int {
+	return len(migrations)
+}
+
+// schemaVersion returns the schema version of the database.
+func (d *db) schemaVersion() (int, error) {
+	var version int
+	err := d.QueryRow("PRAGMA user_version").Scan(&version)
+	return version, err
+}
+
+// migrate applies all pending migrations inside a single transaction. If the
+// database is stored in a file and already contains data, a backup is created
+// before it is upgraded. An error is returned if the database has a newer
+// schema than this package understands.
+func (d *db) migrate() error {
+	version, err := d.schemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("db schema version %d is newer than supported version %d, please upgrade hiro", version, len(migrations))
+	} else if version == len(migrations) {
+		return nil
+	}
+	if err := d.backup(version); err != nil {
+		return fmt.Errorf("could not backup db: %s", err)
+	}
+	return d.update(func(tx *sql.Tx) error {
+		// another process may have migrated the db in the meantime
+		if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+			return err
+		}
+		for i := version; i < len(migrations); i++ {
+			if err := migrations[i](tx); err != nil {
+				return fmt.Errorf("migration %d failed: %s", i+1, err)
+			}
+		}
+		// PRAGMA does not support placeholders, but len(migrations) is an int.
+		_, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", len(migrations)))
+		return err
+	})
+}
+
+// backup writes a copy of the database file next to it, if the database is
+// stored in a file and is not empty. The name of the backup includes the
+// given schema version and the current time.
+func (d *db) backup(version int) error {
+	if d.path == "" {
+		return nil
+	}
+	var tables int
+	if err := d.QueryRow("SELECT count(*) FROM sqlite_master").Scan(&tables); err != nil {
+		return err
+	} else if tables == 0 {
+		return nil
+	}
+	name := fmt.Sprintf("%s.v%d-%s.bak", d.path, version, time.Now().Format("20060102150405"))
+	_, err := d.Exec("VACUUM INTO ?", name)
+	return err
+}
+
+// migrateEntryTimestamps converts the start and end columns of the entries
+// table from formatted strings into seconds since the unix epoch, keeping the
+// original utc offset in separate columns. Values that can't be parsed are
+// copied as is, so no data is lost.
+func migrateEntryTimestamps(tx *sql.Tx) error {
+	if _, err := tx.Exec(`
+CREATE TABLE entries_new (
+	id TEXT PRIMARY KEY,
+	start INTEGER,
+	start_offset INTEGER,
+	end INTEGER,
+	end_offset INTEGER,
+	note TEXT,
+	category_id TEXT REFERENCES categories
+);
+`); err != nil {
+		return err
+	}
+	rows, err := tx.Query("SELECT id, start, end, note, category_id FROM entries")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			id, note, categoryID sql.NullString
+			start, end           sql.NullString
+		)
+		if err := rows.Scan(&id, &start, &end, &note, &categoryID); err != nil {
+			return err
+		}
+		args := []interface{}{id, nil, nil, nil, nil, note, categoryID}
+		for i, val := range []sql.NullString{start, end} {
+			if !val.Valid {
+				continue
+			} else if t, err := time.Parse(datetimeLayout, val.String); err != nil {
+				args[1+i*2] = val.String
+			} else {
+				_, offset := t.Zone()
+				args[1+i*2], args[2+i*2] = t.Unix(), offset
+			}
+		}
+		if _, err := tx.Exec("INSERT INTO entries_new VALUES (?, ?, ?, ?, ?, ?, ?)", args...); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+DROP TABLE entries;
+ALTER TABLE entries_new RENAME TO entries;
+CREATE INDEX category_id ON entries(category_id);
+CREATE INDEX start ON entries(start);
+CREATE INDEX end ON entries(end);
+`)
+	return err
+}
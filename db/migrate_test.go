@@ -0,0 +1,163 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestMigrate(t *testing.T) {
+	d := mustDB(t).(*db)
+	if version, err := d.schemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if version != SchemaVersion() {
+		t.Fatalf("got=%d want=%d", version, SchemaVersion())
+	}
+	// migrating an up to date db is a no-op
+	if err := d.migrate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate_newerVersion(t *testing.T) {
+	d := mustDB(t).(*db)
+	if _, err := d.Exec("PRAGMA user_version = 1000"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.migrate(); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Fatalf("got=%v want newer version error", err)
+	}
+}
+
+func TestMigrate_rollback(t *testing.T) {
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = append(migrations,
+		migrateSQL("CREATE TABLE migrate_test (id TEXT)"),
+		func(*sql.Tx) error { return errors.New("boom") },
+	)
+	d := mustDBVersion(t, len(migrations)-2)
+	if err := d.migrate(); err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("got=%v want boom", err)
+	}
+	if version, err := d.schemaVersion(); err != nil {
+		t.Fatal(err)
+	} else if version != len(migrations)-2 {
+		t.Fatalf("got=%d want=%d", version, len(migrations)-2)
+	}
+	var n int
+	if err := d.QueryRow("SELECT count(*) FROM sqlite_master WHERE name = 'migrate_test'").Scan(&n); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatal("migration was not rolled back")
+	}
+}
+
+func TestNew_backup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hiro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// a legacy db created before schema versioning was introduced
+	legacy, err := sql.Open("sqlite3", filepath.Join(dir, "hiro.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := legacy.Begin()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := migrations[0](tx); err != nil {
+		t.Fatal(err)
+	} else if _, err := tx.Exec("INSERT INTO categories (id, name) VALUES ('1', 'a')"); err != nil {
+		t.Fatal(err)
+	} else if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	} else if err := legacy.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := New(dir, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if categories, err := d.Categories(); err != nil {
+		t.Fatal(err)
+	} else if len(categories) != 1 {
+		t.Fatalf("got=%d categories want=1", len(categories))
+	}
+	backups, err := filepath.Glob(filepath.Join(dir, "hiro.db.v0-*.bak"))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(backups) != 1 {
+		t.Fatalf("got=%d backups want=1", len(backups))
+	}
+}
+
+// mustDBVersion returns an in-memory db migrated to the given version.
+func mustDBVersion(t *testing.T, version int) *db {
+	sqlLite, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlLite.SetMaxOpenConns(1)
+	d := &db{DB: sqlLite}
+	defer func(m []migration) { migrations = m }(migrations)
+	migrations = migrations[:version]
+	if err := d.init(); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestMigrateEntryTimestamps(t *testing.T) {
+	d := mustDBVersion(t, 1)
+	if _, err := d.Exec(`
+INSERT INTO entries (id, start, end, note) VALUES
+	('1', '2015-09-02 15:36:13 +01:00', '2015-09-02 16:00:00 +02:00', 'a'),
+	('2', '2015-09-02 17:00:00 -03:30', NULL, 'b'),
+	('3', 'garbage', NULL, 'c');
+`); err != nil {
+		t.Fatal(err)
+	} else if err := d.migrate(); err != nil {
+		t.Fatal(err)
+	}
+	itr, err := d.Query(Query{IDs: []string{"1", "2"}, Asc: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := IteratorEntries(itr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Entry{
+		{
+			ID:    "1",
+			Start: time.Date(2015, 9, 2, 15, 36, 13, 0, time.FixedZone("", 3600)),
+			End:   time.Date(2015, 9, 2, 16, 0, 0, 0, time.FixedZone("", 7200)),
+			Note:  "a",
+		},
+		{
+			ID:    "2",
+			Start: time.Date(2015, 9, 2, 17, 0, 0, 0, time.FixedZone("", -12600)),
+			Note:  "b",
+		},
+	}
+	diffConfig := &pretty.Config{Diffable: true, PrintStringers: true}
+	if diff := diffConfig.Compare(entries, want); diff != "" {
+		t.Fatal(diff)
+	}
+	var garbage string
+	if err := d.QueryRow("SELECT start FROM entries WHERE id = '3'").Scan(&garbage); err != nil {
+		t.Fatal(err)
+	} else if garbage != "garbage" {
+		t.Fatalf("got=%q want=%q", garbage, "garbage")
+	}
+}
@@ -2,8 +2,12 @@ package db
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"sort"
+	"strings"
 	"time"
+	"unicode"
 
 	"github.com/bradfitz/slice"
 )
@@ -45,6 +49,8 @@ type Entry struct {
 	Start      time.Time
 	End        time.Time
 	Note       string
+	// Tags holds the tags of the entry, see NormalizeTags.
+	Tags []string
 }
 
 func (e Entry) Valid() error {
@@ -53,9 +59,29 @@ func (e Entry) Valid() error {
 	} else if !e.End.IsZero() && !e.End.After(e.Start) {
 		return errors.New("end must be after start")
 	}
+	for _, tag := range e.Tags {
+		if tag == "" || strings.IndexFunc(tag, unicode.IsSpace) != -1 {
+			return fmt.Errorf("bad tag: %q", tag)
+		}
+	}
 	return nil
 }
 
+// NormalizeTags returns the given tags sorted and without duplicates, or nil
+// if there are none.
+func NormalizeTags(tags []string) []string {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
 func (e Entry) Duration(now time.Time) time.Duration {
 	end := e.End
 	if end.IsZero() {
@@ -90,7 +116,8 @@ func (e *Entry) Equal(o *Entry) bool {
 			e.Start.Equal(o.Start) &&
 			e.End.Equal(o.End) &&
 			e.Note == o.Note &&
-			e.CategoryID == o.CategoryID)
+			e.CategoryID == o.CategoryID &&
+			strings.Join(e.Tags, " ") == strings.Join(o.Tags, " "))
 }
 
 // @TODO can this be removed?
@@ -98,6 +125,34 @@ func (e *Entry) Empty() bool {
 	return e.Equal(&Entry{})
 }
 
+// TrashedEntry is an entry that has been moved into the trash.
+type TrashedEntry struct {
+	*Entry
+	// Removed is the time the entry was moved into the trash.
+	Removed time.Time
+}
+
+// Revision kinds.
+const (
+	RevisionEntry    = "entry"
+	RevisionCategory = "category"
+)
+
+// Revision records a change of an entry or category.
+type Revision struct {
+	ID   int64
+	Time time.Time
+	// Kind is the kind of the changed object, RevisionEntry or
+	// RevisionCategory.
+	Kind     string
+	ObjectID string
+	// Old and New hold the *Entry or *Category before and after the change.
+	// Old is nil if the object was created, and New if it was removed.
+	Old, New interface{}
+	// Command is the command that made the change, see Options.Command.
+	Command string
+}
+
 type Category struct {
 	ID       string
 	Name     string
@@ -126,6 +181,22 @@ func (c *CategoryNode) ChildrenByName(name string) []*CategoryNode {
 	return nodes
 }
 
+// Find returns the node of the category with the given id from the tree below
+// c, or nil if there is none.
+func (c *CategoryNode) Find(id string) *CategoryNode {
+	if c == nil {
+		return nil
+	} else if c.Category != nil && c.ID == id {
+		return c
+	}
+	for _, node := range c.Children {
+		if found := node.Find(id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
 // CategoryPath holds a path of the category tree.
 type CategoryPath []*Category
 
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// OverlapPolicy defines how SaveEntry handles entries that overlap with other
+// entries. Entries without an end time are considered to be running forever.
+type OverlapPolicy int
+
+const (
+	// OverlapAllow saves entries without checking for overlaps.
+	OverlapAllow OverlapPolicy = iota
+	// OverlapReject doesn't save entries that overlap with other entries and
+	// returns an *OverlapError instead.
+	OverlapReject
+	// OverlapWarn saves entries that overlap with other entries, but returns
+	// an *OverlapError with Saved set to true.
+	OverlapWarn
+	// OverlapTrim trims the overlapping entries: Entries starting before the
+	// saved entry end at its start, and entries ending after it start at its
+	// end. If an overlapping entry can't be trimmed because it would be
+	// empty, or because it contains the saved entry and would lose its start
+	// or its end, the entry is rejected like with OverlapReject.
+	OverlapTrim
+)
+
+// overlapPolicies maps the names of the policies to the policies.
+var overlapPolicies = map[string]OverlapPolicy{
+	"allow":  OverlapAllow,
+	"reject": OverlapReject,
+	"warn":   OverlapWarn,
+	"trim":   OverlapTrim,
+}
+
+// ParseOverlapPolicy returns the OverlapPolicy with the given name, e.g.
+// "reject", or an error.
+func ParseOverlapPolicy(s string) (OverlapPolicy, error) {
+	if policy, ok := overlapPolicies[strings.ToLower(s)]; ok {
+		return policy, nil
+	}
+	return 0, fmt.Errorf("bad overlap policy: %s", s)
+}
+
+// OverlapError is returned by SaveEntry if the saved entry overlaps with
+// other entries, see OverlapPolicy.
+type OverlapError struct {
+	// Entry is the entry passed to SaveEntry.
+	Entry *Entry
+	// Overlaps holds the entries overlapping with Entry, ordered by start.
+	Overlaps []*Entry
+	// Saved is true if Entry was saved despite the overlaps.
+	Saved bool
+}
+
+func (e *OverlapError) Error() string {
+	if len(e.Overlaps) == 1 {
+		return "entry overlaps with another entry"
+	}
+	return fmt.Sprintf("entry overlaps with %d other entries", len(e.Overlaps))
+}
+
+// overlapSaver is implemented by databases that can save an entry with a
+// given OverlapPolicy instead of the one of their Options, see Import.
+type overlapSaver interface {
+	// saveEntryWith is like SaveEntry, but applies the given policy.
+	saveEntryWith(e *Entry, policy OverlapPolicy) error
+}
+
+// overlapQuery returns the query for the entries overlapping with e,
+// including e itself.
+func overlapQuery(e *Entry) Query {
+	return Query{From: e.Start, To: e.End, Asc: true}
+}
+
+// resolveOverlaps applies the given policy to the entry e and the entries
+// returned by overlapQuery. It returns the trimmed entries that have to be
+// saved along with e, or an *OverlapError. The entry may only be saved if the
+// error is nil or Saved is true.
+func resolveOverlaps(policy OverlapPolicy, e *Entry, candidates []*Entry) ([]*Entry, *OverlapError) {
+	var overlaps []*Entry
+	for _, candidate := range candidates {
+		if candidate.ID != e.ID {
+			overlaps = append(overlaps, candidate)
+		}
+	}
+	if len(overlaps) == 0 || policy == OverlapAllow {
+		return nil, nil
+	}
+	oerr := &OverlapError{Entry: e, Overlaps: overlaps}
+	switch policy {
+	case OverlapWarn:
+		oerr.Saved = true
+		return nil, oerr
+	case OverlapTrim:
+		var trimmed []*Entry
+		for _, overlap := range overlaps {
+			entry := copyEntry(overlap)
+			if entry.Start.Before(e.Start) && !e.End.IsZero() && (entry.End.IsZero() || entry.End.After(e.End)) {
+				return nil, oerr
+			} else if entry.Start.Before(e.Start) {
+				entry.End = e.Start
+			} else if !e.End.IsZero() && (entry.End.IsZero() || entry.End.After(e.End)) {
+				entry.Start = e.End
+			} else {
+				return nil, oerr
+			}
+			trimmed = append(trimmed, entry)
+		}
+		return trimmed, nil
+	}
+	return nil, oerr
+}
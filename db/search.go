@@ -0,0 +1,136 @@
+package db
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// matchTerm is a single term of a Query.NoteMatch query. Terms that consist of
+// more than one token, e.g. "ABC-123", match the tokens as a phrase.
+type matchTerm struct {
+	tokens []string
+	prefix bool
+}
+
+// parseNoteMatch splits the given Query.NoteMatch query into its terms. Terms
+// without any tokens are dropped.
+func parseNoteMatch(q string) []matchTerm {
+	var terms []matchTerm
+	for _, field := range strings.Fields(q) {
+		term := matchTerm{prefix: strings.HasSuffix(field, "*")}
+		for _, t := range tokenize(field) {
+			term.tokens = append(term.tokens, t.s)
+		}
+		if len(term.tokens) > 0 {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// EmptyNoteMatch returns true if the given Query.NoteMatch query has no terms,
+// e.g. because it consists of punctuation only, so it would match all entries.
+func EmptyNoteMatch(q string) bool {
+	return len(parseNoteMatch(q)) == 0
+}
+
+// ftsQuery returns the sqlite full text query for the given terms. Every term
+// is quoted as a phrase, so sqlite's query operators can't be triggered by
+// accident.
+func ftsQuery(terms []matchTerm) string {
+	phrases := make([]string, len(terms))
+	for i, term := range terms {
+		phrase := strings.Join(term.tokens, " ")
+		if term.prefix {
+			phrase += "*"
+		}
+		phrases[i] = `"` + phrase + `"`
+	}
+	return strings.Join(phrases, " ")
+}
+
+// token is a word of a note and its byte offsets.
+type token struct {
+	s          string
+	start, end int
+}
+
+// tokenize splits s into lower cased tokens the same way the "simple"
+// tokenizer of sqlite's full text index does: Tokens are made of ASCII
+// letters and digits as well as all non-ASCII characters, and only ASCII
+// characters are case folded.
+func tokenize(s string) []token {
+	var (
+		tokens []token
+		start  = -1
+	)
+	for i, r := range s + " " {
+		isToken := r >= utf8.RuneSelf ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if isToken && start == -1 {
+			start = i
+		} else if !isToken && start != -1 {
+			tokens = append(tokens, token{s: asciiLower(s[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	return tokens
+}
+
+func asciiLower(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// NoteMatchIndexes returns the byte offsets of the words in note that are
+// matched by the given Query.NoteMatch query, as pairs of start and end
+// offsets. If the note doesn't match the query, nil is returned.
+func NoteMatchIndexes(note, q string) [][]int {
+	var (
+		terms   = parseNoteMatch(q)
+		tokens  = tokenize(note)
+		indexes [][]int
+		matched = make([]bool, len(tokens))
+	)
+	if len(terms) == 0 {
+		return nil
+	}
+	for _, term := range terms {
+		found := false
+		for i := 0; i+len(term.tokens) <= len(tokens); i++ {
+			if term.matches(tokens[i : i+len(term.tokens)]) {
+				found = true
+				for j := range term.tokens {
+					matched[i+j] = true
+				}
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	for i, t := range tokens {
+		if matched[i] {
+			indexes = append(indexes, []int{t.start, t.end})
+		}
+	}
+	return indexes
+}
+
+// matches returns true if the term matches the given tokens.
+func (m matchTerm) matches(tokens []token) bool {
+	for i, want := range m.tokens {
+		if got := tokens[i].s; got == want {
+			continue
+		} else if m.prefix && i == len(m.tokens)-1 && strings.HasPrefix(got, want) {
+			continue
+		}
+		return false
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestNoteMatchIndexes(t *testing.T) {
+	tests := []struct {
+		Note  string
+		Query string
+		Want  [][]int
+	}{
+		{Note: "foo bar", Query: "", Want: nil},
+		{Note: "foo bar", Query: "baz", Want: nil},
+		{Note: "foo bar", Query: "BAR", Want: [][]int{{4, 7}}},
+		{Note: "foo bar", Query: "bar foo", Want: [][]int{{0, 3}, {4, 7}}},
+		{Note: "foo bar", Query: "bar baz", Want: nil},
+		{Note: "foo bar", Query: "ba", Want: nil},
+		{Note: "foo bar", Query: "ba*", Want: [][]int{{4, 7}}},
+		{Note: "Ticket ABC-123, abc", Query: "abc-123", Want: [][]int{{7, 10}, {11, 14}}},
+		{Note: "Ticket ABC 999 123", Query: "abc-123", Want: nil},
+		{Note: "Ticket ABC-1234", Query: "abc-12*", Want: [][]int{{7, 10}, {11, 15}}},
+		{Note: "Käse bar", Query: "käse", Want: [][]int{{0, 5}}},
+		{Note: "foo bar", Query: "-- *", Want: nil},
+	}
+	for _, test := range tests {
+		got := NoteMatchIndexes(test.Note, test.Query)
+		if diff := pretty.Compare(got, test.Want); diff != "" {
+			t.Errorf("test %q %q: %s", test.Note, test.Query, diff)
+		}
+	}
+}
+
+func Test_ftsQuery(t *testing.T) {
+	got := ftsQuery(parseNoteMatch(`foo ABC-123 "bar" baz* OR -x`))
+	want := `"foo" "abc 123" "bar" "baz*" "or" "x"`
+	if got != want {
+		t.Errorf("got=%q want=%q", got, want)
+	}
+}
+
+func TestEmptyNoteMatch(t *testing.T) {
+	tests := map[string]bool{
+		"":         true,
+		" - ?! * ": true,
+		"foo":      false,
+		"-x":       false,
+	}
+	for q, want := range tests {
+		if got := EmptyNoteMatch(q); got != want {
+			t.Errorf("%q: got=%t want=%t", q, got, want)
+		}
+	}
+}